@@ -0,0 +1,227 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoApprovalStore       = errors.New("no approval store has been configured")
+	ErrApprovalNotFound      = errors.New("approval request does not exist")
+	ErrApprovalExpired       = errors.New("approval request is expired")
+	ErrApprovalStatusChanged = errors.New("approval request status has changed")
+)
+
+// ApprovalStatus is the state of a cross-device sign in request.
+type ApprovalStatus string
+
+const (
+	// ApprovalPending requests wait for the user to follow the link
+	ApprovalPending ApprovalStatus = "pending"
+	// ApprovalApproved requests were approved from the link, and wait for
+	// the originating device to complete sign in
+	ApprovalApproved ApprovalStatus = "approved"
+	// ApprovalDenied requests were rejected from the link
+	ApprovalDenied ApprovalStatus = "denied"
+	// ApprovalCompleted requests were used to sign in
+	ApprovalCompleted ApprovalStatus = "completed"
+	// ApprovalExpired is reported for pending requests past their expiry.
+	// It is never stored.
+	ApprovalExpired ApprovalStatus = "expired"
+)
+
+// Approval is a sign in request made on one device, e.g. a laptop, that is
+// approved by following a link on another, e.g. a phone.
+type Approval struct {
+	// ID of the request, included in the links sent to the user
+	ID string
+	// PollHash is the SHA-256 hash of the secret the originating device
+	// polls with, see `RequestApproval`
+	PollHash string
+	// UID of the user the request was made for. It is empty for unknown
+	// users, whose requests are never approved.
+	UID    string
+	Status ApprovalStatus
+	// IP and UserAgent of the originating device, shown when approving
+	IP        string
+	UserAgent string
+	Expires   time.Time
+	Created   time.Time
+}
+
+// ApprovalStore persists approval requests.
+type ApprovalStore interface {
+	// CreateApproval stores a new approval request
+	CreateApproval(ctx context.Context, a *Approval) error
+	// GetApproval returns the approval request with the given ID, or
+	// ErrApprovalNotFound
+	GetApproval(ctx context.Context, id string) (*Approval, error)
+	// TransitionApproval changes the status of the request from one status
+	// to another. It fails with ErrApprovalStatusChanged if the request is
+	// not in the from status, so that each transition happens at most once.
+	TransitionApproval(ctx context.Context, id string, from, to ApprovalStatus) error
+}
+
+// RequestApproval starts a cross-device sign in. Like `RequestToken` it
+// sends a PurposeLogin token to the user, and in addition returns a poll
+// token. The originating device keeps the poll token secret and polls
+// `PollApproval`, while the token is used with `ApproveRequest` from any
+// device, e.g. by following a magic link. The request ID, which is part
+// of the poll token but can't be used to poll, is available to the
+// strategy via `ApprovalIDFromContext`, so it can be included in links.
+func (p *Passwordless) RequestApproval(ctx context.Context, s, uid, recipient string) (string, error) {
+	if p.Approvals == nil {
+		return "", errors.WithStack(ErrNoApprovalStore)
+	}
+	// The request is bound to the user it is made for
+	ruid, rrecipient, err := p.resolve(ctx, s, uid, recipient)
+	if errors.Is(err, ErrUnknownUser) {
+		uid = ""
+	} else if err != nil {
+		return "", err
+	} else {
+		uid, recipient = ruid, rrecipient
+	}
+	t, err := p.GetStrategy(WithRecipient(ctx, recipient), s)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	secret := hex.EncodeToString(b[16:])
+	now := time.Now().UTC()
+	a := &Approval{
+		ID:       hex.EncodeToString(b[:16]),
+		PollHash: hashPollSecret(secret),
+		UID:      uid,
+		Status:   ApprovalPending,
+		Expires:  now.Add(t.TTL(ctx)),
+		Created:  now,
+	}
+	if r := RequestFromContext(ctx); r != nil {
+		a.IP = remoteHost(r)
+		a.UserAgent = r.UserAgent()
+	}
+	if err := p.Approvals.CreateApproval(ctx, a); err != nil {
+		return "", err
+	}
+	// Requests for unknown users are created all the same, and simply never
+	// get approved
+	if err := p.RequestToken(WithApprovalID(ctx, a.ID), PurposeLogin, s, uid, recipient); err != nil {
+		return "", err
+	}
+	return a.ID + "." + secret, nil
+}
+
+// GetApproval returns the approval request, e.g. to show the user where it
+// was made from before approving.
+func (p *Passwordless) GetApproval(ctx context.Context, id string) (*Approval, error) {
+	if p.Approvals == nil {
+		return nil, errors.WithStack(ErrNoApprovalStore)
+	}
+	return p.Approvals.GetApproval(ctx, id)
+}
+
+// ApproveRequest verifies the token sent for the approval request, and
+// marks the request approved. Either uid or recipient must be given, and
+// must be of the user the request was made for. It returns false if the
+// token is not valid.
+func (p *Passwordless) ApproveRequest(ctx context.Context, id, s, uid, recipient, token string) (bool, error) {
+	a, err := p.GetApproval(ctx, id)
+	if err != nil {
+		return false, err
+	} else if a.Status != ApprovalPending {
+		return false, errors.WithStack(ErrApprovalStatusChanged)
+	} else if time.Now().After(a.Expires) {
+		return false, errors.WithStack(ErrApprovalExpired)
+	}
+	if uid == "" && p.Resolver != nil {
+		if uid, err = p.Resolver.ResolveUID(ctx, s, recipient); err != nil &&
+			!errors.Is(err, ErrUnknownUser) {
+			return false, err
+		}
+	}
+	if a.UID == "" || uid != a.UID {
+		if p.EnumerationSafe {
+			p.decoy.verify(token)
+		}
+		return false, nil
+	}
+	valid, err := p.VerifyStrategyToken(ctx, PurposeLogin, s, a.UID, token)
+	if !valid {
+		return false, err
+	}
+	if err := p.Approvals.TransitionApproval(
+		ctx, id, ApprovalPending, ApprovalApproved); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DenyRequest rejects a pending approval request, e.g. when the user does
+// not recognise the device it was made from. The token sent for the
+// request is removed, so that it can't be used to sign in either.
+func (p *Passwordless) DenyRequest(ctx context.Context, id string) error {
+	a, err := p.GetApproval(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := p.Approvals.TransitionApproval(
+		ctx, id, ApprovalPending, ApprovalDenied); err != nil {
+		return err
+	}
+	if a.UID == "" {
+		return nil
+	}
+	return p.Store.Delete(WithPurpose(ctx, PurposeLogin), a.UID)
+}
+
+// PollApproval returns the status of an approval request for the
+// originating device, given the poll token returned by `RequestApproval`.
+// The uid is returned only once, together with ApprovalApproved, after
+// which the request is completed and can't be used again.
+func (p *Passwordless) PollApproval(ctx context.Context, pollToken string) (ApprovalStatus, string, error) {
+	id, secret, ok := strings.Cut(pollToken, ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", errors.WithStack(ErrApprovalNotFound)
+	}
+	a, err := p.GetApproval(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	if subtle.ConstantTimeCompare(
+		[]byte(a.PollHash), []byte(hashPollSecret(secret))) != 1 {
+		return "", "", errors.WithStack(ErrApprovalNotFound)
+	}
+	switch {
+	case a.Status == ApprovalPending && time.Now().After(a.Expires):
+		return ApprovalExpired, "", nil
+	case a.Status == ApprovalApproved:
+		err := p.Approvals.TransitionApproval(
+			ctx, id, ApprovalApproved, ApprovalCompleted)
+		if errors.Is(err, ErrApprovalStatusChanged) {
+			// Completed concurrently
+			return ApprovalCompleted, "", nil
+		} else if err != nil {
+			return "", "", err
+		}
+		return ApprovalApproved, a.UID, nil
+	}
+	return a.Status, "", nil
+}
+
+// hashPollSecret returns the hex encoded SHA-256 hash of a poll secret.
+// Secrets are 256 bits, so a fast hash suffices.
+func hashPollSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,183 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// linkTransport records the magic link it would deliver.
+type linkTransport struct {
+	fn   LinkFunc
+	link string
+}
+
+func (t *linkTransport) Send(ctx context.Context, token, uid, recipient string) (err error) {
+	t.link, err = t.fn(ctx, token, uid, recipient)
+	return err
+}
+
+func TestApproval(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createApprovalTable(db))
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	approvals, err := NewSQLiteApprovalStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+
+	m, err := NewMagicLink("http://example.com/link", []byte("secret"))
+	require.NoError(t, err)
+	tt := &linkTransport{fn: m.LinkFunc("email")}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, time.Minute)
+
+	_, err = p.RequestApproval(nil, "email", "", "bender@ilovebender.com")
+	require.True(t, errors.Is(err, ErrNoApprovalStore))
+	p.Approvals = approvals
+
+	h, err := NewMagicLinkHandler(p, m, func(w http.ResponseWriter, r *http.Request, uid string) {
+		t.Fatal("the device following the link must not be signed in")
+	})
+	require.NoError(t, err)
+
+	// Request from the laptop
+	req := httptest.NewRequest(http.MethodPost, "/signin", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "Laptop/1.0")
+	ctx := SetContext(context.Background(), httptest.NewRecorder(), req)
+	poll, err := p.RequestApproval(ctx, "email", "", "bender@ilovebender.com")
+	require.NoError(t, err)
+	id, secret, ok := strings.Cut(poll, ".")
+	require.True(t, ok)
+	require.Len(t, id, 32)
+	require.Contains(t, tt.link, "req="+id)
+	require.NotContains(t, tt.link, secret, "the link must not allow polling")
+
+	// Only the poll token can poll
+	for _, bad := range []string{id, id + ".", id + "." + strings.Repeat("0", len(secret))} {
+		_, _, err = p.PollApproval(nil, bad)
+		require.True(t, errors.Is(err, ErrApprovalNotFound), bad)
+	}
+	status, uid, err := p.PollApproval(nil, poll)
+	require.NoError(t, err)
+	require.Equal(t, ApprovalPending, status)
+	require.Empty(t, uid)
+
+	// Phone follows the link, and sees where the request came from
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.link, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "192.0.2.1")
+	require.Contains(t, rec.Body.String(), "Laptop/1.0")
+	require.Contains(t, rec.Body.String(), `value="deny"`)
+
+	u, err := url.Parse(tt.link)
+	require.NoError(t, err)
+	post := func(form url.Values, action string) *httptest.ResponseRecorder {
+		f := url.Values{ConfirmActionParam: {action}}
+		for k, v := range form {
+			f[k] = v
+		}
+		req := httptest.NewRequest(http.MethodPost, "/link", strings.NewReader(f.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = post(u.Query(), ConfirmApprove)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "approved")
+
+	// Laptop completes sign in, once
+	status, uid, err = p.PollApproval(nil, poll)
+	require.NoError(t, err)
+	require.Equal(t, ApprovalApproved, status)
+	require.Equal(t, "42", uid)
+	status, uid, err = p.PollApproval(nil, poll)
+	require.NoError(t, err)
+	require.Equal(t, ApprovalCompleted, status)
+	require.Empty(t, uid)
+
+	// The link can't be used again
+	require.Equal(t, http.StatusForbidden, post(u.Query(), ConfirmApprove).Code)
+
+	// Denied requests
+	poll, err = p.RequestApproval(ctx, "email", "", "bender@ilovebender.com")
+	require.NoError(t, err)
+	id, _, _ = strings.Cut(poll, ".")
+	u, err = url.Parse(tt.link)
+	require.NoError(t, err)
+	rec = post(u.Query(), ConfirmDeny)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "denied")
+	status, _, err = p.PollApproval(nil, poll)
+	require.NoError(t, err)
+	require.Equal(t, ApprovalDenied, status)
+	ok, err = p.ApproveRequest(nil, id, "email", "", "bender@ilovebender.com", "1337")
+	require.True(t, errors.Is(err, ErrApprovalStatusChanged))
+	require.False(t, ok)
+	// The token can't sign in either
+	_, ok, err = p.VerifyRecipient(nil, PurposeLogin, "email", "bender@ilovebender.com", "1337")
+	require.True(t, errors.Is(err, ErrTokenNotFound))
+	require.False(t, ok)
+
+	// Bad tokens don't approve
+	poll, err = p.RequestApproval(ctx, "email", "", "bender@ilovebender.com")
+	require.NoError(t, err)
+	id, _, _ = strings.Cut(poll, ".")
+	ok, err = p.ApproveRequest(nil, id, "email", "", "bender@ilovebender.com", "0000")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Requests are approved only by the user they were made for
+	p.Resolver = mapResolver{users: map[string]string{
+		"42": "bender@ilovebender.com", "43": "fry@planetexpress.com"}}
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "43", ""))
+	ok, err = p.ApproveRequest(nil, id, "email", "43", "", "1337")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = p.ApproveRequest(nil, id, "email", "", "fry@planetexpress.com", "1337")
+	require.NoError(t, err)
+	require.False(t, ok)
+	status, _, err = p.PollApproval(nil, poll)
+	require.NoError(t, err)
+	require.Equal(t, ApprovalPending, status)
+
+	// Unknown users get a request that is never approved
+	poll, err = p.RequestApproval(ctx, "email", "", "leela@planetexpress.com")
+	require.NoError(t, err)
+	id, _, _ = strings.Cut(poll, ".")
+	ok, err = p.ApproveRequest(nil, id, "email", "", "leela@planetexpress.com", "1337")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = p.ApproveRequest(nil, id, "email", "", "", "1337")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Expired requests
+	require.NoError(t, approvals.CreateApproval(nil, &Approval{
+		ID:       "expired",
+		PollHash: hashPollSecret("secret"),
+		UID:      "42",
+		Status:   ApprovalPending,
+		Expires:  time.Now().Add(-time.Minute),
+		Created:  time.Now().Add(-2 * time.Minute),
+	}))
+	status, _, err = p.PollApproval(nil, "expired.secret")
+	require.NoError(t, err)
+	require.Equal(t, ApprovalExpired, status)
+	_, err = p.ApproveRequest(nil, "expired", "email", "42", "", "1337")
+	require.True(t, errors.Is(err, ErrApprovalExpired))
+
+	_, _, err = p.PollApproval(nil, "unknown.secret")
+	require.True(t, errors.Is(err, ErrApprovalNotFound))
+}
@@ -0,0 +1,139 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBindingNotSupported = errors.New("token store does not support session binding")
+	ErrBindingMismatch     = errors.New("token was requested from a different session")
+)
+
+// BindingCookieName is the cookie holding the random nonce that identifies
+// a browser session when `Passwordless.BindSessions` is set.
+const BindingCookieName = "pwl_binding"
+
+// BindingStore is implemented by token stores that can bind tokens to the
+// session they were requested from. If the context has a binding, see
+// `WithBinding`, Store must keep it with the token in the same write, so
+// that a token is never stored without its binding.
+type BindingStore interface {
+	TokenStore
+	// Binding returns the binding of the token stored for the user, or an
+	// empty string if the token is not bound
+	Binding(ctx context.Context, uid string) (string, error)
+}
+
+// WithBinding returns a Context specifying the session binding of tokens
+// stored by `RequestToken`. `Passwordless.RequestToken` sets this
+// automatically if BindSessions is set.
+func WithBinding(ctx context.Context, binding string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, bindingKey, binding)
+}
+
+// BindingFromContext returns the binding set with `WithBinding`.
+func BindingFromContext(ctx context.Context) string {
+	b, _ := bindingFromContext(ctx)
+	return b
+}
+
+// bindingFromContext returns the binding set with `WithBinding`, and false
+// if none is set. An empty binding is set for tokens requested outside of
+// a browser session, and must be stored to replace any previous binding.
+func bindingFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	b, ok := ctx.Value(bindingKey).(string)
+	return b, ok
+}
+
+// withConfirmedLink returns a Context indicating the token being verified
+// arrived via a signed magic link the user explicitly confirmed, which is
+// accepted from any session. Set by `MagicLinkHandler`.
+func withConfirmedLink(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, confirmedKey, true)
+}
+
+// confirmedLink returns true if `withConfirmedLink` was used.
+func confirmedLink(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	ok, _ := ctx.Value(confirmedKey).(bool)
+	return ok
+}
+
+// sessionBinding returns the binding of the browser session stored by
+// `SetContext`, derived from the nonce in the binding cookie. If create is
+// true and there is no cookie yet, a new nonce is generated and set. An
+// empty string is returned if the context has no request.
+func sessionBinding(ctx context.Context, create bool) (string, error) {
+	rw, r := fromContext(ctx)
+	if r == nil {
+		return "", nil
+	}
+	nonce := ""
+	if c, err := r.Cookie(BindingCookieName); err == nil {
+		nonce = c.Value
+	}
+	if nonce == "" {
+		if !create || rw == nil {
+			return "", nil
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", errors.WithStack(err)
+		}
+		nonce = hex.EncodeToString(b)
+		http.SetCookie(rw, &http.Cookie{
+			Name:     BindingCookieName,
+			Value:    nonce,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	// Store a fingerprint rather than the nonce itself
+	h := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(h[:]), nil
+}
+
+// checkBinding returns ErrBindingMismatch if the token stored for uid is
+// not bound to the current session. Tokens without a binding, e.g.
+// requested outside of a browser session, are only accepted via confirmed
+// magic links.
+func (p *Passwordless) checkBinding(ctx context.Context, uid string) error {
+	bs, ok := p.Store.(BindingStore)
+	if !ok {
+		return errors.WithStack(ErrBindingNotSupported)
+	}
+	binding, err := bs.Binding(ctx, uid)
+	if err != nil {
+		return err
+	} else if binding == "" {
+		return errors.WithStack(ErrBindingMismatch)
+	}
+	current, err := sessionBinding(ctx, false)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(current)) != 1 {
+		return errors.WithStack(ErrBindingMismatch)
+	}
+	return nil
+}
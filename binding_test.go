@@ -0,0 +1,100 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindSessions(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.BindSessions = true
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+
+	// session returns a context for a request carrying the cookies
+	session := func(cookies ...*http.Cookie) (context.Context, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodPost, "/account/token", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		return SetContext(context.Background(), rec, r), rec
+	}
+
+	ctx, rec := session()
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	require.Equal(t, BindingCookieName, cookie.Name)
+	require.True(t, cookie.HttpOnly)
+	binding, err := store.Binding(nil, "42")
+	require.NoError(t, err)
+	require.NotEmpty(t, binding)
+	require.NotEqual(t, cookie.Value, binding, "the nonce itself should not be stored")
+
+	// A phished code entered from another browser is rejected
+	other, _ := session(&http.Cookie{Name: BindingCookieName, Value: "attacker"})
+	valid, err := p.VerifyToken(other, PurposeLogin, "42", "1337")
+	require.True(t, errors.Is(err, ErrBindingMismatch))
+	require.False(t, valid)
+	none, _ := session()
+	_, err = p.VerifyToken(none, PurposeLogin, "42", "1337")
+	require.True(t, errors.Is(err, ErrBindingMismatch))
+
+	// Bad tokens are reported as usual
+	ctx, _ = session(cookie)
+	valid, err = p.VerifyToken(ctx, PurposeLogin, "42", "0000")
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The originating session is accepted
+	valid, err = p.VerifyToken(ctx, PurposeLogin, "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The cookie is reused for later requests
+	ctx, rec = session(cookie)
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	require.Empty(t, rec.Result().Cookies())
+	b, err := store.Binding(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, binding, b)
+
+	// Confirmed magic links are accepted from any session
+	valid, err = p.VerifyToken(withConfirmedLink(other), PurposeLogin, "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Tokens requested outside a browser session are not bound, replacing
+	// the previous binding, and are only accepted via magic links
+	ctx, _ = session(cookie)
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	b, err = store.Binding(nil, "42")
+	require.NoError(t, err)
+	require.Empty(t, b)
+	for _, ctx := range []context.Context{other, ctx, nil} {
+		valid, err = p.VerifyToken(ctx, PurposeLogin, "42", "1337")
+		require.True(t, errors.Is(err, ErrBindingMismatch))
+		require.False(t, valid)
+	}
+	valid, err = p.VerifyToken(withConfirmedLink(other), PurposeLogin, "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// The store must support binding
+	p.Store = struct{ TokenStore }{store}
+	ctx, _ = session(cookie)
+	require.True(t, errors.Is(p.RequestToken(ctx, PurposeLogin, "email", "42", "bender@ilovebender.com"),
+		ErrBindingNotSupported))
+}
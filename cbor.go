@@ -0,0 +1,110 @@
+package passwordless
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	errCBORNotValid = errors.New("cbor data is not valid")
+)
+
+// cborMaxDepth limits nesting when decoding, as input comes from clients.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR data item in b, see RFC 8949, and
+// returns the rest. Only the subset used by WebAuthn is supported, i.e.
+// definite length items without tags or floats. Integers are returned as
+// int64, byte strings as []byte, text as string, arrays as []interface{}
+// and maps as map[interface{}]interface{}.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 || depth > cborMaxDepth {
+		return nil, nil, errors.WithStack(errCBORNotValid)
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	// Read the argument
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[n:]
+	default:
+		// Indefinite lengths and reserved values
+		return nil, nil, errors.WithStack(errCBORNotValid)
+	}
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if uint64(len(b)) < arg {
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		if major == 3 {
+			return string(b[:arg]), b[arg:], nil
+		}
+		return append([]byte{}, b[:arg]...), b[arg:], nil
+	case 4:
+		if uint64(len(b)) < arg {
+			// Each item takes at least a byte
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			var err error
+			if a[i], b, err = decodeCBORItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return a, b, nil
+	case 5:
+		if uint64(len(b)) < 2*arg {
+			return nil, nil, errors.WithStack(errCBORNotValid)
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.WithStack(errCBORNotValid)
+			}
+			if m[k], b, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, b, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+	}
+	return nil, nil, errors.WithStack(errCBORNotValid)
+}
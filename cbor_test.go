@@ -0,0 +1,83 @@
+package passwordless
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// nested returns n arrays nested in each other, around an integer
+	nested := func(n int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, n), 0x00)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+		rest []byte
+	}{
+		// Examples from RFC 8949, appendix A
+		{"uint", []byte{0x17}, int64(23), nil},
+		{"uint8", []byte{0x18, 0x64}, int64(100), nil},
+		{"uint64", []byte{0x1b, 0, 0, 0, 0xe8, 0xd4, 0xa5, 0x10, 0}, int64(1000000000000), nil},
+		{"negative", []byte{0x39, 0x03, 0xe7}, int64(-1000), nil},
+		{"bytes", []byte{0x44, 1, 2, 3, 4}, []byte{1, 2, 3, 4}, nil},
+		{"text", []byte{0x64, 'I', 'E', 'T', 'F'}, "IETF", nil},
+		{"array", []byte{0x83, 1, 0x82, 2, 3, 0x81, 4},
+			[]interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4)}}, nil},
+		{"map", []byte{0xa2, 0x61, 'a', 1, 0x20, 0xf5},
+			map[interface{}]interface{}{"a": int64(1), int64(-1): true}, nil},
+		{"simple", []byte{0xf4}, false, nil},
+		{"null", []byte{0xf6}, nil, nil},
+		{"rest", []byte{0x01, 0x02, 0x03}, int64(1), []byte{0x02, 0x03}},
+		{"max depth", nested(cborMaxDepth), nil, nil},
+		// As produced by authenticators
+		{"cose", encodeCBOR(cborPairs{{1, 2}, {-257, "alg"}, {"k", []byte{1, 2}}}),
+			map[interface{}]interface{}{int64(1): int64(2), int64(-257): "alg", "k": []byte{1, 2}}, nil},
+	}
+	for _, test := range tests {
+		v, rest, err := decodeCBOR(test.in)
+		require.NoError(t, err, test.name)
+		if test.name != "max depth" {
+			require.Equal(t, test.want, v, test.name)
+		}
+		require.True(t, bytes.Equal(test.rest, rest), test.name)
+	}
+
+	notValid := []struct {
+		name string
+		in   []byte
+	}{
+		// Malformed
+		{"empty", nil},
+		{"reserved info", []byte{0x1c}},
+		{"indefinite bytes", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"indefinite array", []byte{0x9f, 0x01, 0xff}},
+		{"tag", []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"undefined", []byte{0xf7}},
+		{"map key", []byte{0xa1, 0x41, 0x00, 0x01}},
+		{"uint overflow", []byte{0x1b, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{"negative overflow", []byte{0x3b, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		// Truncated
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated bytes", []byte{0x44, 1, 2, 3}},
+		{"truncated text", []byte{0x64, 'I', 'E'}},
+		{"truncated array", []byte{0x83, 1, 2}},
+		{"truncated map", []byte{0xa2, 0x61, 'a', 1, 0x20}},
+		{"truncated map value", []byte{0xa1, 0x61, 'a'}},
+		// Oversized, rejected before allocating
+		{"oversized bytes", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"oversized text", []byte{0x7a, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"oversized array", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"oversized map", []byte{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"too deep", nested(cborMaxDepth + 1)},
+	}
+	for _, test := range notValid {
+		_, _, err := decodeCBOR(test.in)
+		require.True(t, errors.Is(err, errCBORNotValid), test.name)
+	}
+}
@@ -0,0 +1,215 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoTemplate = errors.New("no template for locale")
+)
+
+// EmailTemplate holds the templates used to compose an email for a single
+// locale. Templates are executed with ComposerData.
+type EmailTemplate struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+// NewEmailTemplate parses the given subject, text and HTML templates.
+// Either body may be empty, but not both.
+func NewEmailTemplate(subject, text, html string) (t EmailTemplate, err error) {
+	if text == "" && html == "" {
+		return t, errors.WithStack(ErrNoTemplate)
+	}
+	t.Subject, err = texttemplate.New("subject").Parse(subject)
+	if err != nil {
+		return t, errors.WithStack(err)
+	}
+	if text != "" {
+		t.Text, err = texttemplate.New("text").Parse(text)
+		if err != nil {
+			return t, errors.WithStack(err)
+		}
+	}
+	if html != "" {
+		t.HTML, err = htmltemplate.New("html").Parse(html)
+		if err != nil {
+			return t, errors.WithStack(err)
+		}
+	}
+	return t, nil
+}
+
+// ParseEmailTemplates reads a template set from fsys, with a directory
+// per locale containing "subject.txt", "body.txt" and/or "body.html".
+func ParseEmailTemplates(fsys fs.FS) (map[string]EmailTemplate, error) {
+	dirs, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	templates := map[string]EmailTemplate{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		var parts [3]string
+		for i, name := range []string{"subject.txt", "body.txt", "body.html"} {
+			b, err := fs.ReadFile(fsys, path.Join(d.Name(), name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, errors.WithStack(err)
+			}
+			parts[i] = string(b)
+		}
+		t, err := NewEmailTemplate(parts[0], parts[1], parts[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "locale %s", d.Name())
+		}
+		templates[d.Name()] = t
+	}
+	return templates, nil
+}
+
+// ComposerData is passed to email templates.
+type ComposerData struct {
+	Token     string
+	UID       string
+	Recipient string
+	// Link is the magic link that signs the user in, if a LinkFunc is set
+	Link string
+	// Expires is the time the token expires, see `ExpiresFromContext`
+	Expires time.Time
+	Locale  string
+	// Purpose of the message, e.g. PurposeLogin, see `WithPurpose`
+	Purpose string
+	// PendingRecipient is the new address when changing it, see
+	// `WithPendingRecipient`
+	PendingRecipient string
+}
+
+// LinkFunc returns a link that signs the user in with the given token.
+type LinkFunc func(ctx context.Context, token, uid, recipient string) (string, error)
+
+// TemplateComposer composes emails from a set of templates, keyed by
+// locale.
+type TemplateComposer struct {
+	// Templates keyed by locale, e.g. "en" or "pt-BR"
+	Templates map[string]EmailTemplate
+	// DefaultLocale is used if no template matches the context locale
+	DefaultLocale string
+	// Link builds the magic link made available to templates
+	Link LinkFunc
+	// From address of composed emails. If empty, the sender of the
+	// SMTPTransport is used.
+	From string
+}
+
+// NewTemplateComposer returns a ComposerFunc that renders emails from the
+// given templates, sent from the given address. The locale is selected
+// from the context, see `WithLocale`, falling back to defaultLocale.
+func NewTemplateComposer(templates map[string]EmailTemplate, defaultLocale, from string, link LinkFunc) ComposerFunc {
+	c := &TemplateComposer{
+		Templates:     templates,
+		DefaultLocale: defaultLocale,
+		Link:          link,
+		From:          from,
+	}
+	return c.Compose
+}
+
+// Compose writes an email containing the token to w. It is a ComposerFunc.
+func (c *TemplateComposer) Compose(ctx context.Context, token, uid, recipient string, w io.Writer) error {
+	e, err := c.Email(ctx, token, uid, recipient)
+	if err != nil {
+		return err
+	}
+	_, err = e.Write(w)
+	return err
+}
+
+// Email renders the templates for the context locale into an Email.
+func (c *TemplateComposer) Email(ctx context.Context, token, uid, recipient string) (*Email, error) {
+	locale, t, err := c.template(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data := ComposerData{
+		Token:     token,
+		UID:       uid,
+		Recipient: recipient,
+		Expires:   ExpiresFromContext(ctx),
+		Locale:    locale,
+		Purpose:   PurposeFromContext(ctx),
+
+		PendingRecipient: PendingRecipientFromContext(ctx),
+	}
+	// Messages without a token, e.g. PurposeEmailChangeNotice, have no link
+	if c.Link != nil && token != "" {
+		if data.Link, err = c.Link(ctx, token, uid, recipient); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &Email{
+		To:   recipient,
+		From: c.From,
+	}
+	if e.From == "" {
+		e.From = senderFromContext(ctx)
+	}
+	b := bytes.NewBuffer(nil)
+	if t.Subject != nil {
+		if err := t.Subject.Execute(b, data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		e.Subject = strings.TrimSpace(b.String())
+	}
+
+	// Add content types, from least- to most-preferable.
+	if t.Text != nil {
+		b.Reset()
+		if err := t.Text.Execute(b, data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		e.AddBody("text/plain", b.String())
+	}
+	if t.HTML != nil {
+		b.Reset()
+		if err := t.HTML.Execute(b, data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		e.AddBody("text/html", b.String())
+	}
+
+	return e, nil
+}
+
+// template returns the template best matching the context locale.
+func (c *TemplateComposer) template(ctx context.Context) (string, EmailTemplate, error) {
+	for _, l := range LocalesFromContext(ctx) {
+		if t, ok := c.Templates[l]; ok {
+			return l, t, nil
+		}
+		// Fall back from region to language, e.g. "en-GB" to "en"
+		if i := strings.IndexAny(l, "-_"); i > 0 {
+			if t, ok := c.Templates[l[:i]]; ok {
+				return l[:i], t, nil
+			}
+		}
+	}
+	if t, ok := c.Templates[c.DefaultLocale]; ok {
+		return c.DefaultLocale, t, nil
+	}
+	return "", EmailTemplate{}, errors.WithStack(ErrNoTemplate)
+}
@@ -0,0 +1,139 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testEmailTemplates(t *testing.T) map[string]EmailTemplate {
+	en, err := NewEmailTemplate(
+		"Sign in to {{.Recipient}}",
+		"Your PIN is {{.Token}}, or visit {{.Link}}",
+		`<p>Your PIN is <b>{{.Token}}</b>, or <a href="{{.Link}}">click here</a> for {{.UID}}</p>`)
+	require.NoError(t, err)
+	pt, err := NewEmailTemplate(
+		"Entrar",
+		"O seu PIN é {{.Token}} ({{.Locale}})", "")
+	require.NoError(t, err)
+	return map[string]EmailTemplate{"en": en, "pt": pt}
+}
+
+func TestTemplateComposer(t *testing.T) {
+	c := &TemplateComposer{
+		Templates:     testEmailTemplates(t),
+		DefaultLocale: "en",
+		Link: func(ctx context.Context, token, uid, recipient string) (string, error) {
+			return "https://example.com/?token=" + token + "&uid=" + uid, nil
+		},
+		From: "noreply@example.com",
+	}
+
+	expires := time.Now().Add(time.Hour)
+	e, err := c.Email(withExpires(nil, expires), "1337", "<script>", "bender@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "Sign in to bender@example.com", e.Subject)
+	require.Equal(t, "bender@example.com", e.To)
+	require.Equal(t, "noreply@example.com", e.From)
+	require.Len(t, e.Body, 2)
+	require.Equal(t, "text/plain", e.Body[0].t)
+	require.Equal(t, "Your PIN is 1337, or visit "+
+		"https://example.com/?token=1337&uid=<script>", e.Body[0].c)
+	require.Equal(t, "text/html", e.Body[1].t)
+	require.Equal(t, `<p>Your PIN is <b>1337</b>, or <a href="`+
+		`https://example.com/?token=1337&amp;uid=%3cscript%3e">click here</a>`+
+		` for &lt;script&gt;</p>`, e.Body[1].c)
+
+	// Locale from context
+	e, err = c.Email(WithLocale(nil, "pt-BR"), "1337", "uid", "recipient")
+	require.NoError(t, err)
+	require.Equal(t, "Entrar", e.Subject)
+	require.Len(t, e.Body, 1)
+	require.Equal(t, "O seu PIN é 1337 (pt)", e.Body[0].c)
+
+	// Locale from request
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de;q=0.9, pt;q=0.8, fr")
+	ctx := SetContext(nil, httptest.NewRecorder(), req)
+	e, err = c.Email(ctx, "1337", "uid", "recipient")
+	require.NoError(t, err)
+	require.Equal(t, "Entrar", e.Subject)
+
+	// Unknown locale falls back to default
+	e, err = c.Email(WithLocale(nil, "de"), "1337", "uid", "recipient")
+	require.NoError(t, err)
+	require.Equal(t, "Sign in to recipient", e.Subject)
+
+	c.DefaultLocale = "xx"
+	_, err = c.Email(WithLocale(nil, "de"), "1337", "uid", "recipient")
+	require.ErrorIs(t, err, ErrNoTemplate)
+
+	// ComposerFunc writes the email
+	b := bytes.NewBuffer(nil)
+	f := NewTemplateComposer(testEmailTemplates(t), "en", "noreply@example.com", nil)
+	require.NoError(t, f(nil, "1337", "uid", "recipient", b))
+	require.Contains(t, b.String(), "Your PIN is 1337")
+	require.Contains(t, b.String(), "From: <noreply@example.com>\r\n")
+
+	// Without a From address, the sender of the transport is used
+	c.From, c.DefaultLocale = "", "en"
+	e, err = c.Email(withSender(nil, "pwl@example.com"), "1337", "uid", "recipient")
+	require.NoError(t, err)
+	require.Equal(t, "pwl@example.com", e.From)
+}
+
+func TestParseEmailTemplates(t *testing.T) {
+	templates, err := ParseEmailTemplates(fstest.MapFS{
+		"en/subject.txt": {Data: []byte("Hello")},
+		"en/body.txt":    {Data: []byte("PIN {{.Token}}")},
+		"fr/subject.txt": {Data: []byte("Bonjour")},
+		"fr/body.html":   {Data: []byte("<b>{{.Token}}</b>")},
+		"README":         {Data: []byte("ignored")},
+	})
+	require.NoError(t, err)
+	require.Len(t, templates, 2)
+	require.NotNil(t, templates["en"].Text)
+	require.Nil(t, templates["en"].HTML)
+	require.Nil(t, templates["fr"].Text)
+	require.NotNil(t, templates["fr"].HTML)
+
+	_, err = ParseEmailTemplates(fstest.MapFS{
+		"en/subject.txt": {Data: []byte("Hello")},
+	})
+	require.ErrorIs(t, err, ErrNoTemplate)
+}
+
+// composeTransport composes emails as SMTPTransport would, without
+// sending them
+type composeTransport struct {
+	c    *TemplateComposer
+	sent *Email
+}
+
+func (t *composeTransport) Send(ctx context.Context, token, uid, recipient string) (err error) {
+	t.sent, err = t.c.Email(ctx, token, uid, recipient)
+	return err
+}
+
+func TestTemplateComposerExpires(t *testing.T) {
+	en, err := NewEmailTemplate("PIN", "Valid until {{ .Expires.Format \"15:04\" }}", "")
+	require.NoError(t, err)
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+
+	// The expiry follows the TTL of the strategy sending the token
+	ct := &composeTransport{c: &TemplateComposer{
+		Templates: map[string]EmailTemplate{"en": en}, DefaultLocale: "en"}}
+	p := New(store)
+	p.SetTransport("email", ct, testGenerator{token: "1337"}, 90*time.Minute)
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "uid", "recipient"))
+	require.Equal(t, "Valid until "+time.Now().Add(90*time.Minute).Format("15:04"), ct.sent.Body[0].c)
+}
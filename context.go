@@ -2,6 +2,10 @@ package passwordless
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"context"
 )
@@ -9,8 +13,18 @@ import (
 type ctxKey int
 
 const (
-	reqKey ctxKey = 1
-	rwKey  ctxKey = 2
+	reqKey       ctxKey = 1
+	rwKey        ctxKey = 2
+	localeKey    ctxKey = 3
+	rcptKey      ctxKey = 4
+	apprKey      ctxKey = 5
+	bindingKey   ctxKey = 6
+	confirmedKey ctxKey = 7
+	purposeKey   ctxKey = 8
+	pendingKey   ctxKey = 9
+	sessionKey   ctxKey = 10
+	expiresKey   ctxKey = 11
+	senderKey    ctxKey = 12
 )
 
 // SetContext returns a Context containing the specified `ResponseWriter` and
@@ -39,3 +53,157 @@ func fromContext(ctx context.Context) (http.ResponseWriter, *http.Request) {
 	}
 	return rw, req
 }
+
+// RequestFromContext returns the `Request` stored by `SetContext`, or nil.
+func RequestFromContext(ctx context.Context) *http.Request {
+	_, req := fromContext(ctx)
+	return req
+}
+
+// ResponseWriterFromContext returns the `ResponseWriter` stored by
+// `SetContext`, or nil.
+func ResponseWriterFromContext(ctx context.Context) http.ResponseWriter {
+	rw, _ := fromContext(ctx)
+	return rw
+}
+
+// WithRecipient returns a Context specifying the recipient a token is
+// requested for, allowing strategies to determine validity based on it.
+// `Passwordless.RequestToken` sets this automatically.
+func WithRecipient(ctx context.Context, recipient string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, rcptKey, recipient)
+}
+
+// RecipientFromContext returns the recipient set with `WithRecipient`,
+// and false if none is set.
+func RecipientFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	r, ok := ctx.Value(rcptKey).(string)
+	return r, ok
+}
+
+// WithApprovalID returns a Context carrying the ID of the approval request a
+// token is sent for, see `Passwordless.RequestApproval`.
+func WithApprovalID(ctx context.Context, id string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, apprKey, id)
+}
+
+// ApprovalIDFromContext returns the approval request ID set with
+// `WithApprovalID`, or an empty string.
+func ApprovalIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(apprKey).(string)
+	return id
+}
+
+// withExpires returns a Context carrying the expiry time of the token being
+// sent. It is set by `RequestToken`.
+func withExpires(ctx context.Context, expires time.Time) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, expiresKey, expires)
+}
+
+// ExpiresFromContext returns the time the token being sent expires, as
+// given by the TTL of the strategy. It is zero outside of `RequestToken`.
+func ExpiresFromContext(ctx context.Context) time.Time {
+	if ctx == nil {
+		return time.Time{}
+	}
+	t, _ := ctx.Value(expiresKey).(time.Time)
+	return t
+}
+
+// withSender returns a Context carrying the envelope sender of a transport,
+// used as the From address by composers that don't set one.
+func withSender(ctx context.Context, from string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, senderKey, from)
+}
+
+// senderFromContext returns the sender set with `withSender`.
+func senderFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	from, _ := ctx.Value(senderKey).(string)
+	return from
+}
+
+// WithLocale returns a Context specifying the preferred locale of the user,
+// e.g. "en" or "pt-BR", used to select email templates.
+func WithLocale(ctx context.Context, locale string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, localeKey, locale)
+}
+
+// LocalesFromContext returns the preferred locales of the user, most
+// preferred first. The locale set with `WithLocale` takes precedence,
+// followed by the Accept-Language header of the request set with
+// `SetContext`.
+func LocalesFromContext(ctx context.Context) []string {
+	locales := []string{}
+	if ctx == nil {
+		return locales
+	}
+	if l, ok := ctx.Value(localeKey).(string); ok && l != "" {
+		locales = append(locales, l)
+	}
+	if _, req := fromContext(ctx); req != nil {
+		locales = append(locales,
+			parseAcceptLanguage(req.Header.Get("Accept-Language"))...)
+	}
+	return locales
+}
+
+// parseAcceptLanguage returns the languages in an Accept-Language header
+// ordered by quality.
+func parseAcceptLanguage(h string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	langs := []lang{}
+	for _, part := range strings.Split(h, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
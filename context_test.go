@@ -31,3 +31,33 @@ func TestContext(t *testing.T) {
 	assert.Equal(t, req, req2)
 	assert.Equal(t, "hello", ctx.Value(testKey))
 }
+
+func TestLocalesFromContext(t *testing.T) {
+	assert.Empty(t, LocalesFromContext(nil))
+	assert.Equal(t, []string{"fr"}, LocalesFromContext(WithLocale(nil, "fr")))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de;q=0.5, en-GB, *, pt;q=0.8, nl;q=0")
+	ctx := SetContext(nil, nil, req)
+	assert.Equal(t, []string{"en-GB", "pt", "de"}, LocalesFromContext(ctx))
+
+	ctx = WithLocale(ctx, "fr")
+	assert.Equal(t, []string{"fr", "en-GB", "pt", "de"}, LocalesFromContext(ctx))
+}
+
+func TestRequestFromContext(t *testing.T) {
+	assert.Nil(t, RequestFromContext(nil))
+	assert.Nil(t, ResponseWriterFromContext(context.Background()))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := SetContext(nil, rw, req)
+	assert.Equal(t, req, RequestFromContext(ctx))
+	assert.Equal(t, rw, ResponseWriterFromContext(ctx))
+
+	_, ok := RecipientFromContext(ctx)
+	assert.False(t, ok)
+	r, ok := RecipientFromContext(WithRecipient(ctx, "bender@ilovebender.com"))
+	assert.True(t, ok)
+	assert.Equal(t, "bender@ilovebender.com", r)
+}
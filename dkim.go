@@ -0,0 +1,235 @@
+package passwordless
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrDKIMKeyNotSupported = errors.New("dkim key type is not supported")
+	ErrDKIMConfigNotValid  = errors.New("dkim domain and selector are required")
+	ErrMessageNotValid     = errors.New("message has no header")
+)
+
+// DKIMHeaders are the headers signed by default, if present in the message.
+var DKIMHeaders = []string{
+	"From", "Reply-To", "To", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner signs messages with a DKIM-Signature header, see RFC 6376.
+// Both RSA-SHA256 and Ed25519-SHA256 (RFC 8463) keys are supported. Header
+// and body are canonicalized with the "relaxed" algorithm.
+type DKIMSigner struct {
+	// Domain claiming responsibility for the message (d=)
+	Domain string
+	// Selector of the public key DNS record (s=)
+	Selector string
+	// Headers to sign, DKIMHeaders if empty. Headers that are not present
+	// in a message are skipped.
+	Headers []string
+	// Expiration of signatures (x=), relative to the signing time. No
+	// expiry is set if zero.
+	Expiration time.Duration
+
+	key crypto.Signer
+	alg string
+}
+
+// NewDKIMSigner returns a signer for the given domain and selector, using
+// an *rsa.PrivateKey or ed25519.PrivateKey.
+func NewDKIMSigner(domain, selector string, key crypto.Signer) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.WithStack(ErrDKIMConfigNotValid)
+	}
+	s := &DKIMSigner{
+		Domain:   domain,
+		Selector: selector,
+		key:      key,
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.alg = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.alg = "ed25519-sha256"
+	default:
+		return nil, errors.WithStack(ErrDKIMKeyNotSupported)
+	}
+	return s, nil
+}
+
+// Sign returns the message prefixed with a DKIM-Signature header. The
+// message must use CRLF line endings, as written by `Email`.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	header, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	bh := sha256.Sum256(dkimRelaxedBody(body))
+
+	// Pick the last instance of each header to sign
+	names := s.Headers
+	if len(names) == 0 {
+		names = DKIMHeaders
+	}
+	signed := []string{}
+	canonical := bytes.NewBuffer(nil)
+	for _, name := range names {
+		if field, ok := lastHeaderField(header, name); ok {
+			signed = append(signed, name)
+			canonical.WriteString(dkimRelaxedHeader(field) + "\r\n")
+		}
+	}
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + s.alg,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if s.Expiration > 0 {
+		tags = append(tags,
+			"x="+strconv.FormatInt(now.Add(s.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh[:]),
+		"b=")
+	sigHeader := "DKIM-Signature: " + strings.Join(tags, "; ")
+
+	// The signature covers the signature header itself, with an empty b=
+	// tag and no trailing CRLF.
+	canonical.WriteString(dkimRelaxedHeader(sigHeader))
+	hash := sha256.Sum256(canonical.Bytes())
+
+	var sig []byte
+	switch s.key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	default:
+		sig, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b := bytes.NewBuffer(nil)
+	b.WriteString(sigHeader)
+	b.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	b.WriteString("\r\n")
+	b.Write(msg)
+	return b.Bytes(), nil
+}
+
+// splitMessage returns the header fields and body of a message.
+func splitMessage(msg []byte) (header []string, body []byte, err error) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, nil, errors.WithStack(ErrMessageNotValid)
+	}
+	for _, line := range strings.SplitAfter(string(msg[:i+2]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(header) > 0 {
+			// Continuation of a folded header
+			header[len(header)-1] += line
+		} else {
+			header = append(header, line)
+		}
+	}
+	for i, h := range header {
+		header[i] = strings.TrimSuffix(h, "\r\n")
+	}
+	return header, msg[i+4:], nil
+}
+
+// lastHeaderField returns the last field of the given name.
+func lastHeaderField(header []string, name string) (string, bool) {
+	for i := len(header) - 1; i >= 0; i-- {
+		if j := strings.IndexByte(header[i], ':'); j > 0 &&
+			strings.EqualFold(strings.TrimSpace(header[i][:j]), name) {
+			return header[i], true
+		}
+	}
+	return "", false
+}
+
+// dkimRelaxedHeader canonicalizes a header field, see RFC 6376 3.4.2.
+func dkimRelaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return name + ":" + value
+}
+
+// dkimRelaxedBody canonicalizes a message body, see RFC 6376 3.4.4.
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	b := bytes.NewBuffer(nil)
+	empty := 0
+	for _, line := range lines {
+		line = strings.TrimRight(compressWSP(line), " ")
+		if line == "" {
+			// Defer empty lines, trailing ones are ignored
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return b.Bytes()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// compressWSP replaces each sequence of whitespace with a single space.
+func compressWSP(s string) string {
+	b := strings.Builder{}
+	wsp := false
+	for _, r := range s {
+		if isWSP(r) {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteRune(r)
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// foldBase64 folds a long base64 value over multiple header lines.
+func foldBase64(s string) string {
+	b := strings.Builder{}
+	for len(s) > 72 {
+		b.WriteString(s[:72] + "\r\n ")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
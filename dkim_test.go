@@ -0,0 +1,154 @@
+package passwordless
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyDKIM checks the first DKIM-Signature header of msg against the
+// public key, as a receiving server would.
+func verifyDKIM(msg []byte, pub crypto.PublicKey) error {
+	header, body, err := splitMessage(msg)
+	if err != nil {
+		return err
+	}
+	field, ok := lastHeaderField(header[:1], "DKIM-Signature")
+	if !ok {
+		return errors.New("no signature")
+	}
+	tags := map[string]string{}
+	for _, tag := range strings.Split(field[strings.IndexByte(field, ':')+1:], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		v := strings.Join(strings.FieldsFunc(kv[1], func(r rune) bool {
+			return isWSP(r) || r == '\r' || r == '\n'
+		}), "")
+		tags[strings.TrimSpace(kv[0])] = v
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return errors.New("unexpected canonicalization")
+	}
+
+	bh := sha256.Sum256(dkimRelaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	canonical := bytes.NewBuffer(nil)
+	for _, name := range strings.Split(tags["h"], ":") {
+		if f, ok := lastHeaderField(header[1:], name); ok {
+			canonical.WriteString(dkimRelaxedHeader(f) + "\r\n")
+		}
+	}
+	// Signature header with the b= value removed
+	i := strings.LastIndex(field, "; b=") + len("; b=")
+	canonical.WriteString(dkimRelaxedHeader(field[:i]))
+	hash := sha256.Sum256(canonical.Bytes())
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash[:], sig) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return ErrDKIMKeyNotSupported
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// Example from RFC 6376 3.4.5
+	msg := "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+	header, body, err := splitMessage([]byte(msg))
+	require.NoError(t, err)
+	require.Len(t, header, 2)
+	require.Equal(t, "a:X", dkimRelaxedHeader(header[0]))
+	require.Equal(t, "b:Y Z", dkimRelaxedHeader(header[1]))
+	require.Equal(t, " C\r\nD E\r\n", string(dkimRelaxedBody(body)))
+	require.Empty(t, dkimRelaxedBody([]byte("\r\n\r\n")))
+}
+
+func TestDKIMSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = NewDKIMSigner("", "selector", edKey)
+	require.ErrorIs(t, err, ErrDKIMConfigNotValid)
+
+	e := Email{
+		From:    "noreply@example.com",
+		To:      "bender@ilovebender.com",
+		Subject: "Your PIN",
+	}
+	e.AddBody("text/plain", "Your PIN is 1337")
+	e.AddBody("text/html", "<p>Your PIN is <b>1337</b></p>")
+	msg := e.Bytes()
+
+	for _, tc := range []struct {
+		key crypto.Signer
+		pub crypto.PublicKey
+		alg string
+	}{
+		{rsaKey, &rsaKey.PublicKey, "rsa-sha256"},
+		{edKey, edPub, "ed25519-sha256"},
+	} {
+		s, err := NewDKIMSigner("example.com", "mail", tc.key)
+		require.NoError(t, err)
+		signed, err := s.Sign(msg)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+tc.alg+
+			"; c=relaxed/relaxed; d=example.com; s=mail; ")))
+		require.True(t, bytes.HasSuffix(signed, msg))
+		require.NoError(t, verifyDKIM(signed, tc.pub), tc.alg)
+
+		// Relaxed canonicalization tolerates whitespace changes
+		relaxed := bytes.Replace(signed, []byte("Subject: Your PIN"),
+			[]byte("subject:   Your \t PIN"), 1)
+		require.NoError(t, verifyDKIM(relaxed, tc.pub), tc.alg)
+
+		// Tampering is detected
+		tampered := bytes.Replace(signed, []byte("1337"), []byte("1338"), 1)
+		require.Error(t, verifyDKIM(tampered, tc.pub), tc.alg)
+		tampered = bytes.Replace(signed, []byte("Your PIN"), []byte("Our PIN"), 1)
+		require.Error(t, verifyDKIM(tampered, tc.pub), tc.alg)
+	}
+
+	// Wrong key
+	s, err := NewDKIMSigner("example.com", "mail", edKey)
+	require.NoError(t, err)
+	signed, err := s.Sign(msg)
+	require.NoError(t, err)
+	require.Error(t, verifyDKIM(signed, &rsaKey.PublicKey))
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	require.Error(t, verifyDKIM(signed, otherPub))
+}
+
+func TestSMTPTransportDKIM(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s, err := NewDKIMSigner("example.com", "mail", edKey)
+	require.NoError(t, err)
+
+	tr := NewSMTPTransport("localhost:25", "noreply@example.com", nil,
+		NewTemplateComposer(testEmailTemplates(t), "en", "noreply@example.com", nil))
+	tr.DKIM = s
+	b := bytes.NewBuffer(nil)
+	require.NoError(t, tr.compose(nil, "1337", "uid", "bender@ilovebender.com", b))
+	require.NoError(t, verifyDKIM(b.Bytes(), edPub))
+}
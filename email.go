@@ -0,0 +1,266 @@
+package passwordless
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrHeaderInjection = errors.New("header value contains line breaks")
+)
+
+// Email is a helper for creating multipart (text and html) emails that
+// conform to RFC 5322 and RFC 2045.
+type Email struct {
+	Body []struct{ t, c string }
+	// Inline attachments, referenced from HTML bodies by "cid:" URLs
+	Inline  []Attachment
+	To      string
+	From    string
+	ReplyTo string
+	Subject string
+	Date    time.Time
+	// MessageID including angle brackets, generated if empty
+	MessageID string
+}
+
+// Attachment is a file embedded in an email.
+type Attachment struct {
+	ContentID   string
+	ContentType string
+	Filename    string
+	Data        []byte
+}
+
+// AddBody adds a content section to the email. The `contentType` should
+// be a known type, such as "text/html" or "text/plain". If no `contentType`
+// is provided, "text/plain" is used. Call this method for each required
+// body, with the most preferable type last.
+func (e *Email) AddBody(contentType, body string) {
+	if e.Body == nil {
+		e.Body = make([]struct{ t, c string }, 0)
+	}
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	e.Body = append(e.Body, struct{ t, c string }{contentType, body})
+}
+
+// AddInline embeds a file in the email, e.g. a logo. HTML bodies may
+// display it with `<img src="cid:{contentID}">`.
+func (e *Email) AddInline(contentID, contentType, filename string, data []byte) {
+	e.Inline = append(e.Inline, Attachment{
+		ContentID:   contentID,
+		ContentType: contentType,
+		Filename:    filename,
+		Data:        data,
+	})
+}
+
+// Validate returns ErrHeaderInjection if any value that is written to a
+// header contains a line break.
+func (e Email) Validate() error {
+	values := []string{e.To, e.From, e.ReplyTo, e.Subject, e.MessageID}
+	for _, b := range e.Body {
+		values = append(values, b.t)
+	}
+	for _, a := range e.Inline {
+		values = append(values, a.ContentID, a.ContentType, a.Filename)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return errors.WithStack(ErrHeaderInjection)
+		}
+	}
+	return nil
+}
+
+// Write emits the Email to the specified writer. An error is returned
+// without writing anything if the email does not validate.
+func (e Email) Write(w io.Writer) (int64, error) {
+	if err := e.Validate(); err != nil {
+		return 0, err
+	}
+	return e.Buffer().WriteTo(w)
+}
+
+// Bytes returns the contents of the email as a series of bytes.
+func (e Email) Bytes() []byte {
+	return e.Buffer().Bytes()
+}
+
+// Buffer generates the email header and contents as a `Buffer`. Line
+// breaks are removed from header values, call `Validate` to detect them.
+func (e Email) Buffer() *bytes.Buffer {
+	crlf := "\r\n"
+	b := bytes.NewBuffer(nil)
+	writeHeader := func(k, v string) {
+		b.WriteString(k + ": " + stripLineBreaks(v) + crlf)
+	}
+
+	date := e.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	if e.From != "" {
+		writeHeader("From", formatAddressList(e.From))
+	}
+	if e.ReplyTo != "" {
+		writeHeader("Reply-To", formatAddressList(e.ReplyTo))
+	}
+	if e.To != "" {
+		writeHeader("To", formatAddressList(e.To))
+	}
+	if e.Subject != "" {
+		writeHeader("Subject", mime.QEncoding.Encode("UTF-8", e.Subject))
+	}
+	if e.MessageID != "" {
+		writeHeader("Message-ID", e.MessageID)
+	} else {
+		writeHeader("Message-ID", newMessageID(e.From))
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	if len(e.Inline) > 0 {
+		// Wrap the bodies along with inline files
+		mw := multipart.NewWriter(b)
+		writeHeader("Content-Type", mime.FormatMediaType("multipart/related",
+			map[string]string{"boundary": mw.Boundary()}))
+		b.WriteString(crlf)
+		h, content := e.bodyEntity()
+		pw, _ := mw.CreatePart(h)
+		content(pw)
+		for _, a := range e.Inline {
+			pw, _ := mw.CreatePart(a.header())
+			writeBase64(pw, a.Data)
+		}
+		mw.Close()
+	} else if len(e.Body) > 0 {
+		h, content := e.bodyEntity()
+		for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			// Multipart bodies have no transfer encoding
+			if v := h.Get(k); v != "" {
+				writeHeader(k, v)
+			}
+		}
+		b.WriteString(crlf)
+		content(b)
+	} else {
+		b.WriteString(crlf)
+	}
+	b.WriteString(crlf)
+
+	return b
+}
+
+// bodyEntity returns the header and a function writing the content of the
+// email bodies, as a single part or multipart/alternative entity.
+func (e Email) bodyEntity() (textproto.MIMEHeader, func(io.Writer)) {
+	if len(e.Body) == 1 {
+		return bodyHeader(e.Body[0].t), func(w io.Writer) {
+			writeQuotedPrintable(w, e.Body[0].c)
+		}
+	}
+	boundary := multipart.NewWriter(nil).Boundary()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/alternative",
+		map[string]string{"boundary": boundary}))
+	return h, func(w io.Writer) {
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(boundary)
+		for _, body := range e.Body {
+			pw, _ := mw.CreatePart(bodyHeader(body.t))
+			writeQuotedPrintable(pw, body.c)
+		}
+		mw.Close()
+	}
+}
+
+// header returns the MIME header of an inline attachment.
+func (a Attachment) header() textproto.MIMEHeader {
+	ct := a.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{}
+	params := map[string]string{}
+	disposition := map[string]string{}
+	if a.Filename != "" {
+		params["name"] = a.Filename
+		disposition["filename"] = a.Filename
+	}
+	h.Set("Content-Type", mime.FormatMediaType(ct, params))
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", mime.FormatMediaType("inline", disposition))
+	h.Set("Content-ID", "<"+stripLineBreaks(a.ContentID)+">")
+	return h
+}
+
+// bodyHeader returns the MIME header of a text body.
+func bodyHeader(contentType string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType(
+		stripLineBreaks(contentType), map[string]string{"charset": "UTF-8"}))
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return h
+}
+
+func writeQuotedPrintable(w io.Writer, s string) {
+	qw := quotedprintable.NewWriter(w)
+	io.WriteString(qw, s)
+	qw.Close()
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) {
+	s := base64.StdEncoding.EncodeToString(data)
+	for len(s) > 76 {
+		io.WriteString(w, s[:76]+"\r\n")
+		s = s[76:]
+	}
+	io.WriteString(w, s)
+}
+
+// formatAddressList formats a list of addresses, encoding display names
+// as required. The list is returned unchanged if it can't be parsed.
+func formatAddressList(s string) string {
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		return s
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.String()
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// newMessageID returns a unique Message-ID for an email sent by from.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			domain = a.Address[i+1:]
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + stripLineBreaks(domain) + ">"
+}
+
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,181 @@
+package passwordless
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail(t *testing.T) {
+	d := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	e := Email{
+		To:      "bender@ilovebender.com",
+		From:    "Planet Express <noreply@planetexpress.com>",
+		ReplyTo: "hermes@planetexpress.com",
+		Subject: "Mom Calling",
+		Date:    d,
+	}
+
+	// Empty body
+	m, err := mail.ReadMessage(e.Buffer())
+	assert.NoError(t, err)
+	assert.Equal(t, "<bender@ilovebender.com>", m.Header.Get("To"))
+	assert.Equal(t, `"Planet Express" <noreply@planetexpress.com>`, m.Header.Get("From"))
+	assert.Equal(t, "<hermes@planetexpress.com>", m.Header.Get("Reply-To"))
+	assert.Equal(t, "Mom Calling", m.Header.Get("Subject"))
+	assert.Equal(t, "Sat, 03 Feb 2001 04:05:06 +0000", m.Header.Get("Date"))
+	date, err := m.Header.Date()
+	assert.NoError(t, err)
+	assert.True(t, d.Equal(date))
+	assert.Regexp(t, "^<[0-9a-f]{32}@planetexpress.com>$", m.Header.Get("Message-ID"))
+	assert.Equal(t, "1.0", m.Header.Get("MIME-Version"))
+
+	// Message IDs are unique
+	m2, err := mail.ReadMessage(e.Buffer())
+	assert.NoError(t, err)
+	assert.NotEqual(t, m.Header.Get("Message-ID"), m2.Header.Get("Message-ID"))
+
+	// Plain body
+	e.AddBody("", "Hello dear, = is ünicode")
+	m, err = mail.ReadMessage(e.Buffer())
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=UTF-8", m.Header.Get("Content-Type"))
+	assert.Equal(t, "quoted-printable", m.Header.Get("Content-Transfer-Encoding"))
+	body, err := ioutil.ReadAll(m.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello dear, =3D is =C3=BCnicode\r\n", string(body))
+
+	// Additional HTML body (multipart)
+	e.AddBody("text/html", "<html><body>Hello dear</body></html>")
+	m, err = mail.ReadMessage(e.Buffer())
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0", m.Header.Get("MIME-Version"))
+	ct := m.Header.Get("Content-Type")
+	re := regexp.MustCompile("^multipart/alternative; boundary=([a-z0-9]+)$")
+	assert.Regexp(t, re, ct)
+	boundary := re.FindStringSubmatch(ct)[1]
+	assert.NotEmpty(t, boundary)
+
+	mpr := multipart.NewReader(m.Body, boundary)
+
+	// Read first part
+	p, err := mpr.NextPart()
+	assert.NoError(t, err, "reading first part")
+	assert.Equal(t, "text/plain; charset=UTF-8", p.Header.Get("Content-Type"))
+	body, err = ioutil.ReadAll(p)
+	assert.NoError(t, err, "reading body of first part")
+	assert.Equal(t, "Hello dear, = is ünicode", string(body))
+
+	// Read second part
+	p, err = mpr.NextPart()
+	assert.NoError(t, err, "reading second part")
+	assert.Equal(t, "text/html; charset=UTF-8", p.Header.Get("Content-Type"))
+	body, err = ioutil.ReadAll(p)
+	assert.NoError(t, err, "reading body of second part")
+	assert.Equal(t, "<html><body>Hello dear</body></html>", string(body))
+
+	// Read (non-existent) next part
+	p, err = mpr.NextPart()
+	assert.Nil(t, p)
+
+	// Boundaries are unique
+	m2, err = mail.ReadMessage(e.Buffer())
+	assert.NoError(t, err)
+	assert.NotEqual(t, ct, m2.Header.Get("Content-Type"))
+}
+
+func TestEmailEncodedHeaders(t *testing.T) {
+	e := Email{
+		To:      "Bendér Rodríguez <bender@ilovebender.com>",
+		Subject: "Olá, Mãe",
+	}
+	b := e.Bytes()
+	assert.NotContains(t, string(b), "Olá", "subject should be encoded")
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Olá, Mãe", subject)
+
+	to, err := m.Header.AddressList("To")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bendér Rodríguez", to[0].Name)
+	assert.Equal(t, "bender@ilovebender.com", to[0].Address)
+}
+
+func TestEmailHeaderInjection(t *testing.T) {
+	for _, e := range []Email{
+		{Subject: "Hi\r\nBcc: victim@example.com"},
+		{To: "bender@ilovebender.com\nBcc: victim@example.com"},
+		{From: "a@example.com\r\n"},
+		{Inline: []Attachment{{ContentID: "logo\r\nX-Evil: 1"}}},
+	} {
+		buf := bytes.NewBuffer(nil)
+		n, err := e.Write(buf)
+		assert.ErrorIs(t, err, ErrHeaderInjection)
+		assert.Zero(t, n)
+		assert.Zero(t, buf.Len())
+
+		// Buffer strips line breaks rather than injecting headers
+		m, err := mail.ReadMessage(e.Buffer())
+		require.NoError(t, err)
+		assert.Empty(t, m.Header.Get("Bcc"))
+		assert.Empty(t, m.Header.Get("X-Evil"))
+	}
+}
+
+func TestEmailInline(t *testing.T) {
+	e := Email{To: "bender@ilovebender.com", Subject: "Logo"}
+	e.AddBody("text/plain", "Hello")
+	e.AddBody("text/html", `<img src="cid:logo">`)
+	logo := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 50)
+	e.AddInline("logo", "image/png", "logo.png", logo)
+
+	m, err := mail.ReadMessage(e.Buffer())
+	require.NoError(t, err)
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/related", mt)
+
+	mpr := multipart.NewReader(m.Body, params["boundary"])
+
+	// Alternative bodies
+	p, err := mpr.NextPart()
+	require.NoError(t, err)
+	mt, params, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mt)
+	alt := multipart.NewReader(p, params["boundary"])
+	for _, expected := range []string{"Hello", `<img src="cid:logo">`} {
+		ap, err := alt.NextPart()
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(ap)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(body))
+	}
+
+	// Inline logo
+	p, err = mpr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "<logo>", p.Header.Get("Content-ID"))
+	require.Equal(t, "base64", p.Header.Get("Content-Transfer-Encoding"))
+	require.Equal(t, `inline; filename=logo.png`, p.Header.Get("Content-Disposition"))
+	raw, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	for _, l := range strings.Split(string(raw), "\r\n") {
+		require.LessOrEqual(t, len(l), 76)
+	}
+	_, err = mpr.NextPart()
+	require.Error(t, err)
+}
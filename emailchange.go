@@ -0,0 +1,102 @@
+package passwordless
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrPendingRecipientNotSupported = errors.New("token store does not support pending recipients")
+	ErrPendingRecipientRequired     = errors.New("pending recipient is required")
+)
+
+// PurposeEmailChangeNotice is the purpose of the message sent to the old
+// address of a user when changing it. The message carries no token.
+const PurposeEmailChangeNotice = "email_change_notice"
+
+// PendingRecipientStore is implemented by token stores that can keep a
+// pending recipient, e.g. a new email address, with a token. Store must
+// keep the pending recipient of the context, see `WithPendingRecipient`,
+// with the token in the same write, and clear it if there is none.
+type PendingRecipientStore interface {
+	TokenStore
+	// ConsumePendingRecipient verifies the token like Verify, and if it is
+	// valid removes it like Delete, returning the recipient kept with that
+	// very token
+	ConsumePendingRecipient(ctx context.Context, token, uid string) (string, bool, error)
+}
+
+// WithPendingRecipient returns a Context specifying the pending recipient
+// stored with tokens by `RequestToken`. `Passwordless.RequestEmailChange`
+// sets this automatically.
+func WithPendingRecipient(ctx context.Context, recipient string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, pendingKey, recipient)
+}
+
+// PendingRecipientFromContext returns the recipient set with
+// `WithPendingRecipient`, e.g. to mention the new address when notifying
+// the old one.
+func PendingRecipientFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	r, _ := ctx.Value(pendingKey).(string)
+	return r
+}
+
+// RequestEmailChange sends a PurposeEmailChange token to newRecipient, to
+// prove the signed in user owns it, and keeps the address with the token.
+// If oldRecipient is not empty, it is notified of the change through the
+// same strategy, with an empty token and PurposeEmailChangeNotice as the
+// context purpose. Requires a Store implementing PendingRecipientStore.
+func (p *Passwordless) RequestEmailChange(ctx context.Context, s, uid, oldRecipient, newRecipient string) error {
+	if _, ok := p.Store.(PendingRecipientStore); !ok {
+		return errors.WithStack(ErrPendingRecipientNotSupported)
+	}
+	if uid == "" {
+		return errors.WithStack(ErrUnknownUser)
+	} else if newRecipient == "" {
+		return errors.WithStack(ErrPendingRecipientRequired)
+	}
+	ctx = WithPendingRecipient(ctx, newRecipient)
+	if err := p.RequestToken(ctx, PurposeEmailChange, s, uid, newRecipient); err != nil {
+		return err
+	}
+	if oldRecipient == "" {
+		return nil
+	}
+	ctx = WithPurpose(WithRecipient(ctx, oldRecipient), PurposeEmailChangeNotice)
+	t, err := p.GetStrategy(ctx, s)
+	if err != nil {
+		return err
+	}
+	return t.Send(ctx, "", uid, oldRecipient)
+}
+
+// VerifyEmailChange verifies a token sent by `RequestEmailChange`,
+// returning the confirmed address for the application to commit. The
+// application should check the address is not taken by another user
+// before committing it. Tokens stored without an address are not valid.
+func (p *Passwordless) VerifyEmailChange(ctx context.Context, uid, token string) (string, bool, error) {
+	ps, ok := p.Store.(PendingRecipientStore)
+	if !ok {
+		return "", false, errors.WithStack(ErrPendingRecipientNotSupported)
+	}
+	ctx = WithPurpose(ctx, PurposeEmailChange)
+	if p.BindSessions && !confirmedLink(ctx) {
+		if err := p.checkBinding(ctx, uid); err != nil {
+			return "", false, err
+		}
+	}
+	// The address is read with the token it was stored with, so that it
+	// can't change before the token is removed
+	recipient, valid, err := ps.ConsumePendingRecipient(ctx, token, uid)
+	if err != nil || !valid || recipient == "" {
+		return "", false, err
+	}
+	return recipient, true, nil
+}
@@ -0,0 +1,135 @@
+package passwordless
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// sentMessage records a message sent by recordTransport
+type sentMessage struct {
+	token, recipient, purpose, pending string
+}
+
+type recordTransport struct {
+	sent []sentMessage
+}
+
+func (t *recordTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	t.sent = append(t.sent, sentMessage{
+		token:     token,
+		recipient: recipient,
+		purpose:   PurposeFromContext(ctx),
+		pending:   PendingRecipientFromContext(ctx),
+	})
+	return nil
+}
+
+func TestEmailChange(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	tt := &recordTransport{}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, time.Minute)
+
+	// The uid of the signed in user is required
+	err = p.RequestEmailChange(nil, "email", "", "", "new@ilovebender.com")
+	require.True(t, errors.Is(err, ErrUnknownUser))
+	err = p.RequestEmailChange(nil, "email", "42", "bender@ilovebender.com", "")
+	require.True(t, errors.Is(err, ErrPendingRecipientRequired))
+	require.Empty(t, tt.sent)
+
+	// The token goes to the new address, and the old one is notified
+	require.NoError(t, p.RequestEmailChange(nil, "email", "42",
+		"bender@ilovebender.com", "new@ilovebender.com"))
+	require.Equal(t, []sentMessage{
+		{"1337", "new@ilovebender.com", PurposeEmailChange, "new@ilovebender.com"},
+		{"", "bender@ilovebender.com", PurposeEmailChangeNotice, "new@ilovebender.com"},
+	}, tt.sent)
+
+	// A sign in token for the same user is kept apart
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	recipient, valid, err := store.ConsumePendingRecipient(nil, "1337", "42")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Empty(t, recipient)
+
+	// Bad tokens don't confirm the address
+	recipient, valid, err = p.VerifyEmailChange(nil, "42", "0000")
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Empty(t, recipient)
+
+	recipient, valid, err = p.VerifyEmailChange(nil, "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "new@ilovebender.com", recipient)
+
+	// The token is used up
+	_, valid, err = p.VerifyEmailChange(nil, "42", "1337")
+	require.True(t, errors.Is(err, ErrTokenNotFound))
+	require.False(t, valid)
+
+	// Without an old address there is no notice
+	tt.sent = nil
+	require.NoError(t, p.RequestEmailChange(nil, "email", "43", "", "fry@ilovebender.com"))
+	require.Len(t, tt.sent, 1)
+
+	// A new request replaces the pending address
+	require.NoError(t, p.RequestEmailChange(nil, "email", "43", "", "philip@ilovebender.com"))
+	recipient, valid, err = p.VerifyEmailChange(nil, "43", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "philip@ilovebender.com", recipient)
+
+	// Tokens without a pending address don't confirm one, also when they
+	// replace a token with one
+	require.NoError(t, p.RequestEmailChange(nil, "email", "44", "", "leela@ilovebender.com"))
+	require.NoError(t, p.RequestToken(nil, PurposeEmailChange, "email", "44", "leela@ilovebender.com"))
+	recipient, valid, err = p.VerifyEmailChange(nil, "44", "1337")
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Empty(t, recipient)
+}
+
+func TestEmailChangeNotice(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	templates, err := ParseEmailTemplates(os.DirFS("example/templates/email"))
+	require.NoError(t, err)
+	tt := &composeTransport{c: &TemplateComposer{
+		Templates:     templates,
+		DefaultLocale: "en",
+		Link: func(ctx context.Context, token, uid, recipient string) (string, error) {
+			return "https://example.com/?token=" + token, nil
+		},
+	}}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, time.Minute)
+
+	// The old address is told about the change, without a PIN or link
+	require.NoError(t, p.RequestEmailChange(nil, "email", "42",
+		"bender@ilovebender.com", "new@ilovebender.com"))
+	require.Equal(t, "bender@ilovebender.com", tt.sent.To)
+	require.Equal(t, "Go-Passwordless email address change", tt.sent.Subject)
+	require.Len(t, tt.sent.Body, 2)
+	for _, b := range tt.sent.Body {
+		require.Contains(t, b.c, "new@ilovebender.com", b.t)
+		require.NotContains(t, b.c, "PIN", b.t)
+		require.NotContains(t, b.c, "https://example.com", b.t)
+	}
+
+	// Sign in emails are unchanged
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	require.Equal(t, "Go-Passwordless signin", tt.sent.Subject)
+	require.Contains(t, tt.sent.Body[0].c, "Your PIN is 1337 - or use the following link: "+
+		"https://example.com/?token=1337")
+}
@@ -0,0 +1,112 @@
+package passwordless
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultDecoyDelay is the delivery time assumed for a strategy until a
+// request for a known user was observed, see `Passwordless.DecoyDelay`.
+const DefaultDecoyDelay = 500 * time.Millisecond
+
+const (
+	// decoyWeight is the weight of the latest observation in the moving
+	// average of request durations.
+	decoyWeight = 0.2
+	// decoyHash is a bcrypt hash with the cost used by SQLiteStore, so that
+	// comparing against it takes as long as verifying a stored token.
+	decoyHash = "$2a$10$aThTBeeZ6Pym/lpOL8JMkOjTxl3Th0Oqs0PeYUgeYur5GsmiDrtuy"
+)
+
+// decoy mimics the work done for known users when `EnumerationSafe` is
+// set, so that requests for unknown users can't be told apart. Delivery
+// times are estimated per strategy, as e.g. SMTP is much slower than a
+// webhook.
+type decoy struct {
+	mu        sync.Mutex
+	estimates map[string]time.Duration
+
+	// now, sleep and compare are replaced by tests
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration)
+	compare func(hash, token []byte) error
+}
+
+// clock returns the current time.
+func (d *decoy) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// observe records the duration of a request for a known user of the named
+// strategy.
+func (d *decoy) observe(strategy string, elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.estimates == nil {
+		d.estimates = map[string]time.Duration{}
+	}
+	estimate, ok := d.estimates[strategy]
+	if !ok {
+		// The first observation replaces the assumed delay
+		d.estimates[strategy] = elapsed
+		return
+	}
+	d.estimates[strategy] = estimate + time.Duration(decoyWeight*float64(elapsed-estimate))
+}
+
+// delay returns how long to wait since start for a request of the named
+// strategy, falling back to floor until one was observed.
+func (d *decoy) delay(strategy string, floor time.Duration, start time.Time) time.Duration {
+	d.mu.Lock()
+	estimate, ok := d.estimates[strategy]
+	d.mu.Unlock()
+	if !ok {
+		estimate = floor
+	}
+	return estimate - d.clock().Sub(start)
+}
+
+// wait blocks for the given duration, or until ctx is done.
+func (d *decoy) wait(ctx context.Context, remaining time.Duration) {
+	if remaining <= 0 {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if d.sleep != nil {
+		d.sleep(ctx, remaining)
+		return
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// request generates and hashes a token like `RequestToken` would, then
+// simulates delivery by the named strategy by waiting until the estimated
+// delivery time has passed since start.
+func (d *decoy) request(ctx context.Context, strategy string, t Strategy, floor time.Duration, start time.Time) {
+	if tok, err := t.Generate(ctx); err == nil {
+		bcrypt.GenerateFromPassword([]byte(tok), bcrypt.DefaultCost)
+	}
+	d.wait(ctx, d.delay(strategy, floor, start))
+}
+
+// verify compares the token against a dummy hash like a token store would.
+func (d *decoy) verify(token string) {
+	compare := d.compare
+	if compare == nil {
+		compare = bcrypt.CompareHashAndPassword
+	}
+	compare([]byte(decoyHash), []byte(token))
+}
@@ -0,0 +1,116 @@
+package passwordless
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// clockTransport simulates the latency of a real delivery by advancing the
+// clock.
+type clockTransport struct {
+	clock *testClock
+	delay time.Duration
+}
+
+func (t clockTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	t.clock.now = t.clock.now.Add(t.delay)
+	return nil
+}
+
+func TestEnumerationSafe(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{
+		"42": "bender@ilovebender.com",
+		"43": "leela@planetexpress.com",
+	}}
+	clock := &testClock{now: time.Unix(1600000000, 0)}
+	p.SetTransport("email", clockTransport{clock: clock, delay: 300 * time.Millisecond},
+		testGenerator{token: "1337"}, time.Minute)
+	p.SetTransport("webhook", clockTransport{clock: clock, delay: 20 * time.Millisecond},
+		testGenerator{token: "1337"}, time.Minute)
+	var waits []time.Duration
+	p.decoy.now = clock.Now
+	p.decoy.sleep = func(ctx context.Context, d time.Duration) {
+		waits = append(waits, d)
+	}
+	compared := 0
+	p.decoy.compare = func(hash, token []byte) error {
+		compared++
+		return nil
+	}
+	request := func(s, recipient string) {
+		require.NoError(t, p.RequestToken(nil, PurposeLogin, s, "", recipient))
+	}
+
+	// Without the mode, unknown users don't wait
+	request("email", "fry@planetexpress.com")
+	require.Empty(t, waits)
+
+	// With the mode, unknown users wait for the assumed delay until a
+	// delivery was observed
+	p.EnumerationSafe = true
+	request("email", "fry@planetexpress.com")
+	require.Equal(t, []time.Duration{DefaultDecoyDelay}, waits)
+	p.DecoyDelay = time.Second
+	request("email", "fry@planetexpress.com")
+	require.Equal(t, time.Second, waits[1])
+
+	// Then for as long as deliveries by the same strategy take
+	request("email", "bender@ilovebender.com")
+	request("email", "fry@planetexpress.com")
+	require.Equal(t, 300*time.Millisecond, waits[2])
+	request("webhook", "bender@ilovebender.com")
+	request("webhook", "fry@planetexpress.com")
+	require.Equal(t, 20*time.Millisecond, waits[3])
+
+	// The estimate is a moving average
+	p.SetTransport("email", clockTransport{clock: clock, delay: 800 * time.Millisecond},
+		testGenerator{token: "1337"}, time.Minute)
+	request("email", "bender@ilovebender.com")
+	request("email", "fry@planetexpress.com")
+	require.Equal(t, 400*time.Millisecond, waits[4])
+	request("webhook", "fry@planetexpress.com")
+	require.Equal(t, 20*time.Millisecond, waits[5])
+
+	// Verification compares against a dummy hash for an unknown user, and
+	// a known user without a pending token, like for a bad token
+	for _, recipient := range []string{
+		"bender@ilovebender.com", "fry@planetexpress.com", "leela@planetexpress.com",
+	} {
+		uid, valid, err := p.VerifyRecipient(nil, PurposeLogin, "email", recipient, "badtoken")
+		require.NoError(t, err)
+		require.False(t, valid)
+		require.Empty(t, uid)
+	}
+	require.Equal(t, 2, compared)
+
+	uid, valid, err := p.VerifyRecipient(nil, PurposeLogin, "email", "bender@ilovebender.com", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", uid)
+}
+
+func TestDecoyWait(t *testing.T) {
+	// The delay is cut short if the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := &decoy{}
+	d.wait(ctx, time.Hour)
+	d.wait(nil, -time.Second)
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 
 	"github.com/mozey/go-passwordless-sqlite"
+	"github.com/pkg/errors"
 )
 
 // signinHandler prompts the user to choose a method by which to send them
 // a token.
 func signinHandler(w http.ResponseWriter, r *http.Request) {
 	if session, err := getSession(w, r); err == nil {
-		if isSignedIn(session) {
+		if isSignedIn(r) {
 			session.AddFlash("already_signed_in")
 			session.Save(r, w)
 			redirect(w, r, "/", baseURL)
@@ -19,11 +21,11 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err := tmpl.ExecuteTemplate(w, "signin", struct {
-			Strategies map[string]passwordless.Strategy
+			Strategies []passwordless.StrategyEntry
 			Context    *Context
 			Next       string
 		}{
-			Strategies: pw.ListStrategies(nil),
+			Strategies: pw.ListStrategies(passwordless.SetContext(nil, w, r)),
 			Context:    getTemplateContext(w, r, session),
 			Next:       r.FormValue("next"),
 		}); err != nil {
@@ -43,7 +45,7 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if isSignedIn(session) {
+	if isSignedIn(r) {
 		session.AddFlash("already_signed_in")
 		session.Save(r, w)
 		redirect(w, r, r.FormValue("next"), baseURL)
@@ -55,7 +57,6 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	strategy := r.FormValue("strategy")
 	recipient := r.FormValue("recipient")
-	uid := r.FormValue("uid")
 
 	// token is only set if the user is trying to verify a token they've got
 	token := r.FormValue("token")
@@ -63,13 +64,7 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	// tokenError will be set if the user enters a bad token.
 	tokenError := ""
 
-	if uid == "" {
-		// Lookup user ID. We just use the recipient value in this demo,
-		// but typically you'd perform a database query here.
-		uid = recipient
-	}
-
-	log.Println("strategy=", strategy, "recipient=", recipient, "uid=", uid, "token=", token)
+	log.Println("strategy=", strategy, "recipient=", recipient)
 
 	if strategy == "" {
 		// No strategy specified in request, so send the user back to
@@ -80,8 +75,11 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if token == "" {
 		// No token provided in request, so generate a new one and send it
-		// to the user via their preferred transport strategy.
-		err := pw.RequestToken(ctx, strategy, uid, recipient)
+		// to the user via their preferred transport strategy. The user ID
+		// is looked up by the resolver. The poll token is kept in the
+		// session, so this device can poll for approval in case the user
+		// follows the link on another device.
+		pollToken, err := pw.RequestApproval(ctx, strategy, "", recipient)
 
 		if err != nil {
 			writeError(w, r, session, http.StatusInternalServerError, Error{
@@ -91,14 +89,16 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		}
+		session.Values["approval"] = pollToken
+		session.Save(r, w)
 	} else {
-		// User has provided a token, verify it against provided uid.
-		valid, err := pw.VerifyToken(ctx, uid, token)
+		// User has provided a token, verify it against the user the
+		// recipient belongs to, and start a session if it is valid.
+		_, valid, err := pw.SignIn(ctx, strategy, recipient, token)
 
 		if valid {
-			// User provided a valid token! We can safely use the uid as it
-			// is validated alongside the token.
-			session.Values["uid"] = uid
+			// User provided a valid token! The session cookie is set, and
+			// identifies the user the recipient belongs to.
 			session.AddFlash("signed_in")
 			session.Save(r, w)
 			redirect(w, r, r.FormValue("next"), baseURL)
@@ -134,13 +134,11 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 		Context    *Context
 		Strategy   string
 		Recipient  string
-		UserID     string
 		Next       string
 		TokenError string
 	}{
 		Strategy:   strategy,
 		Recipient:  recipient,
-		UserID:     uid,
 		Context:    getTemplateContext(w, r, session),
 		Next:       r.FormValue("next"),
 		TokenError: tokenError,
@@ -149,16 +147,140 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// linkSignedIn is called once the token of a magic link was verified.
+func linkSignedIn(w http.ResponseWriter, r *http.Request, uid string) {
+	session, err := getSession(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Only sign in links are sent
+	if passwordless.PurposeFromContext(r.Context()) != passwordless.PurposeLogin {
+		writeError(w, r, session, http.StatusBadRequest, Error{
+			Name:        "Invalid link",
+			Description: "This link can't be used to sign in.",
+		})
+		return
+	}
+	if _, err := pw.IssueSession(passwordless.SetContext(r.Context(), w, r), uid); err != nil {
+		writeError(w, r, session, http.StatusInternalServerError, Error{
+			Name:        "Internal Error",
+			Description: err.Error(),
+			Error:       err,
+		})
+		return
+	}
+	session.AddFlash("signed_in")
+	session.Save(r, w)
+	redirect(w, r, "/", baseURL)
+}
+
+// pollHandler reports the status of the sign in requested from this
+// device, and signs the user in once it was approved from another device.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := getSession(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	pollToken, _ := session.Values["approval"].(string)
+	if pollToken == "" {
+		http.Error(w, "No sign in requested", http.StatusNotFound)
+		return
+	}
+
+	status, uid, err := pw.PollApproval(r.Context(), pollToken)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	switch status {
+	case passwordless.ApprovalPending:
+	case passwordless.ApprovalApproved:
+		delete(session.Values, "approval")
+		if _, err := pw.IssueSession(passwordless.SetContext(r.Context(), w, r), uid); err != nil {
+			log.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		session.AddFlash("signed_in")
+	default:
+		delete(session.Values, "approval")
+	}
+	session.Save(r, w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status passwordless.ApprovalStatus `json:"status"`
+	}{status})
+}
+
 func signoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := getSession(w, r)
 	if err != nil {
 		return
 	}
 
-	// Remove secure session cookie
-	delete(session.Values, "uid")
+	// Revoke the passwordless session, and remove its cookie
+	if err := pw.EndSession(passwordless.SetContext(r.Context(), w, r)); err != nil {
+		log.Println(err)
+	}
 	session.AddFlash("signed_out")
 	session.Save(r, w)
 
 	redirect(w, r, r.FormValue("next"), baseURL)
 }
+
+// sessionsHandler lists the sessions of the signed in user, and revokes
+// them individually or all at once.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := getSession(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	current := passwordless.UserSessionFromContext(r.Context())
+
+	if r.Method == http.MethodPost {
+		if id := r.FormValue("id"); id != "" {
+			err = pw.RevokeSession(r.Context(), current.UID, id)
+		} else {
+			err = pw.RevokeSessions(r.Context(), current.UID)
+		}
+		if err != nil && !errors.Is(err, passwordless.ErrSessionNotFound) {
+			writeError(w, r, session, http.StatusInternalServerError, Error{
+				Name:        "Failed revoking session",
+				Description: err.Error(),
+				Error:       err,
+			})
+			return
+		}
+		http.Redirect(w, r, "/restricted/sessions", http.StatusSeeOther)
+		return
+	}
+
+	sessions, err := pw.ListSessions(r.Context(), current.UID)
+	if err != nil {
+		writeError(w, r, session, http.StatusInternalServerError, Error{
+			Name:        "Failed listing sessions",
+			Description: err.Error(),
+			Error:       err,
+		})
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "sessions", struct {
+		Context  *Context
+		Sessions []*passwordless.UserSession
+		Current  string
+	}{
+		Context:  getTemplateContext(w, r, session),
+		Sessions: sessions,
+		Current:  current.ID,
+	}); err != nil {
+		log.Println(err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"net/smtp"
@@ -13,8 +12,6 @@ import (
 	"path"
 	"time"
 
-	"context"
-
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	_ "github.com/mattn/go-sqlite3"
@@ -28,6 +25,9 @@ const SesssionKey string = "go-passwordless-example"
 
 var pw *passwordless.Passwordless
 
+// magicLink builds the links sent to users that sign them in
+var magicLink *passwordless.MagicLink
+
 var (
 	tmpl  *template.Template
 	store sessions.Store
@@ -60,6 +60,18 @@ func main() {
 	}
 	store = sessions.NewCookieStore(cookieKey)
 
+	// Sign magic links so they can't be tampered with
+	linkKey := []byte(os.Getenv("PWL_KEY_MAGIC_LINK"))
+	if len(linkKey) == 0 {
+		log.Println("PWL_KEY_MAGIC_LINK not defined; using random key")
+		linkKey = securecookie.GenerateRandomKey(32)
+	}
+	magicLink, err = passwordless.NewMagicLink(baseURL+"/account/link", linkKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	magicLink.TTL = 30 * time.Minute
+
 	// Init Passwordless with ephemeral memory store that will hold tokens
 	// util they're used (or expire)
 	db, err := createDB("example")
@@ -71,10 +83,27 @@ func main() {
 		log.Fatalln(err)
 	}
 	pw = passwordless.New(store)
+	pw.Resolver = userResolver{}
+	// Codes are only accepted from the browser that requested them
+	pw.BindSessions = true
+	pw.Approvals, err = passwordless.NewSQLiteApprovalStore(db, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Signed in users get a revocable session, see SessionMiddleware
+	pw.Sessions, err = passwordless.NewSQLiteSessionStore(db, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Add Passwordless email transport using SMTP credentials from env
 	if fromAddr := os.Getenv("PWL_EMAIL_ADDR"); fromAddr != "" {
 		log.Printf("Using email transport via %s", fromAddr)
+		emailTemplates, err := passwordless.ParseEmailTemplates(
+			os.DirFS("templates/email"))
+		if err != nil {
+			log.Fatalln("couldn't load email templates:", err)
+		}
 		pw.SetTransport("email", passwordless.NewSMTPTransport(
 			os.Getenv("PWL_EMAIL_ADDR"),
 			os.Getenv("PWL_EMAIL_FROM"),
@@ -83,22 +112,35 @@ func main() {
 				os.Getenv("PWL_EMAIL_AUTH_USERNAME"),
 				os.Getenv("PWL_EMAIL_AUTH_PASSWORD"),
 				os.Getenv("PWL_EMAIL_AUTH_HOST")),
-			emailWriter,
+			passwordless.NewTemplateComposer(emailTemplates, "en",
+				os.Getenv("PWL_EMAIL_FROM"), magicLink.LinkFunc("email")),
 		), passwordless.NewCrockfordGenerator(10), 30*time.Minute)
+		pw.Strategies.SetInfo("email", passwordless.StrategyInfo{
+			Label: "Send me an email", Icon: "fa-envelope"})
 	} else {
 		log.Println("No email transport specified, printing codes to stdout")
+		// Only offer the debug strategy to local clients
+		local, err := passwordless.RemoteIPIn("127.0.0.0/8", "::1/128")
+		if err != nil {
+			log.Fatalln(err)
+		}
 		pw.SetTransport("debug", passwordless.LogTransport{
 			MessageFunc: func(token, uid string) string {
-				return fmt.Sprintf("Login at %s/account/token?strategy=debug&token=%s&uid=%s",
-					baseURL, token, uid)
+				return "Login at " + magicLink.URL("debug", token, uid, "")
 			},
-		}, passwordless.NewCrockfordGenerator(4), 30*time.Minute)
+		}, passwordless.NewCrockfordGenerator(4), 30*time.Minute, local)
+		pw.Strategies.SetInfo("debug", passwordless.StrategyInfo{
+			Label: "Emit to debug stdout", Icon: "fa-tty"})
 	}
 
 	limiter, err := rateLimiter()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	linkHandler, err := passwordless.NewMagicLinkHandler(pw, magicLink, linkSignedIn)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Setup routes
 	http.HandleFunc("/", tmplHandler("index"))
@@ -108,6 +150,10 @@ func main() {
 	// verify a provided token
 	http.Handle("/account/token",
 		limiter.RateLimit(http.HandlerFunc(tokenHandler)))
+	// verify a token from a magic link, after the user confirms
+	http.Handle("/account/link", limiter.RateLimit(linkHandler))
+	// poll for approval of a sign in from another device
+	http.HandleFunc("/account/poll", pollHandler)
 
 	http.HandleFunc("/account/signout", signoutHandler)
 
@@ -126,9 +172,11 @@ func main() {
 	http.HandleFunc("/restricted", RestrictedHandler(
 		baseURL+"/account/signin", restricted))
 	restricted.HandleFunc("/", tmplHandler("secret"))
+	http.HandleFunc("/restricted/sessions", RestrictedHandler(
+		baseURL+"/account/signin", http.HandlerFunc(sessionsHandler)))
 
-	// Listen!
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Listen! Requests with a session cookie are authenticated first.
+	log.Fatal(http.ListenAndServe(":8080", pw.SessionMiddleware(http.DefaultServeMux)))
 }
 
 // RestrictedHandler wraps handlers and redirects the client to the specified
@@ -140,7 +188,7 @@ func RestrictedHandler(signinUrl string, h http.Handler) func(http.ResponseWrite
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if session, err := getSession(w, r); err == nil {
-			if session.Values["uid"] == nil {
+			if !isSignedIn(r) {
 				// Not logged in, redirect to signin page with a redirect.
 				u, _ := url.Parse(signinUrl)
 				u.RawQuery = u.RawQuery + "&next=" + r.URL.String()
@@ -176,40 +224,6 @@ func tmplHandler(name string) func(http.ResponseWriter, *http.Request) {
 	})
 }
 
-// emailWriter writes the token to email form.
-func emailWriter(ctx context.Context, token, uid, recipient string, w io.Writer) error {
-	e := &passwordless.Email{
-		Subject: "Go-Passwordless signin",
-		To:      recipient,
-	}
-
-	link := baseURL + "/account/token" +
-		"?strategy=email&token=" + token + "&uid=" + uid
-
-	// Ideally these would be populated from templates, but...
-	text := "You (or someone who knows your email address) wants " +
-		"to sign in to the Go-Passwordless website.\n\n" +
-		"Your PIN is " + token + " - or use the following link: " +
-		link + "\n\n" +
-		"(If you were did not request or were not expecting this email, " +
-		"you can safely ignore it.)"
-	html := "<!doctype html><html><body>" +
-		"<p>You (or someone who knows your email address) wants " +
-		"to sign in to the Go-Passwordless website.</p>" +
-		"<p>Your PIN is <b>" + token + "</b> - or <a href=\"" + link + "\">" +
-		"click here</a> to sign in automatically.</p>" +
-		"<p>(If you did not request or were not expecting this email, " +
-		"you can safely ignore it.)</p></body></html>"
-
-	// Add content types, from least- to most-preferable.
-	e.AddBody("text/plain", text)
-	e.AddBody("text/html", html)
-
-	_, err := e.Write(w)
-
-	return err
-}
-
 // rateLimiter creates and returns a new HTTPRateLimiter
 func rateLimiter() (*throttled.HTTPRateLimiter, error) {
 	store, err := memstore.New(0x10000)
@@ -217,7 +231,7 @@ func rateLimiter() (*throttled.HTTPRateLimiter, error) {
 		return nil, err
 	}
 
-	quota := throttled.RateQuota{throttled.PerMin(10), 5}
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(10), MaxBurst: 5}
 
 	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
 	if err != nil {
@@ -244,11 +258,42 @@ func createDB(dbName string) (db *sql.DB, err error) {
 		return db, errors.WithStack(err)
 	}
 	_, err = db.Exec(`create table session (
-	uid string primary key,
+	uid string not null,
 	token varchar(255) not null,
 	expires datetime not null,
+	created datetime not null,
+	binding varchar(64) not null default '',
+	purpose varchar(32) not null default 'login',
+	recipient varchar(255) not null default '',
+	primary key (uid, purpose)
+);`)
+	if err != nil {
+		return db, errors.WithStack(err)
+	}
+	_, err = db.Exec(`create table approval (
+	id varchar(64) primary key,
+	poll_hash varchar(64) not null,
+	uid string not null,
+	status varchar(16) not null,
+	ip varchar(64) not null,
+	user_agent text not null,
+	expires datetime not null,
 	created datetime not null
 );`)
+	if err != nil {
+		return db, errors.WithStack(err)
+	}
+	_, err = db.Exec(`create table user_session (
+	id varchar(32) primary key,
+	hash varchar(64) not null unique,
+	uid string not null,
+	ip varchar(64) not null,
+	user_agent text not null,
+	created datetime not null,
+	last_seen datetime not null,
+	expires datetime not null
+);
+create index user_session_uid on user_session (uid);`)
 	if err != nil {
 		return db, errors.WithStack(err)
 	}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mozey/go-passwordless-sqlite"
+)
+
+// userResolver maps recipients to user IDs. In this demo every recipient
+// is a user identified by the recipient itself, but typically you'd
+// perform a database query here and return passwordless.ErrUnknownUser
+// for addresses that don't belong to an account.
+type userResolver struct{}
+
+func (userResolver) ResolveUID(ctx context.Context, strategy, recipient string) (string, error) {
+	uid := strings.ToLower(strings.TrimSpace(recipient))
+	if uid == "" {
+		return "", passwordless.ErrUnknownUser
+	}
+	return uid, nil
+}
+
+func (userResolver) ResolveRecipient(ctx context.Context, strategy, uid string) (string, error) {
+	return uid, nil
+}
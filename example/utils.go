@@ -6,6 +6,7 @@ import (
 	"net/url"
 
 	"github.com/gorilla/sessions"
+	"github.com/mozey/go-passwordless-sqlite"
 )
 
 // Context holds data pertaining to the base page template.
@@ -29,10 +30,10 @@ func getTemplateContext(w http.ResponseWriter, r *http.Request, s *sessions.Sess
 	ctx := &Context{
 		Flashes: s.Flashes(),
 	}
-	if uid, ok := s.Values["uid"].(string); ok {
+	if us := passwordless.UserSessionFromContext(r.Context()); us != nil {
 		ctx.SignedIn = true
-		ctx.UserName = uid
-		ctx.UserID = uid
+		ctx.UserName = us.UID
+		ctx.UserID = us.UID
 	}
 	s.Save(r, w)
 	return ctx
@@ -83,6 +84,8 @@ func getSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, erro
 	return session, nil
 }
 
-func isSignedIn(s *sessions.Session) bool {
-	return s != nil && s.Values["uid"] != nil
+// isSignedIn returns true if the request has a passwordless session, see
+// passwordless.SessionMiddleware.
+func isSignedIn(r *http.Request) bool {
+	return passwordless.UserSessionFromContext(r.Context()) != nil
 }
@@ -0,0 +1,179 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/url"
+	"time"
+)
+
+// HOTP is a Strategy for counter-based one-time passwords generated by a
+// hardware token or authenticator app, see RFC 4226. Like TOTP, nothing is
+// stored or sent when requesting a token, and codes are verified against
+// the secret enrolled with `Enroll`.
+type HOTP struct {
+	NopTransport
+	otpConfig
+	Store OTPStore
+	// Window is the number of counters after the expected one that are also
+	// accepted, in case codes were generated without being used
+	Window uint64
+	// ResyncWindow is the number of counters searched by `Resync`
+	ResyncWindow uint64
+	valid        []ValidFunc
+}
+
+// NewHOTP returns an HOTP strategy using 6 digit SHA1 codes, accepting
+// codes up to 10 counters ahead, and resynchronising up to 100 counters
+// ahead. Verification locks for DefaultOTPLockout after
+// DefaultOTPMaxFailures failed codes. The strategy is only valid for
+// contexts satisfying all of the predicates.
+func NewHOTP(store OTPStore, issuer string, valid ...ValidFunc) *HOTP {
+	return &HOTP{
+		otpConfig: otpConfig{
+			Issuer:      issuer,
+			Digits:      6,
+			Algorithm:   OTPSHA1,
+			MaxFailures: DefaultOTPMaxFailures,
+			Lockout:     DefaultOTPLockout,
+		},
+		Store:        store,
+		Window:       10,
+		ResyncWindow: 100,
+		valid:        valid,
+	}
+}
+
+// Generate returns an empty token, as codes are generated on the device.
+func (s *HOTP) Generate(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// Sanitize removes spaces and dashes from codes.
+func (s *HOTP) Sanitize(ctx context.Context, t string) (string, error) {
+	return sanitizeOTP(t), nil
+}
+
+// TTL returns zero, as codes don't expire.
+func (s *HOTP) TTL(context.Context) time.Duration {
+	return 0
+}
+
+// Valid returns true if the context satisfies all validity predicates.
+func (s *HOTP) Valid(ctx context.Context) bool {
+	return AllOf(s.valid...)(ctx)
+}
+
+// Enroll generates a new pending secret for the user, with the counter
+// starting at zero. The account, e.g. the email address of the user,
+// identifies the secret in the authenticator app. The secret replaces any
+// existing one once the user enters a code from the device with `Confirm`.
+func (s *HOTP) Enroll(ctx context.Context, uid, account string) (*OTPEnrollment, error) {
+	params := url.Values{}
+	params.Set("counter", "0")
+	return s.enroll(ctx, s.Store, "hotp", uid, account, params)
+}
+
+// Confirm activates the secret enrolled with `Enroll` if code matches one
+// of the first counters within the window, replacing any existing secret.
+// It returns false if the code is not valid, which counts as a failure
+// like in `VerifyToken`.
+func (s *HOTP) Confirm(ctx context.Context, uid, code string) (bool, error) {
+	now := time.Now()
+	if err := s.locked(ctx, s.Store, uid, now); err != nil {
+		return false, err
+	}
+	secret, err := s.Store.PendingOTPSecret(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	c, ok, err := s.search(secret, 0, s.Window, sanitizeOTP(code))
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return s.fail(ctx, s.Store, uid, now)
+	}
+	if err := s.Store.ActivateOTPSecret(ctx, uid, c+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyToken returns true if code matches the expected counter, or one
+// within the window after it. The counter then moves past the code, so
+// it and any codes before it are not accepted again. After MaxFailures
+// failed codes, verification fails with ErrOTPLocked until Lockout has
+// passed.
+func (s *HOTP) VerifyToken(ctx context.Context, uid, code string) (bool, error) {
+	now := time.Now()
+	if err := s.locked(ctx, s.Store, uid, now); err != nil {
+		return false, err
+	}
+	secret, next, err := s.Store.OTPSecret(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	c, ok, err := s.search(secret, next, s.Window, sanitizeOTP(code))
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return s.fail(ctx, s.Store, uid, now)
+	}
+	if err := s.Store.AdvanceOTPCounter(ctx, uid, c+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Resync resynchronises the counter of a device that generated more codes
+// than the window allows, see RFC 4226 section 7.4. The user enters two
+// consecutive codes, which are searched for within the resync window. It
+// returns false if they are not found, which counts as a failure like in
+// `VerifyToken`.
+func (s *HOTP) Resync(ctx context.Context, uid, code1, code2 string) (bool, error) {
+	now := time.Now()
+	if err := s.locked(ctx, s.Store, uid, now); err != nil {
+		return false, err
+	}
+	secret, next, err := s.Store.OTPSecret(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	code1, code2 = sanitizeOTP(code1), sanitizeOTP(code2)
+	for c := next; c <= next+s.ResyncWindow; c++ {
+		first, err := s.code(secret, c)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(first), []byte(code1)) != 1 {
+			continue
+		}
+		second, err := s.code(secret, c+1)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(second), []byte(code2)) != 1 {
+			continue
+		}
+		if err := s.Store.AdvanceOTPCounter(ctx, uid, c+2); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return s.fail(ctx, s.Store, uid, now)
+}
+
+// search returns the first counter from `from` to `from+n` inclusive that
+// code matches.
+func (s *HOTP) search(secret []byte, from, n uint64, code string) (uint64, bool, error) {
+	for c := from; c <= from+n; c++ {
+		expected, err := s.code(secret, c)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return c, true, nil
+		}
+	}
+	return 0, false, nil
+}
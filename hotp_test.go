@@ -0,0 +1,81 @@
+package passwordless
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// hotpCodes are the test vectors for counters 0 to 9 from RFC 4226,
+// appendix D
+var hotpCodes = []string{
+	"755224", "287082", "359152", "969429", "338314",
+	"254676", "287922", "162583", "399871", "520489",
+}
+
+func TestHOTP(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOTPTable(db, HOTPTableName))
+	otps, err := NewSQLiteOTPStore(db, HOTPTableName)
+	require.NoError(t, err)
+	s := NewHOTP(otps, "Planet Express")
+	s.Window = 2
+	s.ResyncWindow = 5
+
+	e, err := s.Enroll(nil, "42", "bender@ilovebender.com")
+	require.NoError(t, err)
+	u, err := url.Parse(e.URI)
+	require.NoError(t, err)
+	require.Equal(t, "hotp", u.Host)
+	require.Equal(t, "0", u.Query().Get("counter"))
+
+	// The secret is active once confirmed with a code
+	require.NoError(t, otps.SetOTPSecret(nil, "42", []byte("12345678901234567890")))
+	_, err = s.VerifyToken(nil, "42", hotpCodes[0])
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	valid, err := s.Confirm(nil, "42", hotpCodes[5])
+	require.NoError(t, err)
+	require.False(t, valid, "beyond the window")
+	valid, err = s.Confirm(nil, "42", hotpCodes[0])
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[1])
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Used codes are rejected
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[1])
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Codes within the window are accepted, skipping the ones before
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[4])
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[3])
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Codes beyond the window require resynchronisation
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[8])
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = s.Resync(nil, "42", hotpCodes[8], hotpCodes[6])
+	require.NoError(t, err)
+	require.False(t, valid, "codes must be consecutive")
+	valid, err = s.Resync(nil, "42", hotpCodes[8], hotpCodes[9])
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, counter, err := otps.OTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), counter)
+	valid, err = s.VerifyToken(nil, "42", hotpCodes[9])
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	_, err = s.VerifyToken(nil, "43", hotpCodes[0])
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+}
@@ -0,0 +1,372 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoJWTIssuer        = errors.New("no jwt issuer has been configured")
+	ErrJWTKeyNotSupported = errors.New("jwt key type is not supported")
+	ErrJWTKeyNotFound     = errors.New("jwt key does not exist")
+	ErrJWTNotValid        = errors.New("jwt is not valid")
+	ErrJWTExpired         = errors.New("jwt is expired")
+)
+
+// JWTKey is a key that signs JWTs. The algorithm follows from the type of
+// Key: a []byte secret for HS256, an *rsa.PrivateKey for RS256 or an
+// ed25519.PrivateKey for EdDSA.
+type JWTKey struct {
+	// ID is published as the "kid" header, so verifiers pick the right key
+	// while keys are rotated
+	ID  string
+	Key interface{}
+}
+
+// alg returns the JWS algorithm of the key, see RFC 7518.
+func (k JWTKey) alg() (string, error) {
+	switch key := k.Key.(type) {
+	case []byte:
+		if len(key) < 32 {
+			break
+		}
+		return "HS256", nil
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	case ed25519.PrivateKey:
+		return "EdDSA", nil
+	}
+	return "", errors.WithStack(ErrJWTKeyNotSupported)
+}
+
+func (k JWTKey) sign(data []byte) ([]byte, error) {
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case *rsa.PrivateKey:
+		h := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		return sig, errors.WithStack(err)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	}
+	return nil, errors.WithStack(ErrJWTKeyNotSupported)
+}
+
+func (k JWTKey) verify(data, sig []byte) bool {
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PrivateKey:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sig) == nil
+	case ed25519.PrivateKey:
+		return ed25519.Verify(key.Public().(ed25519.PublicKey), data, sig)
+	}
+	return false
+}
+
+// JWK is a public key in JSON Web Key format, see RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP curve and public key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWTIssuer issues JWTs to users once they signed in, e.g. for an API
+// gateway. Keys are rotated by adding a new key with `Rotate`, which signs
+// from then on, while the previous keys remain published until removed.
+type JWTIssuer struct {
+	// Issuer is the "iss" claim, e.g. "https://example.com"
+	Issuer string
+	// Audience is the "aud" claim, if not empty
+	Audience []string
+	// TTL is the lifetime of tokens
+	TTL time.Duration
+	// Claims optionally returns claims to add to the token of a user,
+	// e.g. roles. They can't replace the registered claims.
+	Claims func(ctx context.Context, uid string) (map[string]interface{}, error)
+
+	mu   sync.RWMutex
+	keys []JWTKey
+	now  func() time.Time
+}
+
+// NewJWTIssuer returns an issuer signing tokens with key, valid for 15
+// minutes.
+func NewJWTIssuer(issuer string, key JWTKey) (*JWTIssuer, error) {
+	if _, err := key.alg(); err != nil {
+		return nil, err
+	}
+	return &JWTIssuer{
+		Issuer: issuer,
+		TTL:    15 * time.Minute,
+		keys:   []JWTKey{key},
+		now:    time.Now,
+	}, nil
+}
+
+// Rotate makes key sign new tokens. Previous keys still verify and are
+// published, so that tokens signed by them stay valid until they expire.
+func (i *JWTIssuer) Rotate(key JWTKey) error {
+	if _, err := key.alg(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys = append([]JWTKey{key}, i.keys...)
+	return nil
+}
+
+// RemoveKey stops publishing and verifying with a previous key. The
+// signing key can't be removed.
+func (i *JWTIssuer) RemoveKey(id string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for n, k := range i.keys[1:] {
+		if k.ID == id {
+			i.keys = append(i.keys[:n+1], i.keys[n+2:]...)
+			return nil
+		}
+	}
+	return errors.WithStack(ErrJWTKeyNotFound)
+}
+
+// Issue returns a signed token for the user, with the "sub" claim set to
+// uid, "strategy" to the strategy the user signed in with, and
+// "auth_time" to when they did.
+func (i *JWTIssuer) Issue(ctx context.Context, uid, strategy string, authTime time.Time) (string, error) {
+	claims := map[string]interface{}{}
+	if i.Claims != nil {
+		extra, err := i.Claims(ctx, uid)
+		if err != nil {
+			return "", err
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := i.now()
+	claims["iss"] = i.Issuer
+	claims["sub"] = uid
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(i.TTL).Unix()
+	claims["jti"] = jti
+	claims["auth_time"] = authTime.Unix()
+	if strategy != "" {
+		claims["strategy"] = strategy
+	}
+	if len(i.Audience) == 1 {
+		claims["aud"] = i.Audience[0]
+	} else if len(i.Audience) > 1 {
+		claims["aud"] = i.Audience
+	}
+	return i.Sign(claims)
+}
+
+// Sign returns a token with the given claims as is, signed with the
+// current key.
+func (i *JWTIssuer) Sign(claims map[string]interface{}) (string, error) {
+	i.mu.RLock()
+	key := i.keys[0]
+	i.mu.RUnlock()
+	alg, err := key.alg()
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]string{
+		"alg": alg, "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sig, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// Verify checks a token issued by `Issue`, and returns its claims. The
+// signature, issuer, audience and expiry are checked.
+func (i *JWTIssuer) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.WithStack(ErrJWTNotValid)
+	}
+	enc := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if b, err := enc.DecodeString(parts[0]); err != nil {
+		return nil, errors.Wrap(ErrJWTNotValid, err.Error())
+	} else if err := json.Unmarshal(b, &header); err != nil {
+		return nil, errors.Wrap(ErrJWTNotValid, err.Error())
+	}
+	key, ok := i.key(header.Kid)
+	if !ok {
+		return nil, errors.WithStack(ErrJWTKeyNotFound)
+	}
+	// The algorithm is given by the key, never by the token
+	if alg, err := key.alg(); err != nil || alg != header.Alg {
+		return nil, errors.Wrap(ErrJWTNotValid, "alg")
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.Wrap(ErrJWTNotValid, "signature")
+	}
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(ErrJWTNotValid, err.Error())
+	}
+	claims := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil {
+		return nil, errors.Wrap(ErrJWTNotValid, err.Error())
+	}
+	if claims["iss"] != i.Issuer || !i.audienceValid(claims["aud"]) {
+		return nil, errors.Wrap(ErrJWTNotValid, "iss or aud")
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return nil, errors.Wrap(ErrJWTNotValid, "exp")
+	}
+	if e, err := exp.Int64(); err != nil || i.now().Unix() >= e {
+		return nil, errors.WithStack(ErrJWTExpired)
+	}
+	return claims, nil
+}
+
+// JWKS returns the public keys of the issuer, see RFC 7517. HS256 keys are
+// secret, so they are never included.
+func (i *JWTIssuer) JWKS() []JWK {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	enc := base64.RawURLEncoding
+	keys := []JWK{}
+	for _, k := range i.keys {
+		switch key := k.Key.(type) {
+		case *rsa.PrivateKey:
+			keys = append(keys, JWK{
+				Kty: "RSA", Kid: k.ID, Use: "sig", Alg: "RS256",
+				N: enc.EncodeToString(key.N.Bytes()),
+				E: enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case ed25519.PrivateKey:
+			keys = append(keys, JWK{
+				Kty: "OKP", Kid: k.ID, Use: "sig", Alg: "EdDSA", Crv: "Ed25519",
+				X: enc.EncodeToString(key.Public().(ed25519.PublicKey)),
+			})
+		}
+	}
+	return keys
+}
+
+// JWKSHandler serves the public keys as a JWK Set, e.g. at
+// "/.well-known/jwks.json".
+func (i *JWTIssuer) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Let verifiers pick up rotated keys soon
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(struct {
+			Keys []JWK `json:"keys"`
+		}{i.JWKS()})
+	})
+}
+
+// key returns the key with the given ID.
+func (i *JWTIssuer) key(id string) (JWTKey, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, k := range i.keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return JWTKey{}, false
+}
+
+// audienceValid returns true if aud contains one of the audiences of the
+// issuer, or if the issuer has none.
+func (i *JWTIssuer) audienceValid(aud interface{}) bool {
+	if len(i.Audience) == 0 {
+		return true
+	}
+	var auds []interface{}
+	switch a := aud.(type) {
+	case string:
+		auds = []interface{}{a}
+	case []interface{}:
+		auds = a
+	}
+	for _, a := range auds {
+		for _, want := range i.Audience {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SignInJWT verifies a PurposeLogin token sent to recipient, see
+// `VerifyRecipient`, and returns a JWT for the user if it is valid.
+func (p *Passwordless) SignInJWT(ctx context.Context, s, recipient, token string) (string, bool, error) {
+	if p.JWT == nil {
+		return "", false, errors.WithStack(ErrNoJWTIssuer)
+	}
+	uid, valid, err := p.VerifyRecipient(ctx, PurposeLogin, s, recipient, token)
+	if !valid {
+		return "", false, err
+	}
+	jwt, err := p.JWT.Issue(ctx, uid, s, time.Now())
+	if err != nil {
+		return "", false, err
+	}
+	return jwt, true, nil
+}
+
+// signingAlg returns the algorithm of the key signing new tokens.
+func (i *JWTIssuer) signingAlg() (string, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.keys[0].alg()
+}
@@ -0,0 +1,179 @@
+package passwordless
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTIssuer(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keys := []JWTKey{
+		{ID: "hs", Key: []byte("01234567890123456789012345678901")},
+		{ID: "rs", Key: rsaKey},
+		{ID: "ed", Key: edKey},
+	}
+
+	_, err = NewJWTIssuer("https://example.com", JWTKey{ID: "short", Key: []byte("secret")})
+	require.True(t, errors.Is(err, ErrJWTKeyNotSupported))
+
+	for _, key := range keys {
+		i, err := NewJWTIssuer("https://example.com", key)
+		require.NoError(t, err)
+		i.Audience = []string{"api"}
+		i.Claims = func(ctx context.Context, uid string) (map[string]interface{}, error) {
+			return map[string]interface{}{"role": "admin", "sub": "ignored"}, nil
+		}
+		authTime := time.Now().Add(-time.Minute)
+		token, err := i.Issue(nil, "42", "email", authTime)
+		require.NoError(t, err, key.ID)
+
+		claims, err := i.Verify(token)
+		require.NoError(t, err, key.ID)
+		require.Equal(t, "42", claims["sub"])
+		require.Equal(t, "email", claims["strategy"])
+		require.Equal(t, "admin", claims["role"])
+		require.Equal(t, "api", claims["aud"])
+		require.Equal(t, json.Number(strconv.FormatInt(authTime.Unix(), 10)), claims["auth_time"])
+
+		// Tampering with the payload breaks the signature
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(map[string]interface{}{
+			"iss": "https://example.com", "sub": "1", "aud": "api",
+			"exp": time.Now().Add(time.Hour).Unix()})
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+		_, err = i.Verify(strings.Join(parts, "."))
+		require.True(t, errors.Is(err, ErrJWTNotValid), key.ID)
+
+		// Other audiences and expired tokens are rejected
+		i.Audience = []string{"other"}
+		_, err = i.Verify(token)
+		require.True(t, errors.Is(err, ErrJWTNotValid), key.ID)
+		i.Audience = nil
+		i.TTL = -time.Second
+		expired, err := i.Issue(nil, "42", "email", authTime)
+		require.NoError(t, err)
+		_, err = i.Verify(expired)
+		require.True(t, errors.Is(err, ErrJWTExpired), key.ID)
+	}
+
+	// The algorithm of the key can't be swapped by the token
+	i, err := NewJWTIssuer("https://example.com", keys[1])
+	require.NoError(t, err)
+	token, err := i.Issue(nil, "42", "", time.Now())
+	require.NoError(t, err)
+	parts := strings.Split(token, ".")
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rs"})
+	parts[0] = base64.RawURLEncoding.EncodeToString(header)
+	_, err = i.Verify(strings.Join(parts, "."))
+	require.True(t, errors.Is(err, ErrJWTNotValid))
+	for _, token := range []string{"", "a.b", "a.b.c"} {
+		_, err = i.Verify(token)
+		require.Error(t, err, token)
+	}
+}
+
+func TestJWTIssuerRotate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	i, err := NewJWTIssuer("https://example.com", JWTKey{ID: "1", Key: rsaKey})
+	require.NoError(t, err)
+	old, err := i.Issue(nil, "42", "email", time.Now())
+	require.NoError(t, err)
+
+	// New tokens are signed with the new key, old ones stay valid
+	require.NoError(t, i.Rotate(JWTKey{ID: "2", Key: edKey}))
+	token, err := i.Issue(nil, "42", "email", time.Now())
+	require.NoError(t, err)
+	_, err = i.Verify(token)
+	require.NoError(t, err)
+	_, err = i.Verify(old)
+	require.NoError(t, err)
+
+	// Both keys are published, HMAC secrets never are
+	require.NoError(t, i.Rotate(JWTKey{ID: "3", Key: []byte("01234567890123456789012345678901")}))
+	rec := httptest.NewRecorder()
+	i.JWKSHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "2", jwks.Keys[0].Kid)
+	require.Equal(t, "1", jwks.Keys[1].Kid)
+
+	// Published keys verify the tokens, as a relying party would
+	enc := base64.RawURLEncoding
+	x, err := enc.DecodeString(jwks.Keys[0].X)
+	require.NoError(t, err)
+	parts := strings.Split(token, ".")
+	sig, err := enc.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(x, []byte(parts[0]+"."+parts[1]), sig))
+	n, err := enc.DecodeString(jwks.Keys[1].N)
+	require.NoError(t, err)
+	e, err := enc.DecodeString(jwks.Keys[1].E)
+	require.NoError(t, err)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	parts = strings.Split(old, ".")
+	sig, err = enc.DecodeString(parts[2])
+	require.NoError(t, err)
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig))
+
+	// Removed keys no longer verify, the signing key can't be removed
+	require.NoError(t, i.RemoveKey("1"))
+	_, err = i.Verify(old)
+	require.True(t, errors.Is(err, ErrJWTKeyNotFound))
+	require.True(t, errors.Is(i.RemoveKey("3"), ErrJWTKeyNotFound))
+}
+
+func TestSignInJWT(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+
+	_, _, err = p.SignInJWT(nil, "email", "bender@ilovebender.com", "1337")
+	require.True(t, errors.Is(err, ErrNoJWTIssuer))
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p.JWT, err = NewJWTIssuer("https://example.com", JWTKey{ID: "1", Key: edKey})
+	require.NoError(t, err)
+
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "", "bender@ilovebender.com"))
+	_, valid, err := p.SignInJWT(nil, "email", "bender@ilovebender.com", "0000")
+	require.NoError(t, err)
+	require.False(t, valid)
+	token, valid, err := p.SignInJWT(nil, "email", "bender@ilovebender.com", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	claims, err := p.JWT.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "42", claims["sub"])
+	require.Equal(t, "email", claims["strategy"])
+}
@@ -0,0 +1,415 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrLinkNotValid          = errors.New("link is not valid")
+	ErrLinkSignatureNotValid = errors.New("link signature is not valid")
+	ErrLinkExpired           = errors.New("link has expired")
+	ErrLinkSecretRequired    = errors.New("link secret is required to bind sessions")
+)
+
+// Query parameters of magic links.
+const (
+	LinkParamStrategy  = "strategy"
+	LinkParamToken     = "token"
+	LinkParamUID       = "uid"
+	LinkParamRecipient = "recipient"
+	LinkParamRequest   = "req"
+	LinkParamPurpose   = "purpose"
+	LinkParamExpires   = "exp"
+	LinkParamSignature = "sig"
+)
+
+// linkParams are the parameters covered by the signature.
+var linkParams = []string{
+	LinkParamStrategy, LinkParamToken, LinkParamUID, LinkParamRecipient,
+	LinkParamRequest, LinkParamPurpose, LinkParamExpires,
+}
+
+// LinkParams are the values carried by a magic link.
+type LinkParams struct {
+	Strategy  string
+	Token     string
+	UID       string
+	Recipient string
+	// Request is the ID of the approval request the link approves, if any
+	Request string
+	// Purpose of the token, PurposeLogin if not set in the link
+	Purpose string
+	// Expires is zero if the link does not expire
+	Expires time.Time
+}
+
+// MagicLink builds and parses URLs that sign a user in when followed.
+type MagicLink struct {
+	// BaseURL links point to, e.g. "https://example.com/account/link".
+	// Query parameters of the base URL are preserved.
+	BaseURL *url.URL
+	// Secret used to sign links with HMAC-SHA256. If empty, links are not
+	// signed.
+	Secret []byte
+	// TTL after which links expire. Zero means links don't expire, in
+	// which case the TTL of the token still applies. Expiry can only be
+	// enforced reliably if links are signed.
+	TTL time.Duration
+
+	now func() time.Time
+}
+
+// NewMagicLink returns a link builder for the given base URL, signing
+// links with secret if it is not empty.
+func NewMagicLink(baseURL string, secret []byte) (*MagicLink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrap(ErrLinkNotValid, err.Error())
+	}
+	return &MagicLink{
+		BaseURL: u,
+		Secret:  secret,
+		now:     time.Now,
+	}, nil
+}
+
+// URL returns a properly encoded link carrying the token. Empty values are
+// omitted, e.g. either uid or recipient may be empty if the user can be
+// resolved from the other.
+func (m *MagicLink) URL(strategy, token, uid, recipient string) string {
+	return m.build(LinkParams{
+		Strategy:  strategy,
+		Token:     token,
+		UID:       uid,
+		Recipient: recipient,
+	})
+}
+
+// LinkFunc returns a function building links for the named strategy, e.g.
+// for `TemplateComposer.Link`. Links include the approval request ID and
+// the purpose of the token from the context.
+func (m *MagicLink) LinkFunc(strategy string) LinkFunc {
+	return func(ctx context.Context, token, uid, recipient string) (string, error) {
+		return m.build(LinkParams{
+			Strategy:  strategy,
+			Token:     token,
+			UID:       uid,
+			Recipient: recipient,
+			Request:   ApprovalIDFromContext(ctx),
+			Purpose:   PurposeFromContext(ctx),
+		}), nil
+	}
+}
+
+// build returns the link for p, ignoring p.Expires in favour of the TTL.
+func (m *MagicLink) build(p LinkParams) string {
+	q := m.BaseURL.Query()
+	params := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			params.Set(k, v)
+			q.Set(k, v)
+		}
+	}
+	set(LinkParamStrategy, p.Strategy)
+	set(LinkParamToken, p.Token)
+	set(LinkParamUID, p.UID)
+	set(LinkParamRecipient, p.Recipient)
+	set(LinkParamRequest, p.Request)
+	if p.Purpose != PurposeLogin {
+		set(LinkParamPurpose, p.Purpose)
+	}
+	if m.TTL > 0 {
+		set(LinkParamExpires, strconv.FormatInt(m.clock().Add(m.TTL).Unix(), 10))
+	}
+	if len(m.Secret) > 0 {
+		q.Set(LinkParamSignature, m.sign(params))
+	}
+	u := *m.BaseURL
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Parse extracts the parameters of a link, e.g. from the query or a
+// submitted form, verifying the signature and expiry.
+func (m *MagicLink) Parse(values url.Values) (LinkParams, error) {
+	params := url.Values{}
+	for _, k := range linkParams {
+		if v := values.Get(k); v != "" {
+			params.Set(k, v)
+		}
+	}
+	p := LinkParams{
+		Strategy:  params.Get(LinkParamStrategy),
+		Token:     params.Get(LinkParamToken),
+		UID:       params.Get(LinkParamUID),
+		Recipient: params.Get(LinkParamRecipient),
+		Request:   params.Get(LinkParamRequest),
+		Purpose:   params.Get(LinkParamPurpose),
+	}
+	if p.Purpose == "" {
+		p.Purpose = PurposeLogin
+	}
+	if p.Token == "" || (p.UID == "" && p.Recipient == "") {
+		return p, errors.WithStack(ErrLinkNotValid)
+	}
+	// Approval requests sign the originating device in
+	if p.Request != "" && p.Purpose != PurposeLogin {
+		return p, errors.WithStack(ErrLinkNotValid)
+	}
+	if len(m.Secret) > 0 {
+		sig := values.Get(LinkParamSignature)
+		if !hmac.Equal([]byte(sig), []byte(m.sign(params))) {
+			return p, errors.WithStack(ErrLinkSignatureNotValid)
+		}
+	}
+	if exp := params.Get(LinkParamExpires); exp != "" {
+		unix, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return p, errors.Wrap(ErrLinkNotValid, err.Error())
+		}
+		p.Expires = time.Unix(unix, 0)
+		if m.clock().After(p.Expires) {
+			return p, errors.WithStack(ErrLinkExpired)
+		}
+	}
+	return p, nil
+}
+
+// clock returns the current time.
+func (m *MagicLink) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// sign returns the base64url encoded HMAC of the canonically encoded
+// params.
+func (m *MagicLink) sign(params url.Values) string {
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write([]byte(params.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// DefaultConfirmTemplate is rendered by MagicLinkHandler for GET requests.
+// It is executed with ConfirmData. For approval requests, the form must
+// submit ConfirmActionParam as either ConfirmApprove or ConfirmDeny.
+const DefaultConfirmTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+{{ with .Approval }}<p>Sign in was requested from {{ or .IP "an unknown address" }}
+{{ with .UserAgent }}using {{ . }} {{ end }}at {{ .Created.Format "2006-01-02 15:04 MST" }}.
+If this wasn't you, deny the request.</p>
+{{ end }}<form method="post" action="{{ .Action }}">
+{{ range $k, $v := .Values }}{{ range $v }}<input type="hidden" name="{{ $k }}" value="{{ . }}">
+{{ end }}{{ end }}{{ if .Approval }}<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+{{ else }}<button type="submit">Continue signing in</button>
+{{ end }}</form>
+</body>
+</html>
+`
+
+// Form values posted from the confirm page of approval requests.
+const (
+	ConfirmActionParam = "action"
+	ConfirmApprove     = "approve"
+	ConfirmDeny        = "deny"
+)
+
+// ConfirmData is passed to the MagicLinkHandler confirm template.
+type ConfirmData struct {
+	// Action is the URL the form must be posted to
+	Action string
+	// Values must be posted as hidden form fields
+	Values url.Values
+	// Params of the link being confirmed
+	Params LinkParams
+	// Request is the GET request showing the page
+	Request *http.Request
+	// Approval is set if the link approves a sign in requested from another
+	// device, see `Passwordless.RequestApproval`
+	Approval *Approval
+}
+
+// MagicLinkHandler consumes magic links. Following a link (GET) only shows a
+// confirmation page, so that email link scanners pre-fetching URLs don't
+// use up the token; submitting it (POST) verifies the token for the
+// purpose of the link, see `LinkParams`. OnSuccess finds the purpose with
+// `PurposeFromContext` on the request, e.g. to sign in for PurposeLogin.
+//
+// Links for approval requests don't sign in the device they are followed
+// on. Instead the confirm page shows where the request was made, and the
+// user approves or denies it, after which OnApproval is called.
+type MagicLinkHandler struct {
+	Passwordless *Passwordless
+	Link         *MagicLink
+	// Confirm is the page shown for GET requests, see ConfirmData
+	Confirm *template.Template
+	// OnSuccess is called once the token was verified, e.g. to start a
+	// session and redirect. The request context carries the purpose of
+	// the link.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, uid string)
+	// OnFailure is called if the link or token is not valid, or
+	// verification fails. By default it responds with 403 Forbidden for
+	// invalid links and tokens, and 500 otherwise.
+	OnFailure func(w http.ResponseWriter, r *http.Request, err error)
+	// OnApproval is called once an approval request was approved or
+	// denied. By default it responds with a short plain text message.
+	OnApproval func(w http.ResponseWriter, r *http.Request, status ApprovalStatus)
+}
+
+// NewMagicLinkHandler returns a handler verifying links built by link,
+// calling onSuccess with the uid of the signed in user. If p binds
+// sessions, links must be signed, see `MagicLink.Secret`.
+func NewMagicLinkHandler(p *Passwordless, link *MagicLink, onSuccess func(w http.ResponseWriter, r *http.Request, uid string)) (*MagicLinkHandler, error) {
+	if p.BindSessions && len(link.Secret) == 0 {
+		return nil, errors.WithStack(ErrLinkSecretRequired)
+	}
+	return &MagicLinkHandler{
+		Passwordless: p,
+		Link:         link,
+		Confirm:      template.Must(template.New("confirm").Parse(DefaultConfirmTemplate)),
+		OnSuccess:    onSuccess,
+	}, nil
+}
+
+func (h *MagicLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.confirm(w, r)
+	case http.MethodPost:
+		h.verify(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// confirm renders the confirmation page, without touching the token.
+func (h *MagicLinkHandler) confirm(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	params, err := h.Link.Parse(values)
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	var approval *Approval
+	if params.Request != "" {
+		if approval, err = h.Passwordless.GetApproval(r.Context(), params.Request); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Keep the token out of Referer headers sent by the confirm page
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.Confirm.Execute(w, ConfirmData{
+		Action:   r.URL.EscapedPath(),
+		Values:   values,
+		Params:   params,
+		Request:  r,
+		Approval: approval,
+	}); err != nil {
+		h.fail(w, r, errors.WithStack(err))
+	}
+}
+
+// verify checks the posted token, signing the user in on success.
+func (h *MagicLinkHandler) verify(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.fail(w, r, errors.Wrap(ErrLinkNotValid, err.Error()))
+		return
+	}
+	params, err := h.Link.Parse(r.PostForm)
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	ctx := SetContext(r.Context(), w, r)
+	if len(h.Link.Secret) > 0 {
+		// The user confirmed a link we signed, so it is accepted from any
+		// session. Unsigned links could be made up by anyone.
+		ctx = withConfirmedLink(ctx)
+	}
+	if params.Request != "" {
+		h.approve(ctx, w, r, params)
+		return
+	}
+	uid, valid := params.UID, false
+	if uid != "" {
+		valid, err = h.Passwordless.VerifyToken(ctx, params.Purpose, uid, params.Token)
+	} else {
+		uid, valid, err = h.Passwordless.VerifyRecipient(
+			ctx, params.Purpose, params.Strategy, params.Recipient, params.Token)
+	}
+	if err != nil {
+		h.fail(w, r, err)
+	} else if !valid {
+		h.fail(w, r, errors.WithStack(ErrLinkNotValid))
+	} else {
+		h.OnSuccess(w, r.WithContext(WithPurpose(r.Context(), params.Purpose)), uid)
+	}
+}
+
+// approve approves or denies the approval request of the link.
+func (h *MagicLinkHandler) approve(ctx context.Context, w http.ResponseWriter, r *http.Request, params LinkParams) {
+	status := ApprovalDenied
+	if r.PostForm.Get(ConfirmActionParam) == ConfirmDeny {
+		if err := h.Passwordless.DenyRequest(ctx, params.Request); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+	} else {
+		valid, err := h.Passwordless.ApproveRequest(ctx, params.Request,
+			params.Strategy, params.UID, params.Recipient, params.Token)
+		if err != nil {
+			h.fail(w, r, err)
+			return
+		} else if !valid {
+			h.fail(w, r, errors.WithStack(ErrLinkNotValid))
+			return
+		}
+		status = ApprovalApproved
+	}
+	if h.OnApproval != nil {
+		h.OnApproval(w, r, status)
+	} else if status == ApprovalApproved {
+		io.WriteString(w, "Sign in approved, continue on the device you signed in from.\n")
+	} else {
+		io.WriteString(w, "Sign in request denied.\n")
+	}
+}
+
+func (h *MagicLinkHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if h.OnFailure != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+	switch {
+	case errors.Is(err, ErrLinkNotValid), errors.Is(err, ErrLinkSignatureNotValid),
+		errors.Is(err, ErrLinkExpired), errors.Is(err, ErrTokenNotFound),
+		errors.Is(err, ErrTokenExpired), errors.Is(err, ErrBindingMismatch),
+		errors.Is(err, ErrApprovalNotFound),
+		errors.Is(err, ErrApprovalExpired), errors.Is(err, ErrApprovalStatusChanged):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,199 @@
+package passwordless
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicLink(t *testing.T) {
+	m, err := NewMagicLink("https://example.com/account/link?lang=en", nil)
+	require.NoError(t, err)
+
+	link := m.URL("email", "AB CD", "", "bender+test@ilovebender.com")
+	require.Equal(t, "https://example.com/account/link?lang=en"+
+		"&recipient=bender%2Btest%40ilovebender.com&strategy=email&token=AB+CD", link)
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	p, err := m.Parse(u.Query())
+	require.NoError(t, err)
+	require.Equal(t, LinkParams{
+		Strategy: "email", Token: "AB CD", Recipient: "bender+test@ilovebender.com",
+		Purpose: PurposeLogin,
+	}, p)
+
+	_, err = m.Parse(url.Values{"token": {"1337"}})
+	require.True(t, errors.Is(err, ErrLinkNotValid))
+
+	// Signed and expiring
+	now := time.Unix(1600000000, 0)
+	m.Secret = []byte("secret")
+	m.TTL = time.Hour
+	m.now = func() time.Time { return now }
+	fn := m.LinkFunc("email")
+	link, err = fn(nil, "1337", "42", "")
+	require.NoError(t, err)
+	u, err = url.Parse(link)
+	require.NoError(t, err)
+	q := u.Query()
+	require.Equal(t, "1600003600", q.Get("exp"))
+	require.NotEmpty(t, q.Get("sig"))
+	p, err = m.Parse(q)
+	require.NoError(t, err)
+	require.Equal(t, "42", p.UID)
+	require.Equal(t, time.Unix(1600003600, 0), p.Expires)
+
+	for _, param := range []string{"uid", "exp", "token"} {
+		tampered := url.Values{}
+		for k, v := range q {
+			tampered[k] = v
+		}
+		tampered.Set(param, "1")
+		_, err = m.Parse(tampered)
+		require.True(t, errors.Is(err, ErrLinkSignatureNotValid), param)
+	}
+	q.Del("sig")
+	_, err = m.Parse(q)
+	require.True(t, errors.Is(err, ErrLinkSignatureNotValid))
+
+	now = now.Add(2 * time.Hour)
+	_, err = m.Parse(u.Query())
+	require.True(t, errors.Is(err, ErrLinkExpired))
+
+	// Struct literals use the current time
+	base, _ := url.Parse("https://example.com/link")
+	m = &MagicLink{BaseURL: base, Secret: []byte("secret"), TTL: time.Hour}
+	u, err = url.Parse(m.URL("email", "1337", "42", ""))
+	require.NoError(t, err)
+	p, err = m.Parse(u.Query())
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), p.Expires, time.Minute)
+	require.Equal(t, PurposeLogin, p.Purpose)
+
+	// Links carry the purpose of the token, covered by the signature
+	link, err = m.LinkFunc("email")(WithPurpose(nil, PurposeReauth), "1337", "42", "")
+	require.NoError(t, err)
+	u, err = url.Parse(link)
+	require.NoError(t, err)
+	q = u.Query()
+	require.Equal(t, PurposeReauth, q.Get("purpose"))
+	p, err = m.Parse(q)
+	require.NoError(t, err)
+	require.Equal(t, PurposeReauth, p.Purpose)
+	q.Del("purpose")
+	_, err = m.Parse(q)
+	require.True(t, errors.Is(err, ErrLinkSignatureNotValid))
+
+	// Approval requests only sign in
+	link, err = m.LinkFunc("email")(
+		WithApprovalID(WithPurpose(nil, PurposeReauth), "abc"), "1337", "42", "")
+	require.NoError(t, err)
+	u, err = url.Parse(link)
+	require.NoError(t, err)
+	_, err = m.Parse(u.Query())
+	require.True(t, errors.Is(err, ErrLinkNotValid))
+}
+
+func TestMagicLinkHandler(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+	m, err := NewMagicLink("http://example.com/link", []byte("secret"))
+	require.NoError(t, err)
+
+	signedIn, purpose := "", ""
+	h, err := NewMagicLinkHandler(p, m, func(w http.ResponseWriter, r *http.Request, uid string) {
+		signedIn = uid
+		purpose = PurposeFromContext(r.Context())
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "", "bender@ilovebender.com"))
+	link := m.URL("email", "1337", "", "bender@ilovebender.com")
+
+	// Following the link only shows the confirm page
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, link, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "no-referrer", rec.Header().Get("Referrer-Policy"))
+	body := rec.Body.String()
+	require.Contains(t, body, `action="/link"`)
+	require.Empty(t, signedIn)
+	exists, _, err := store.Exists(nil, "42")
+	require.NoError(t, err)
+	require.True(t, exists, "GET must not consume the token")
+
+	// Post the form as rendered
+	form := url.Values{}
+	re := regexp.MustCompile(`name="([^"]+)" value="([^"]*)"`)
+	for _, m := range re.FindAllStringSubmatch(body, -1) {
+		form.Add(m[1], m[2])
+	}
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/link", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	bad := url.Values{}
+	for k, v := range form {
+		bad[k] = v
+	}
+	bad.Set("token", "0000")
+	require.Equal(t, http.StatusForbidden, post(bad).Code, "tampered link")
+
+	rec = post(form)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "42", signedIn)
+
+	// Tokens are single use
+	signedIn = ""
+	require.Equal(t, http.StatusForbidden, post(form).Code)
+	require.Empty(t, signedIn)
+
+	// Links with a uid are verified directly
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", ""))
+	form, _ = url.ParseQuery(strings.SplitN(m.URL("email", "1337", "42", ""), "?", 2)[1])
+	require.Equal(t, http.StatusSeeOther, post(form).Code)
+	require.Equal(t, "42", signedIn)
+	require.Equal(t, PurposeLogin, purpose)
+
+	// Links verify tokens of their purpose
+	require.NoError(t, p.RequestToken(nil, PurposeReauth, "email", "42", ""))
+	link, err = m.LinkFunc("email")(WithPurpose(nil, PurposeReauth), "1337", "42", "")
+	require.NoError(t, err)
+	form, _ = url.ParseQuery(strings.SplitN(link, "?", 2)[1])
+	require.Equal(t, http.StatusSeeOther, post(form).Code)
+	require.Equal(t, PurposeReauth, purpose)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, link, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// Bound sessions require signed links, as only those are accepted from
+	// any session
+	p.BindSessions = true
+	unsigned, err := NewMagicLink("http://example.com/link", nil)
+	require.NoError(t, err)
+	_, err = NewMagicLinkHandler(p, unsigned, h.OnSuccess)
+	require.True(t, errors.Is(err, ErrLinkSecretRequired))
+	h.Link = unsigned
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", ""))
+	form, _ = url.ParseQuery(strings.SplitN(unsigned.URL("email", "1337", "42", ""), "?", 2)[1])
+	signedIn = ""
+	require.Equal(t, http.StatusForbidden, post(form).Code)
+	require.Empty(t, signedIn)
+}
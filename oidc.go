@@ -0,0 +1,721 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrOIDCClientNotFound      = errors.New("oidc client does not exist")
+	ErrOIDCRedirectURINotValid = errors.New("oidc redirect uri is not valid")
+	ErrOIDCCSRFNotValid        = errors.New("oidc login form is not valid")
+)
+
+// OIDC endpoints served by OIDCProvider, relative to the issuer URL.
+const (
+	OIDCDiscoveryPath = "/.well-known/openid-configuration"
+	OIDCAuthorizePath = "/authorize"
+	OIDCTokenPath     = "/token"
+	OIDCJWKSPath      = "/jwks"
+)
+
+// DefaultOIDCCodeTTL is the lifetime of authorization codes.
+const DefaultOIDCCodeTTL = time.Minute
+
+// DefaultOIDCMaxFailures is the number of wrong PINs accepted for a
+// recipient, and DefaultOIDCMaxSends the number of PINs sent to it, after
+// which it is locked for DefaultOIDCLockout.
+const (
+	DefaultOIDCMaxFailures = 5
+	DefaultOIDCMaxSends    = 5
+	DefaultOIDCLockout     = 15 * time.Minute
+)
+
+// Form values posted from the OIDC login page.
+const (
+	LoginRecipientParam = "recipient"
+	LoginTokenParam     = "token"
+	LoginCSRFParam      = "csrf"
+)
+
+// OIDCCSRFCookieName is the cookie holding the random nonce the CSRF token
+// of the OIDC login form is derived from.
+const OIDCCSRFCookieName = "pwl_oidc_csrf"
+
+// oidcAuthParams are the parameters of authorization requests, kept as
+// hidden fields by the login page.
+var oidcAuthParams = []string{
+	"response_type", "client_id", "redirect_uri", "scope", "state", "nonce",
+	"code_challenge", "code_challenge_method", "prompt",
+}
+
+// OIDCClient is a relying party registered with OIDCProvider.
+type OIDCClient struct {
+	ID   string
+	Name string
+	// RedirectURIs the authorization response may be sent to. They must
+	// match exactly.
+	RedirectURIs []string
+	// Public clients, e.g. single page or mobile apps, have no secret and
+	// rely on PKCE alone
+	Public  bool
+	Created time.Time
+}
+
+// OIDCClientStore persists registered clients.
+type OIDCClientStore interface {
+	// CreateClient stores a new client with its secret, which is empty for
+	// public clients
+	CreateClient(ctx context.Context, c *OIDCClient, secret string) error
+	// GetClient returns the client with the given ID, or
+	// ErrOIDCClientNotFound
+	GetClient(ctx context.Context, id string) (*OIDCClient, error)
+	// VerifyClientSecret returns true if secret is the secret of the client
+	VerifyClientSecret(ctx context.Context, id, secret string) (bool, error)
+	// DeleteClient removes the client
+	DeleteClient(ctx context.Context, id string) error
+}
+
+// DefaultOIDCLoginTemplate is rendered by OIDCProvider to sign users in. It
+// is executed with OIDCLoginData. The form first posts LoginRecipientParam
+// to send a PIN, and then LoginTokenParam as well to verify it. Both must
+// include LoginCSRFParam.
+const DefaultOIDCLoginTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<p>Sign in to {{ .Client.Name }}</p>
+{{ with .Error }}<p>{{ . }}</p>
+{{ end }}<form method="post" action="{{ .Action }}">
+<input type="hidden" name="csrf" value="{{ .CSRF }}">
+{{ range $k, $v := .Values }}{{ range $v }}<input type="hidden" name="{{ $k }}" value="{{ . }}">
+{{ end }}{{ end }}{{ if .Recipient }}<input type="hidden" name="recipient" value="{{ .Recipient }}">
+<label>Enter the PIN sent to {{ .Recipient }} <input name="token" autocomplete="one-time-code" required></label>
+{{ else }}<label>Email <input type="email" name="recipient" autocomplete="email" required></label>
+{{ end }}<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`
+
+// OIDCLoginData is passed to the OIDCProvider login template.
+type OIDCLoginData struct {
+	// Action is the URL the form must be posted to
+	Action string
+	// Values of the authorization request must be posted as hidden form
+	// fields
+	Values url.Values
+	// CSRF must be posted as LoginCSRFParam
+	CSRF string
+	// Client the user signs in to
+	Client *OIDCClient
+	// Recipient is set once a PIN was sent to it
+	Recipient string
+	// Error to show the user, if any
+	Error string
+}
+
+// oidcAttempts counts PINs sent to or entered for a recipient.
+type oidcAttempts struct {
+	count   int
+	expires time.Time
+}
+
+// oidcCode is an authorization code waiting to be exchanged for tokens.
+type oidcCode struct {
+	clientID    string
+	redirectURI string
+	uid         string
+	recipient   string
+	scope       string
+	nonce       string
+	challenge   string
+	authTime    time.Time
+	expires     time.Time
+}
+
+// OIDCProvider is a minimal OpenID Connect provider, so that several apps
+// share one passwordless sign in. It supports the authorization code flow
+// with PKCE (S256), which is required for all clients, and serves the
+// discovery, JWKS, authorization and token endpoints.
+//
+// Users sign in with a PIN sent by Strategy, and receive an id_token
+// signed by the JWT issuer of Passwordless, which must use RS256 or
+// EdDSA keys for clients to verify it. The access_token is issued by
+// `JWTIssuer.Issue`. If Passwordless has Sessions, signing in starts a
+// session, and users with a session, see `SessionMiddleware`, are not
+// asked to sign in again.
+//
+// Authorization codes are kept in memory, so they must be exchanged with
+// the instance that issued them.
+type OIDCProvider struct {
+	Passwordless *Passwordless
+	Clients      OIDCClientStore
+	// Strategy delivering PINs, e.g. "email"
+	Strategy string
+	// Login is the sign in page, see OIDCLoginData
+	Login *template.Template
+	// CodeTTL is the lifetime of authorization codes
+	CodeTTL time.Duration
+	// MaxFailures is the number of wrong PINs accepted for a recipient,
+	// after which no PINs are verified for it until Lockout passed since
+	// the first failure. Likewise, no more than MaxSends PINs are sent to
+	// it.
+	MaxFailures int
+	MaxSends    int
+	Lockout     time.Duration
+
+	// prefix is the path of the issuer URL
+	prefix   string
+	mu       sync.Mutex
+	codes    map[string]*oidcCode
+	failures map[string]*oidcAttempts
+	sends    map[string]*oidcAttempts
+}
+
+// NewOIDCProvider returns a provider for the issuer of p.JWT, signing users
+// in with the named strategy. The issuer URL must be where the provider is
+// served, e.g. "https://login.example.com".
+func NewOIDCProvider(p *Passwordless, strategy string, clients OIDCClientStore) (*OIDCProvider, error) {
+	if p.JWT == nil {
+		return nil, errors.WithStack(ErrNoJWTIssuer)
+	}
+	if p.Resolver == nil {
+		return nil, errors.WithStack(ErrNoResolver)
+	}
+	if alg, err := p.JWT.signingAlg(); err != nil {
+		return nil, err
+	} else if alg == "HS256" {
+		// Clients can't verify tokens signed with a secret
+		return nil, errors.Wrap(ErrJWTKeyNotSupported, alg)
+	}
+	u, err := url.Parse(p.JWT.Issuer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &OIDCProvider{
+		Passwordless: p,
+		Clients:      clients,
+		Strategy:     strategy,
+		Login:        template.Must(template.New("login").Parse(DefaultOIDCLoginTemplate)),
+		CodeTTL:      DefaultOIDCCodeTTL,
+		MaxFailures:  DefaultOIDCMaxFailures,
+		MaxSends:     DefaultOIDCMaxSends,
+		Lockout:      DefaultOIDCLockout,
+		prefix:       strings.TrimSuffix(u.Path, "/"),
+		codes:        map[string]*oidcCode{},
+		failures:     map[string]*oidcAttempts{},
+		sends:        map[string]*oidcAttempts{},
+	}, nil
+}
+
+// RegisterClient registers a new client, and returns it with its secret.
+// Public clients have no secret.
+func (h *OIDCProvider) RegisterClient(ctx context.Context, name string, redirectURIs []string, public bool) (*OIDCClient, string, error) {
+	if len(redirectURIs) == 0 {
+		return nil, "", errors.WithStack(ErrOIDCRedirectURINotValid)
+	}
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(uri, " \t\n") {
+			return nil, "", errors.Wrap(ErrOIDCRedirectURINotValid, uri)
+		}
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := ""
+	if !public {
+		if secret, err = randomHex(32); err != nil {
+			return nil, "", err
+		}
+	}
+	c := &OIDCClient{
+		ID:           id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Public:       public,
+		Created:      time.Now().UTC().Truncate(time.Second),
+	}
+	if err := h.Clients.CreateClient(ctx, c, secret); err != nil {
+		return nil, "", err
+	}
+	return c, secret, nil
+}
+
+func (h *OIDCProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, h.prefix) {
+	case OIDCDiscoveryPath:
+		h.discovery(w, r)
+	case OIDCJWKSPath:
+		h.Passwordless.JWT.JWKSHandler().ServeHTTP(w, r)
+	case OIDCAuthorizePath:
+		h.authorize(w, r)
+	case OIDCTokenPath:
+		h.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// discovery serves the provider metadata, see OpenID Connect Discovery 1.0.
+func (h *OIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := h.Passwordless.JWT.Issuer
+	base := strings.TrimSuffix(issuer, "/")
+	algs := []string{}
+	for _, k := range h.Passwordless.JWT.JWKS() {
+		algs = append(algs, k.Alg)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                base + OIDCAuthorizePath,
+		"token_endpoint":                        base + OIDCTokenPath,
+		"jwks_uri":                              base + OIDCJWKSPath,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"scopes_supported":                      []string{"openid", "email"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email",
+			"email_verified"},
+		"token_endpoint_auth_methods_supported": []string{
+			"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported": []string{"S256"},
+		"prompt_values_supported":          []string{"none", "login"},
+	})
+}
+
+// authorize handles authorization requests, signing the user in first
+// unless they have a session.
+func (h *OIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := url.Values{}
+	for _, k := range oidcAuthParams {
+		if v := r.Form.Get(k); v != "" {
+			values.Set(k, v)
+		}
+	}
+	ctx := SetContext(r.Context(), w, r)
+
+	// Until the redirect URI is known to belong to the client, errors can't
+	// be sent to it
+	client, err := h.Clients.GetClient(ctx, values.Get("client_id"))
+	if errors.Is(err, ErrOIDCClientNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		h.serverError(w)
+		return
+	}
+	redirectURI := values.Get("redirect_uri")
+	if !contains(client.RedirectURIs, redirectURI) {
+		http.Error(w, ErrOIDCRedirectURINotValid.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case values.Get("response_type") != "code":
+		h.redirectError(w, r, values, "unsupported_response_type", "")
+		return
+	case !contains(strings.Fields(values.Get("scope")), "openid"):
+		h.redirectError(w, r, values, "invalid_scope", "openid scope is required")
+		return
+	case values.Get("code_challenge") == "" ||
+		values.Get("code_challenge_method") != "S256":
+		h.redirectError(w, r, values, "invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	prompt := values.Get("prompt")
+	if s := UserSessionFromContext(ctx); s != nil && prompt != "login" {
+		h.issueCode(w, r, values, s.UID, "", s.Created)
+		return
+	} else if prompt == "none" {
+		h.redirectError(w, r, values, "login_required", "")
+		return
+	}
+
+	csrf, err := h.csrfToken(w, r, values)
+	if err != nil {
+		h.serverError(w)
+		return
+	}
+	data := OIDCLoginData{
+		Action: r.URL.EscapedPath(),
+		Values: values,
+		CSRF:   csrf,
+		Client: client,
+	}
+	if r.Method != http.MethodPost {
+		h.render(w, data)
+		return
+	}
+	// Other sites must not post the form for the user
+	if subtle.ConstantTimeCompare([]byte(csrf), []byte(r.PostForm.Get(LoginCSRFParam))) != 1 {
+		http.Error(w, ErrOIDCCSRFNotValid.Error(), http.StatusForbidden)
+		return
+	}
+	p := h.Passwordless
+	data.Recipient = r.PostForm.Get(LoginRecipientParam)
+	token := r.PostForm.Get(LoginTokenParam)
+	if data.Recipient == "" {
+		h.render(w, data)
+		return
+	} else if token == "" {
+		if h.limited(h.sends, h.MaxSends, data.Recipient) {
+			data.Error = "Too many attempts, please try again later"
+			h.render(w, data)
+			return
+		}
+		h.count(h.sends, data.Recipient)
+		// Unknown users are shown the same page, see `RequestToken`
+		if err := p.RequestToken(ctx, PurposeLogin, h.Strategy, "", data.Recipient); err != nil {
+			h.serverError(w)
+			return
+		}
+		h.render(w, data)
+		return
+	}
+
+	// Recipients are locked regardless of whether they are known, so that
+	// PINs can't be guessed and locking reveals nothing
+	if h.limited(h.failures, h.MaxFailures, data.Recipient) {
+		data.Error = "Too many attempts, please try again later"
+		h.render(w, data)
+		return
+	}
+	uid, valid := "", false
+	if p.Sessions != nil {
+		var s *UserSession
+		if s, valid, err = p.SignIn(ctx, h.Strategy, data.Recipient, token); valid {
+			uid = s.UID
+		}
+	} else {
+		uid, valid, err = p.VerifyRecipient(ctx, PurposeLogin, h.Strategy, data.Recipient, token)
+	}
+	if err != nil && !errors.Is(err, ErrTokenNotFound) &&
+		!errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrBindingMismatch) &&
+		!errors.Is(err, ErrNotValidForContext) {
+		h.serverError(w)
+		return
+	} else if !valid {
+		h.count(h.failures, data.Recipient)
+		data.Error = "The PIN is not valid"
+		h.render(w, data)
+		return
+	}
+	h.mu.Lock()
+	delete(h.failures, attemptKey(data.Recipient))
+	h.mu.Unlock()
+	h.issueCode(w, r, values, uid, data.Recipient, time.Now())
+}
+
+// csrfToken returns the CSRF token of the login form for the
+// authorization request, derived from the nonce in the CSRF cookie, which
+// is set if missing.
+func (h *OIDCProvider) csrfToken(w http.ResponseWriter, r *http.Request, values url.Values) (string, error) {
+	nonce := ""
+	if c, err := r.Cookie(OIDCCSRFCookieName); err == nil {
+		nonce = c.Value
+	}
+	if nonce == "" {
+		var err error
+		if nonce, err = randomHex(16); err != nil {
+			return "", err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     OIDCCSRFCookieName,
+			Value:    nonce,
+			Path:     h.prefix + OIDCAuthorizePath,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	mac := hmac.New(sha256.New, []byte(nonce))
+	mac.Write([]byte(values.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// limited returns true if attempts for recipient reached max.
+func (h *OIDCProvider) limited(attempts map[string]*oidcAttempts, max int, recipient string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, ok := attempts[attemptKey(recipient)]
+	return ok && a.count >= max && time.Now().Before(a.expires)
+}
+
+// count counts an attempt for recipient, e.g. a wrong PIN.
+func (h *OIDCProvider) count(attempts map[string]*oidcAttempts, recipient string) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, a := range attempts {
+		if now.After(a.expires) {
+			delete(attempts, k)
+		}
+	}
+	key := attemptKey(recipient)
+	a, ok := attempts[key]
+	if !ok {
+		a = &oidcAttempts{expires: now.Add(h.Lockout)}
+		attempts[key] = a
+	}
+	a.count++
+}
+
+// issueCode redirects the user back to the client with an authorization
+// code.
+func (h *OIDCProvider) issueCode(w http.ResponseWriter, r *http.Request, values url.Values, uid, recipient string, authTime time.Time) {
+	code, err := randomHex(32)
+	if err != nil {
+		h.serverError(w)
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	for k, c := range h.codes {
+		if now.After(c.expires) {
+			delete(h.codes, k)
+		}
+	}
+	h.codes[code] = &oidcCode{
+		clientID:    values.Get("client_id"),
+		redirectURI: values.Get("redirect_uri"),
+		uid:         uid,
+		recipient:   recipient,
+		scope:       values.Get("scope"),
+		nonce:       values.Get("nonce"),
+		challenge:   values.Get("code_challenge"),
+		authTime:    authTime,
+		expires:     now.Add(h.CodeTTL),
+	}
+	h.mu.Unlock()
+	h.redirect(w, r, values, url.Values{"code": {code}})
+}
+
+// token exchanges an authorization code for tokens.
+func (h *OIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.tokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	ctx := r.Context()
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		h.tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	// Authenticate the client, see RFC 6749 section 2.3.1
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := h.Clients.GetClient(ctx, id)
+	if errors.Is(err, ErrOIDCClientNotFound) {
+		h.tokenError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if err != nil {
+		h.serverError(w)
+		return
+	}
+	if !client.Public {
+		valid, err := h.Clients.VerifyClientSecret(ctx, id, secret)
+		if err != nil {
+			h.serverError(w)
+			return
+		} else if !valid {
+			h.tokenError(w, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+	}
+
+	// Codes are used once, even if the exchange fails
+	h.mu.Lock()
+	code, ok := h.codes[r.PostForm.Get("code")]
+	delete(h.codes, r.PostForm.Get("code"))
+	h.mu.Unlock()
+	verifier := r.PostForm.Get("code_verifier")
+	switch {
+	case !ok || time.Now().After(code.expires) || code.clientID != client.ID:
+		h.tokenError(w, http.StatusBadRequest, "invalid_grant", "code is not valid")
+		return
+	case code.redirectURI != r.PostForm.Get("redirect_uri"):
+		h.tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match")
+		return
+	case len(verifier) < 43 || len(verifier) > 128 ||
+		subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(code.challenge)) != 1:
+		h.tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier is not valid")
+		return
+	}
+
+	idToken, err := h.idToken(ctx, client, code)
+	if err != nil {
+		h.serverError(w)
+		return
+	}
+	jwt := h.Passwordless.JWT
+	accessToken, err := jwt.Issue(ctx, code.uid, h.Strategy, code.authTime)
+	if err != nil {
+		h.serverError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(jwt.TTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.scope,
+	})
+}
+
+// idToken returns the id_token for an authorization code.
+func (h *OIDCProvider) idToken(ctx context.Context, client *OIDCClient, code *oidcCode) (string, error) {
+	jwt := h.Passwordless.JWT
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":       jwt.Issuer,
+		"sub":       code.uid,
+		"aud":       client.ID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(jwt.TTL).Unix(),
+		"auth_time": code.authTime.Unix(),
+	}
+	if code.nonce != "" {
+		claims["nonce"] = code.nonce
+	}
+	if contains(strings.Fields(code.scope), "email") {
+		recipient := code.recipient
+		if recipient == "" {
+			// Signed in with a session
+			var err error
+			recipient, err = h.Passwordless.Resolver.ResolveRecipient(ctx, h.Strategy, code.uid)
+			if err != nil {
+				return "", err
+			}
+		}
+		claims["email"] = recipient
+		claims["email_verified"] = true
+	}
+	return jwt.Sign(claims)
+}
+
+// redirect sends the authorization response to the client.
+func (h *OIDCProvider) redirect(w http.ResponseWriter, r *http.Request, values, params url.Values) {
+	u, err := url.Parse(values.Get("redirect_uri"))
+	if err != nil {
+		h.serverError(w)
+		return
+	}
+	q := u.Query()
+	for k := range params {
+		q.Set(k, params.Get(k))
+	}
+	if state := values.Get("state"); state != "" {
+		q.Set("state", state)
+	}
+	q.Set("iss", h.Passwordless.JWT.Issuer)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// redirectError sends an error response to the client, see RFC 6749
+// section 4.1.2.1.
+func (h *OIDCProvider) redirectError(w http.ResponseWriter, r *http.Request, values url.Values, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	h.redirect(w, r, values, params)
+}
+
+// tokenError responds to a token request with an error, see RFC 6749
+// section 5.2.
+func (h *OIDCProvider) tokenError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (h *OIDCProvider) render(w http.ResponseWriter, data OIDCLoginData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// Clients must not frame the login page
+	w.Header().Set("X-Frame-Options", "DENY")
+	if err := h.Login.Execute(w, data); err != nil {
+		h.serverError(w)
+	}
+}
+
+func (h *OIDCProvider) serverError(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusInternalServerError),
+		http.StatusInternalServerError)
+}
+
+// pkceChallenge returns the S256 code challenge of a verifier, see
+// RFC 7636.
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// attemptKey returns the key attempts for recipient are counted under, so
+// that they can't be spread across spellings of the same address.
+func attemptKey(recipient string) string {
+	return strings.ToLower(strings.TrimSpace(recipient))
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
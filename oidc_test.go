@@ -0,0 +1,410 @@
+package passwordless
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// relyingParty is a minimal OIDC client, as an app signing users in with
+// the provider would be.
+type relyingParty struct {
+	t           *testing.T
+	http        *http.Client
+	id, secret  string
+	redirectURI string
+	config      map[string]interface{}
+	verifier    string
+}
+
+func newRelyingParty(t *testing.T, issuer, id, secret, redirectURI string) *relyingParty {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	rp := &relyingParty{
+		t: t,
+		http: &http.Client{
+			Jar: jar,
+			// The redirect back to the client is checked by the tests
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		id:          id,
+		secret:      secret,
+		redirectURI: redirectURI,
+	}
+	r, err := rp.http.Get(issuer + OIDCDiscoveryPath)
+	require.NoError(t, err)
+	defer r.Body.Close()
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&rp.config))
+	require.Equal(t, issuer, rp.config["issuer"])
+	return rp
+}
+
+// authParams returns the parameters of an authorization request, with a
+// new PKCE verifier.
+func (rp *relyingParty) authParams(scope, nonce string) url.Values {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	require.NoError(rp.t, err)
+	rp.verifier = base64.RawURLEncoding.EncodeToString(b)
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.id},
+		"redirect_uri":          {rp.redirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(rp.verifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// authorize sends an authorization request, posting form values if any
+// along with the CSRF token of the login page.
+func (rp *relyingParty) authorize(params, form url.Values) (*http.Response, string) {
+	endpoint := rp.config["authorization_endpoint"].(string)
+	var r *http.Response
+	var err error
+	if form == nil {
+		r, err = rp.http.Get(endpoint + "?" + params.Encode())
+	} else {
+		values := url.Values{}
+		for k, v := range params {
+			values[k] = v
+		}
+		if _, ok := form[LoginCSRFParam]; !ok {
+			_, body := rp.authorize(params, nil)
+			if m := regexp.MustCompile(`name="csrf" value="([^"]*)"`).FindStringSubmatch(body); m != nil {
+				values.Set(LoginCSRFParam, m[1])
+			}
+		}
+		for k, v := range form {
+			values[k] = v
+		}
+		r, err = rp.http.PostForm(endpoint, values)
+	}
+	require.NoError(rp.t, err)
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(rp.t, err)
+	return r, string(body)
+}
+
+// callback returns the query of the redirect back to the client.
+func (rp *relyingParty) callback(r *http.Response) url.Values {
+	require.Equal(rp.t, http.StatusFound, r.StatusCode)
+	u, err := url.Parse(r.Header.Get("Location"))
+	require.NoError(rp.t, err)
+	require.True(rp.t, strings.HasPrefix(u.String(), rp.redirectURI))
+	q := u.Query()
+	require.Equal(rp.t, "xyz", q.Get("state"))
+	require.Equal(rp.t, rp.config["issuer"], q.Get("iss"))
+	return q
+}
+
+// exchange redeems a code at the token endpoint.
+func (rp *relyingParty) exchange(code, verifier string) (int, map[string]interface{}) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.redirectURI},
+		"code_verifier": {verifier},
+	}
+	if rp.secret == "" {
+		form.Set("client_id", rp.id)
+	}
+	req, err := http.NewRequest(http.MethodPost, rp.config["token_endpoint"].(string),
+		strings.NewReader(form.Encode()))
+	require.NoError(rp.t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rp.secret != "" {
+		req.SetBasicAuth(rp.id, rp.secret)
+	}
+	r, err := rp.http.Do(req)
+	require.NoError(rp.t, err)
+	defer r.Body.Close()
+	body := map[string]interface{}{}
+	require.NoError(rp.t, json.NewDecoder(r.Body).Decode(&body))
+	return r.StatusCode, body
+}
+
+// verifyIDToken checks the signature of the id_token with the published
+// keys, and returns its claims.
+func (rp *relyingParty) verifyIDToken(token string) map[string]interface{} {
+	r, err := rp.http.Get(rp.config["jwks_uri"].(string))
+	require.NoError(rp.t, err)
+	defer r.Body.Close()
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(rp.t, json.NewDecoder(r.Body).Decode(&jwks))
+
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	require.Len(rp.t, parts, 3)
+	var header struct{ Alg, Kid string }
+	b, err := enc.DecodeString(parts[0])
+	require.NoError(rp.t, err)
+	require.NoError(rp.t, json.Unmarshal(b, &header))
+	sig, err := enc.DecodeString(parts[2])
+	require.NoError(rp.t, err)
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range jwks.Keys {
+		if k.Kid != header.Kid || k.Alg != header.Alg {
+			continue
+		}
+		switch k.Kty {
+		case "OKP":
+			x, err := enc.DecodeString(k.X)
+			require.NoError(rp.t, err)
+			verified = ed25519.Verify(x, signed, sig)
+		case "RSA":
+			n, err := enc.DecodeString(k.N)
+			require.NoError(rp.t, err)
+			e, err := enc.DecodeString(k.E)
+			require.NoError(rp.t, err)
+			pub := &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			h := sha256.Sum256(signed)
+			verified = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+		}
+	}
+	require.True(rp.t, verified)
+
+	claims := map[string]interface{}{}
+	b, err = enc.DecodeString(parts[1])
+	require.NoError(rp.t, err)
+	require.NoError(rp.t, json.Unmarshal(b, &claims))
+	require.Equal(rp.t, rp.config["issuer"], claims["iss"])
+	require.Equal(rp.t, rp.id, claims["aud"])
+	require.Greater(rp.t, claims["exp"].(float64), float64(time.Now().Unix()))
+	return claims
+}
+
+func TestOIDCProvider(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOIDCClientTable(db))
+	require.NoError(t, createUserSessionTable(db))
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	tt := &testTransport{}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, time.Minute)
+	p.Sessions, err = NewSQLiteSessionStore(db, "")
+	require.NoError(t, err)
+	clients, err := NewSQLiteOIDCClientStore(db, "")
+	require.NoError(t, err)
+
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	_, err = NewOIDCProvider(p, "email", clients)
+	require.True(t, errors.Is(err, ErrNoJWTIssuer))
+	p.JWT, err = NewJWTIssuer(srv.URL, JWTKey{ID: "hs", Key: []byte("01234567890123456789012345678901")})
+	require.NoError(t, err)
+	_, err = NewOIDCProvider(p, "email", clients)
+	require.True(t, errors.Is(err, ErrJWTKeyNotSupported))
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p.JWT, err = NewJWTIssuer(srv.URL, JWTKey{ID: "1", Key: rsaKey})
+	require.NoError(t, err)
+	provider, err := NewOIDCProvider(p, "email", clients)
+	require.NoError(t, err)
+	handler = p.SessionMiddleware(provider)
+
+	_, _, err = provider.RegisterClient(nil, "Wiki", nil, false)
+	require.True(t, errors.Is(err, ErrOIDCRedirectURINotValid))
+	_, _, err = provider.RegisterClient(nil, "Wiki", []string{"/callback"}, false)
+	require.True(t, errors.Is(err, ErrOIDCRedirectURINotValid))
+	wiki, secret, err := provider.RegisterClient(nil, "Wiki", []string{"https://wiki.example.com/callback"}, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	app, secret2, err := provider.RegisterClient(nil, "App", []string{"http://127.0.0.1/callback"}, true)
+	require.NoError(t, err)
+	require.Empty(t, secret2)
+
+	rp := newRelyingParty(t, srv.URL, wiki.ID, secret, wiki.RedirectURIs[0])
+	require.Equal(t, []interface{}{"S256"}, rp.config["code_challenge_methods_supported"])
+	require.Equal(t, []interface{}{"RS256"}, rp.config["id_token_signing_alg_values_supported"])
+
+	// The user signs in with a PIN
+	params := rp.authParams("openid email", "n-0S6")
+	r, body := rp.authorize(params, nil)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "Sign in to Wiki")
+	r, body = rp.authorize(params, url.Values{LoginRecipientParam: {"nobody@example.com"}})
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "Enter the PIN sent to nobody@example.com")
+	require.Empty(t, tt.token)
+	r, body = rp.authorize(params, url.Values{
+		LoginRecipientParam: {"nobody@example.com"}, LoginTokenParam: {"1337"}})
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "The PIN is not valid")
+	r, body = rp.authorize(params, url.Values{LoginRecipientParam: {"bender@ilovebender.com"}})
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "Enter the PIN sent to bender@ilovebender.com")
+	require.Equal(t, "1337", tt.token)
+	r, body = rp.authorize(params, url.Values{
+		LoginRecipientParam: {"bender@ilovebender.com"}, LoginTokenParam: {"0000"}})
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "The PIN is not valid")
+	r, _ = rp.authorize(params, url.Values{
+		LoginRecipientParam: {"bender@ilovebender.com"}, LoginTokenParam: {"1337"}})
+	code := rp.callback(r).Get("code")
+	require.NotEmpty(t, code)
+
+	// The client exchanges the code for tokens, once
+	status, tokens := newRelyingParty(t, srv.URL, wiki.ID, "wrong", rp.redirectURI).
+		exchange(code, rp.verifier)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "invalid_client", tokens["error"])
+	status, tokens = rp.exchange(code, rp.verifier)
+	require.Equal(t, http.StatusOK, status, tokens)
+	require.Equal(t, "Bearer", tokens["token_type"])
+	claims := rp.verifyIDToken(tokens["id_token"].(string))
+	require.Equal(t, "42", claims["sub"])
+	require.Equal(t, "n-0S6", claims["nonce"])
+	require.Equal(t, "bender@ilovebender.com", claims["email"])
+	require.Equal(t, true, claims["email_verified"])
+	access, err := p.JWT.Verify(tokens["access_token"].(string))
+	require.NoError(t, err)
+	require.Equal(t, "42", access["sub"])
+	require.Equal(t, "email", access["strategy"])
+	status, tokens = rp.exchange(code, rp.verifier)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "invalid_grant", tokens["error"])
+
+	// Signing in started a session, so the user isn't asked again. Public
+	// clients rely on PKCE alone.
+	pub := newRelyingParty(t, srv.URL, app.ID, "", app.RedirectURIs[0])
+	pub.http.Jar = rp.http.Jar
+	params = pub.authParams("openid", "")
+	r, _ = pub.authorize(params, nil)
+	code = pub.callback(r).Get("code")
+	status, tokens = pub.exchange(code, "wrong-verifier-wrong-verifier-wrong-verifier")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "invalid_grant", tokens["error"])
+	r, _ = pub.authorize(params, nil)
+	code = pub.callback(r).Get("code")
+	status, tokens = pub.exchange(code, pub.verifier)
+	require.Equal(t, http.StatusOK, status, tokens)
+	claims = pub.verifyIDToken(tokens["id_token"].(string))
+	require.Equal(t, "42", claims["sub"])
+	require.NotContains(t, claims, "email")
+	require.NotContains(t, claims, "nonce")
+
+	// Without a session, prompt=none fails
+	pub = newRelyingParty(t, srv.URL, app.ID, "", app.RedirectURIs[0])
+	params = pub.authParams("openid", "")
+	params.Set("prompt", "none")
+	r, _ = pub.authorize(params, nil)
+	require.Equal(t, "login_required", pub.callback(r).Get("error"))
+
+	// Requests without PKCE or the openid scope are refused
+	params = pub.authParams("openid", "")
+	params.Del("code_challenge")
+	r, _ = pub.authorize(params, nil)
+	require.Equal(t, "invalid_request", pub.callback(r).Get("error"))
+	params = pub.authParams("email", "")
+	r, _ = pub.authorize(params, nil)
+	require.Equal(t, "invalid_scope", pub.callback(r).Get("error"))
+
+	// Errors are never sent to unregistered redirect URIs
+	params = pub.authParams("openid", "")
+	params.Set("redirect_uri", "https://evil.example.com/callback")
+	r, _ = pub.authorize(params, nil)
+	require.Equal(t, http.StatusBadRequest, r.StatusCode)
+	params.Set("client_id", "unknown")
+	r, _ = pub.authorize(params, nil)
+	require.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	// Verification errors only show the PIN is not valid
+	p.SetTransport("never", tt, testGenerator{token: "1337"}, time.Minute,
+		func(context.Context) bool { return false })
+	provider.Strategy = "never"
+	params = pub.authParams("openid", "")
+	pin := url.Values{
+		LoginRecipientParam: {"bender@ilovebender.com"}, LoginTokenParam: {"1337"}}
+	r, body = pub.authorize(params, pin)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "The PIN is not valid")
+
+	// Recipients are locked after too many wrong PINs, also for the right
+	// one and other spellings
+	provider.Strategy = "email"
+	provider.MaxFailures = 2
+	r, _ = pub.authorize(params, url.Values{LoginRecipientParam: {"bender@ilovebender.com"}})
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	pin.Set(LoginTokenParam, "0000")
+	_, body = pub.authorize(params, pin)
+	require.Contains(t, body, "The PIN is not valid")
+	pin.Set(LoginTokenParam, "1337")
+	pin.Set(LoginRecipientParam, "Bender@ilovebender.com")
+	r, body = pub.authorize(params, pin)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	require.Contains(t, body, "Too many attempts")
+
+	// Only so many PINs are sent to a recipient
+	provider.MaxSends = 3
+	tt.token = ""
+	_, body = pub.authorize(params, url.Values{LoginRecipientParam: {"bender@ilovebender.com"}})
+	require.NotContains(t, body, "Too many attempts")
+	require.Equal(t, "1337", tt.token)
+	tt.token = ""
+	_, body = pub.authorize(params, url.Values{LoginRecipientParam: {"BENDER@ilovebender.com"}})
+	require.Contains(t, body, "Too many attempts")
+	require.Empty(t, tt.token)
+
+	// The form can't be posted without the CSRF token of the browser and
+	// authorization request
+	other := newRelyingParty(t, srv.URL, app.ID, "", app.RedirectURIs[0])
+	_, body = pub.authorize(params, nil)
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]*)"`).FindStringSubmatch(body)[1]
+	for _, test := range []struct {
+		rp   *relyingParty
+		csrf string
+	}{{pub, ""}, {other, csrf}} {
+		r, _ = test.rp.authorize(params, url.Values{
+			LoginRecipientParam: {"bender@ilovebender.com"}, LoginCSRFParam: {test.csrf}})
+		require.Equal(t, http.StatusForbidden, r.StatusCode)
+	}
+	params.Set("state", "abc")
+	r, _ = pub.authorize(params, url.Values{
+		LoginRecipientParam: {"bender@ilovebender.com"}, LoginCSRFParam: {csrf}})
+	require.Equal(t, http.StatusForbidden, r.StatusCode)
+	params.Set("state", "xyz")
+
+	// Store failures are server errors, and don't count as wrong PINs
+	provider.MaxFailures = DefaultOIDCMaxFailures
+	_, err = db.Exec("drop table session")
+	require.NoError(t, err)
+	pin.Set(LoginRecipientParam, "bender@ilovebender.com")
+	r, _ = pub.authorize(params, pin)
+	require.Equal(t, http.StatusInternalServerError, r.StatusCode)
+	require.Equal(t, 2, provider.failures["bender@ilovebender.com"].count)
+}
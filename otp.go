@@ -0,0 +1,226 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+)
+
+var (
+	ErrOTPNotEnrolled       = errors.New("user has not enrolled an authenticator")
+	ErrOTPCodeReused        = errors.New("code has already been used")
+	ErrOTPAlgorithmNotValid = errors.New("otp algorithm is not valid")
+	ErrOTPDigitsNotValid    = errors.New("otp digits must be between 6 and 9")
+	ErrOTPPeriodNotValid    = errors.New("otp period must be at least a second")
+	ErrOTPIssuerRequired    = errors.New("otp issuer is required")
+	ErrOTPLocked            = errors.New("too many failed codes, try again later")
+)
+
+// OTPSecretSize is the size in bytes of generated secrets, as recommended
+// by RFC 4226.
+const OTPSecretSize = 20
+
+const (
+	// DefaultOTPMaxFailures is the number of consecutive failed codes after
+	// which verification is locked
+	DefaultOTPMaxFailures = 5
+	// DefaultOTPLockout is how long verification stays locked
+	DefaultOTPLockout = 15 * time.Minute
+)
+
+// OTPAlgorithm is the HMAC hash used to derive one-time passwords.
+type OTPAlgorithm string
+
+const (
+	// OTPSHA1 is the default, and the only algorithm supported by all
+	// authenticator apps
+	OTPSHA1   OTPAlgorithm = "SHA1"
+	OTPSHA256 OTPAlgorithm = "SHA256"
+	OTPSHA512 OTPAlgorithm = "SHA512"
+)
+
+func (a OTPAlgorithm) hash() (func() hash.Hash, error) {
+	switch a {
+	case OTPSHA1, "":
+		return sha1.New, nil
+	case OTPSHA256:
+		return sha256.New, nil
+	case OTPSHA512:
+		return sha512.New, nil
+	}
+	return nil, errors.WithStack(ErrOTPAlgorithmNotValid)
+}
+
+// OTPStore keeps the shared secrets of one-time password authenticators,
+// together with a counter used to reject codes that were used before, and
+// the number of failed codes. Newly enrolled secrets are pending until
+// the user confirms them with a code, so that an active secret keeps
+// working until then. Secrets must be readable to compute codes, so they
+// are not hashed.
+type OTPStore interface {
+	// SetOTPSecret keeps the secret as pending for the user, replacing any
+	// pending secret. The active secret is not changed.
+	SetOTPSecret(ctx context.Context, uid string, secret []byte) error
+	// PendingOTPSecret returns the pending secret of the user, or
+	// ErrOTPNotEnrolled
+	PendingOTPSecret(ctx context.Context, uid string) ([]byte, error)
+	// ActivateOTPSecret replaces the active secret of the user with the
+	// pending one, setting the counter and resetting failures. It fails
+	// with ErrOTPNotEnrolled if there is no pending secret.
+	ActivateOTPSecret(ctx context.Context, uid string, counter uint64) error
+	// OTPSecret returns the active secret and counter of the user, or
+	// ErrOTPNotEnrolled
+	OTPSecret(ctx context.Context, uid string) ([]byte, uint64, error)
+	// AdvanceOTPCounter sets the counter of the user if it is greater than
+	// the stored one, failing with ErrOTPCodeReused otherwise, so that each
+	// code is accepted at most once. Failures are reset.
+	AdvanceOTPCounter(ctx context.Context, uid string, counter uint64) error
+	// AddOTPFailure counts a failed code of the user at the given time
+	AddOTPFailure(ctx context.Context, uid string, at time.Time) error
+	// OTPFailures returns the number of failed codes of the user since
+	// the last accepted one, and the time of the last failure, or
+	// ErrOTPNotEnrolled
+	OTPFailures(ctx context.Context, uid string) (int, time.Time, error)
+	// DeleteOTPSecret removes the secrets of the user
+	DeleteOTPSecret(ctx context.Context, uid string) error
+}
+
+// OTPEnrollment is the result of enrolling an authenticator, to show the
+// user once.
+type OTPEnrollment struct {
+	// Secret is the base32 encoded secret, for manual entry
+	Secret string
+	// URI is the otpauth:// URI understood by authenticator apps
+	URI string
+}
+
+// PNG returns the URI as a QR code image, size pixels wide, for scanning
+// with an authenticator app.
+func (e OTPEnrollment) PNG(size int) ([]byte, error) {
+	b, err := qrcode.Encode(e.URI, qrcode.Medium, size)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+// otpConfig holds the parameters shared by TOTP and HOTP.
+type otpConfig struct {
+	Issuer    string
+	Digits    int
+	Algorithm OTPAlgorithm
+	// MaxFailures is the number of consecutive failed codes after which
+	// verification is locked for Lockout, so that codes can't be guessed.
+	// Zero disables the limit.
+	MaxFailures int
+	Lockout     time.Duration
+}
+
+func (c otpConfig) validate() error {
+	if c.Issuer == "" {
+		return errors.WithStack(ErrOTPIssuerRequired)
+	}
+	if c.Digits < 6 || c.Digits > 9 {
+		return errors.WithStack(ErrOTPDigitsNotValid)
+	}
+	_, err := c.Algorithm.hash()
+	return err
+}
+
+// code returns the one-time password for the counter, see RFC 4226.
+func (c otpConfig) code(secret []byte, counter uint64) (string, error) {
+	h, err := c.Algorithm.hash()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(h, secret)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], counter)
+	mac.Write(b[:])
+	sum := mac.Sum(nil)
+	// Dynamic truncation
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < c.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", c.Digits, v%mod), nil
+}
+
+// locked returns ErrOTPLocked if the user reached MaxFailures, and the
+// last failure was within Lockout.
+func (c otpConfig) locked(ctx context.Context, store OTPStore, uid string, now time.Time) error {
+	failures, last, err := store.OTPFailures(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if c.MaxFailures > 0 && failures >= c.MaxFailures && now.Before(last.Add(c.Lockout)) {
+		return errors.WithStack(ErrOTPLocked)
+	}
+	return nil
+}
+
+// fail counts a failed code of the user, and returns false.
+func (c otpConfig) fail(ctx context.Context, store OTPStore, uid string, now time.Time) (bool, error) {
+	if c.MaxFailures <= 0 {
+		return false, nil
+	}
+	return false, store.AddOTPFailure(ctx, uid, now)
+}
+
+// enroll generates a pending secret for the user and returns the
+// enrollment for an otpauth:// URI of the given type, "totp" or "hotp".
+func (c otpConfig) enroll(ctx context.Context, store OTPStore, kind, uid, account string, params url.Values) (*OTPEnrollment, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, OTPSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := store.SetOTPSecret(ctx, uid, secret); err != nil {
+		return nil, err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	alg := c.Algorithm
+	if alg == "" {
+		alg = OTPSHA1
+	}
+	params.Set("secret", enc)
+	params.Set("issuer", c.Issuer)
+	params.Set("algorithm", string(alg))
+	params.Set("digits", strconv.Itoa(c.Digits))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     kind,
+		Path:     "/" + c.Issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return &OTPEnrollment{Secret: enc, URI: u.String()}, nil
+}
+
+// sanitizeOTP removes the spaces and dashes users may enter to group
+// digits.
+func sanitizeOTP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, s)
+}
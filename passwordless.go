@@ -12,6 +12,7 @@ var (
 	ErrNoTransport        = errors.New("no transports have been configured")
 	ErrUnknownStrategy    = errors.New("unknown strategy")
 	ErrNotValidForContext = errors.New("strategy not valid for context")
+	ErrNoResolver         = errors.New("no user resolver has been configured")
 )
 
 // Strategy defines how to send and what tokens to send to users.
@@ -25,12 +26,32 @@ type Strategy interface {
 	Valid(context.Context) bool
 }
 
+// TokenVerifier is implemented by strategies that verify tokens
+// themselves rather than through the token store, e.g. TOTP, where codes
+// are generated on the user's device.
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, uid, token string) (bool, error)
+}
+
 // SimpleStrategy is a convenience wrapper combining a Transport,
-// TokenGenerator, and TTL.
+// TokenGenerator, TTL and validity predicates.
 type SimpleStrategy struct {
 	Transport
 	TokenGenerator
-	ttl time.Duration
+	ttl   time.Duration
+	valid []ValidFunc
+}
+
+// NewSimpleStrategy returns a strategy delivering tokens generated by g
+// via t, valid for the given TTL. The strategy is only valid for contexts
+// satisfying all of the provided predicates.
+func NewSimpleStrategy(t Transport, g TokenGenerator, ttl time.Duration, valid ...ValidFunc) SimpleStrategy {
+	return SimpleStrategy{
+		Transport:      t,
+		TokenGenerator: g,
+		ttl:            ttl,
+		valid:          valid,
+	}
 }
 
 // TTL returns the time-to-live of tokens generated with this strategy.
@@ -38,15 +59,53 @@ func (s SimpleStrategy) TTL(context.Context) time.Duration {
 	return s.ttl
 }
 
-// Valid always returns true for SimpleStrategy.
-func (s SimpleStrategy) Valid(context.Context) bool {
-	return true
+// Valid returns true if the context satisfies all validity predicates of
+// the strategy, or if it has none.
+func (s SimpleStrategy) Valid(ctx context.Context) bool {
+	return AllOf(s.valid...)(ctx)
 }
 
 // Passwordless holds a set of named strategies and an associated token store.
 type Passwordless struct {
-	Strategies map[string]Strategy
+	Strategies *StrategyRegistry
 	Store      TokenStore
+	// Resolver optionally maps recipients to uids and back, see
+	// `RequestToken` and `VerifyRecipient`
+	Resolver UserResolver
+	// EnumerationSafe makes requests for users unknown to the Resolver
+	// indistinguishable from those for known users, by hashing a dummy
+	// token and delaying for as long as a delivery typically takes
+	EnumerationSafe bool
+	// DecoyDelay is the delivery time assumed for a strategy by
+	// EnumerationSafe until a request for a known user was observed. It
+	// defaults to DefaultDecoyDelay.
+	DecoyDelay time.Duration
+	// Approvals optionally stores cross-device sign in requests, see
+	// `RequestApproval`
+	Approvals ApprovalStore
+	// BindSessions binds tokens to the browser session they were requested
+	// from, using a cookie. Tokens are then only accepted from the same
+	// session, unless they arrive via a signed magic link the user
+	// confirmed. Tokens requested outside of a browser session are only
+	// accepted via such links. Requires a Store implementing BindingStore.
+	BindSessions bool
+	// Sessions optionally stores the sessions issued to users once signed
+	// in, see `IssueSession`
+	Sessions SessionStore
+	// SessionTTL is the lifetime of sessions, DefaultSessionTTL if zero
+	SessionTTL time.Duration
+	// RefreshTokens optionally stores refresh tokens, see
+	// `IssueRefreshToken`
+	RefreshTokens RefreshTokenStore
+	// RefreshTTL is the sliding lifetime of refresh tokens, and
+	// RefreshMaxTTL the absolute lifetime of a family of them. They default
+	// to DefaultRefreshTTL and DefaultRefreshMaxTTL.
+	RefreshTTL    time.Duration
+	RefreshMaxTTL time.Duration
+	// JWT optionally issues JWTs to users once signed in, see `SignInJWT`
+	JWT *JWTIssuer
+
+	decoy decoy
 }
 
 // New returns a new Passwordless instance with the specified token store.
@@ -55,37 +114,35 @@ type Passwordless struct {
 func New(store TokenStore) *Passwordless {
 	return &Passwordless{
 		Store:      store,
-		Strategies: make(map[string]Strategy),
+		Strategies: NewStrategyRegistry(),
 	}
 }
 
-// SetStrategy registers the given strategy.
+// SetStrategy registers the given strategy, replacing any existing strategy
+// of the same name. Use `Strategies` directly to set display metadata.
 func (p *Passwordless) SetStrategy(name string, s Strategy) {
-	p.Strategies[name] = s
+	p.Strategies.Set(name, s)
 }
 
 // SetTransport registers a transport strategy under a specified name. The
 // TTL specifies for how long tokens generated with the provided TokenGenerator
 // are valid. Some delivery mechanisms may require longer TTLs than others
-// depending on the nature/punctuality of the transport.
-func (p *Passwordless) SetTransport(name string, t Transport, g TokenGenerator, ttl time.Duration) Strategy {
-	s := SimpleStrategy{
-		Transport:      t,
-		TokenGenerator: g,
-		ttl:            ttl,
-	}
+// depending on the nature/punctuality of the transport. The strategy is only
+// offered for contexts satisfying all of the optional validity predicates.
+func (p *Passwordless) SetTransport(name string, t Transport, g TokenGenerator, ttl time.Duration, valid ...ValidFunc) Strategy {
+	s := NewSimpleStrategy(t, g, ttl, valid...)
 	p.SetStrategy(name, s)
 	return s
 }
 
-// ListStrategies returns a list of strategies valid for the context mapped
-// to their names. If you have multiple strategies, call this in order to
-// provide a list of options for the user to pick from.
-func (p *Passwordless) ListStrategies(ctx context.Context) map[string]Strategy {
-	s := map[string]Strategy{}
-	for n, t := range p.Strategies {
-		if t.Valid(ctx) {
-			s[n] = t
+// ListStrategies returns the strategies valid for the context, in the
+// order they were registered. If you have multiple strategies, call this in
+// order to provide a list of options for the user to pick from.
+func (p *Passwordless) ListStrategies(ctx context.Context) []StrategyEntry {
+	s := []StrategyEntry{}
+	for _, e := range p.Strategies.List() {
+		if e.Valid(ctx) {
+			s = append(s, e)
 		}
 	}
 	return s
@@ -94,43 +151,175 @@ func (p *Passwordless) ListStrategies(ctx context.Context) map[string]Strategy {
 // GetStrategy returns the Strategy of the given name, or nil if one does
 // not exist.
 func (p *Passwordless) GetStrategy(ctx context.Context, name string) (Strategy, error) {
-	t, ok := p.Strategies[name]
+	e, ok := p.Strategies.Get(name)
 	if !ok {
 		return nil, ErrUnknownStrategy
-	} else if !t.Valid(ctx) {
+	} else if !e.Valid(ctx) {
 		return nil, ErrNotValidForContext
 	}
-	return t, nil
+	return e.Strategy, nil
 }
 
-// RequestToken generates and delivers a token to the given user. If the
-// specified strategy is not known or not valid, an error is returned.
-func (p *Passwordless) RequestToken(ctx context.Context, s, uid, recipient string) error {
-	if t, err := p.GetStrategy(ctx, s); err != nil {
+// RequestToken generates and delivers a token to the given user, that is
+// only accepted for the given purpose, e.g. PurposeLogin. Requesting a
+// token replaces any pending token for the same purpose. If the specified
+// strategy is not known or not valid, an error is returned. The recipient
+// and purpose are added to the context, see `WithRecipient` and
+// `WithPurpose`.
+//
+// If a Resolver is configured, either uid or recipient may be empty and is
+// looked up. When the user is not known, nil is returned without sending a
+// token, so that callers don't reveal which accounts exist. Set
+// EnumerationSafe to also conceal this from timing.
+//
+// For strategies implementing TokenVerifier nothing is stored, and the
+// strategy transport is called with an empty token.
+func (p *Passwordless) RequestToken(ctx context.Context, purpose, s, uid, recipient string) error {
+	start := p.decoy.clock()
+	ctx = WithPurpose(ctx, purpose)
+	// Resolve first, so that validity is checked against the recipient the
+	// token is sent to, also when only the uid is given
+	ruid, rrecipient, err := p.resolve(ctx, s, uid, recipient)
+	unknown := errors.Is(err, ErrUnknownUser)
+	if err != nil && !unknown {
 		return err
-	} else {
-		return RequestToken(ctx, p.Store, t, uid, recipient)
+	} else if !unknown {
+		uid, recipient = ruid, rrecipient
+	}
+	if recipient != "" {
+		ctx = WithRecipient(ctx, recipient)
+	}
+	t, err := p.GetStrategy(ctx, s)
+	if err != nil {
+		return err
+	}
+	if unknown {
+		if p.EnumerationSafe {
+			floor := p.DecoyDelay
+			if floor == 0 {
+				floor = DefaultDecoyDelay
+			}
+			p.decoy.request(ctx, s, t, floor, start)
+		}
+		return nil
+	}
+	if _, ok := t.(TokenVerifier); ok {
+		return t.Send(ctx, "", uid, recipient)
+	}
+	if p.BindSessions {
+		if _, ok := p.Store.(BindingStore); !ok {
+			return ErrBindingNotSupported
+		}
+		binding, err := sessionBinding(ctx, true)
+		if err != nil {
+			return err
+		}
+		ctx = WithBinding(ctx, binding)
 	}
+	err = RequestToken(ctx, p.Store, t, uid, recipient)
+	if err == nil && p.EnumerationSafe {
+		p.decoy.observe(s, p.decoy.clock().Sub(start))
+	}
+	return err
 }
 
-// VerifyToken verifies the provided token is valid.
-func (p *Passwordless) VerifyToken(ctx context.Context, uid, token string) (bool, error) {
-	return VerifyToken(ctx, p.Store, uid, token)
+// VerifyToken verifies the provided token is valid, and was requested for
+// the same purpose. If BindSessions is set, valid tokens requested from a
+// different session are rejected with ErrBindingMismatch, and are not
+// removed.
+func (p *Passwordless) VerifyToken(ctx context.Context, purpose, uid, token string) (bool, error) {
+	ctx = WithPurpose(ctx, purpose)
+	if !p.BindSessions || confirmedLink(ctx) {
+		return VerifyToken(ctx, p.Store, uid, token)
+	}
+	if isValid, err := p.Store.Verify(ctx, token, uid); err != nil || !isValid {
+		return false, err
+	}
+	if err := p.checkBinding(ctx, uid); err != nil {
+		return false, err
+	}
+	return true, p.Store.Delete(ctx, uid)
+}
+
+// VerifyStrategyToken verifies the token of the named strategy. Strategies
+// implementing TokenVerifier check the token themselves, otherwise this is
+// the same as `VerifyToken`. If EnumerationSafe is set, users who have not
+// enrolled an authenticator get the same result as a wrong code.
+func (p *Passwordless) VerifyStrategyToken(ctx context.Context, purpose, s, uid, token string) (bool, error) {
+	ctx = WithPurpose(ctx, purpose)
+	t, err := p.GetStrategy(ctx, s)
+	if err != nil {
+		return false, err
+	}
+	if v, ok := t.(TokenVerifier); ok {
+		valid, err := v.VerifyToken(ctx, uid, token)
+		if p.EnumerationSafe && errors.Is(err, ErrOTPNotEnrolled) {
+			return false, nil
+		}
+		return valid, err
+	}
+	return p.VerifyToken(ctx, purpose, uid, token)
+}
+
+// VerifyRecipient verifies the token sent to recipient using the named
+// strategy for the given purpose, returning the uid of the user it was
+// issued to. It requires a Resolver, so that clients only need to provide
+// the address they entered rather than the uid. If the recipient is not
+// known, the token is reported as invalid. If EnumerationSafe is set, the
+// same applies when no unexpired token was issued to the user.
+func (p *Passwordless) VerifyRecipient(ctx context.Context, purpose, s, recipient, token string) (string, bool, error) {
+	if p.Resolver == nil {
+		return "", false, ErrNoResolver
+	}
+	uid, err := p.Resolver.ResolveUID(ctx, s, recipient)
+	if errors.Is(err, ErrUnknownUser) || (err == nil && uid == "") {
+		if p.EnumerationSafe {
+			p.decoy.verify(token)
+		}
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	valid, err := p.VerifyStrategyToken(ctx, purpose, s, uid, token)
+	if p.EnumerationSafe &&
+		(errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired)) {
+		// Known users without a pending token look like unknown users
+		p.decoy.verify(token)
+		return "", false, nil
+	} else if !valid {
+		return "", false, err
+	}
+	return uid, true, err
 }
 
 // RequestToken generates, saves and delivers a token to the specified
-// recipient.
+// recipient. If the context has a binding, see `WithBinding`, the store
+// must implement BindingStore. Likewise, if it has a pending recipient, see
+// `WithPendingRecipient`, the store must implement PendingRecipientStore.
 func RequestToken(ctx context.Context, s TokenStore, t Strategy, uid, recipient string) error {
 	tok, err := t.Generate(ctx)
 	if err != nil {
 		return err
 	}
+	// The store keeps the binding and the address being verified with the
+	// token
+	if _, ok := bindingFromContext(ctx); ok {
+		if _, ok := s.(BindingStore); !ok {
+			return ErrBindingNotSupported
+		}
+	}
+	if PendingRecipientFromContext(ctx) != "" {
+		if _, ok := s.(PendingRecipientStore); !ok {
+			return ErrPendingRecipientNotSupported
+		}
+	}
 	// Store token
-	if err := s.Store(ctx, tok, uid, t.TTL(ctx)); err != nil {
+	ttl := t.TTL(ctx)
+	if err := s.Store(ctx, tok, uid, ttl); err != nil {
 		return err
 	}
 	// Send token to user
-	if err := t.Send(ctx, tok, uid, recipient); err != nil {
+	if err := t.Send(withExpires(ctx, time.Now().Add(ttl)), tok, uid, recipient); err != nil {
 		return err
 	}
 	return nil
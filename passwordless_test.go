@@ -47,7 +47,7 @@ func TestPasswordless(t *testing.T) {
 	s := p.SetTransport("test", tt, tg, 5*time.Minute)
 
 	// Check transports match those set
-	require.Equal(t, map[string]Strategy{"test": s}, p.ListStrategies(nil))
+	require.Equal(t, []StrategyEntry{{Name: "test", Strategy: s}}, p.ListStrategies(nil))
 	if s0, err := p.GetStrategy(nil, "test"); err != nil {
 		require.NoError(t, err)
 	} else {
@@ -55,17 +55,17 @@ func TestPasswordless(t *testing.T) {
 	}
 
 	// Check returned token is as expected
-	require.NoError(t, p.RequestToken(nil, "test", "uid", "recipient"))
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "test", "uid", "recipient"))
 	require.Equal(t, tt.token, tg.token)
 	require.Equal(t, tt.recipient, "recipient")
 
 	// Check invalid token is rejected
-	v, err := p.VerifyToken(nil, "uid", "badtoken")
+	v, err := p.VerifyToken(nil, PurposeLogin, "uid", "badtoken")
 	require.NoError(t, err)
 	require.False(t, v)
 
 	// Verify token
-	v, err = p.VerifyToken(nil, "uid", tg.token)
+	v, err = p.VerifyToken(nil, PurposeLogin, "uid", tg.token)
 	require.NoError(t, err)
 	require.True(t, v)
 }
@@ -89,12 +89,12 @@ func TestPasswordlessFailures(t *testing.T) {
 	_, err = p.GetStrategy(nil, "madeup")
 	require.Equal(t, err, ErrUnknownStrategy)
 
-	err = p.RequestToken(nil, "madeup", "", "")
+	err = p.RequestToken(nil, PurposeLogin, "madeup", "", "")
 	require.Equal(t, err, ErrUnknownStrategy)
 
 	p.SetStrategy("unfriendly", testStrategy{valid: false})
 
-	err = p.RequestToken(nil, "unfriendly", "", "")
+	err = p.RequestToken(nil, PurposeLogin, "unfriendly", "", "")
 	require.Equal(t, err, ErrNotValidForContext)
 }
 
@@ -210,3 +210,44 @@ func (m mockTokenStore) Verify(ctx context.Context, token, uid string) (bool, er
 func (m mockTokenStore) Delete(ctx context.Context, uid string) error {
 	return m.delete(ctx, uid)
 }
+
+func TestTokenPurpose(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	tt := &testTransport{}
+	tg := &testGenerator{token: "1337"}
+	p.SetTransport("email", tt, tg, 5*time.Minute)
+
+	// A sign in token can't confirm an account deletion
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "uid", "recipient"))
+	v, err := p.VerifyToken(nil, PurposeAccountDeletion, "uid", "1337")
+	require.ErrorIs(t, err, ErrTokenNotFound)
+	require.False(t, v)
+
+	// Tokens for different purposes are kept side by side
+	tg.token = "4242"
+	require.NoError(t, p.RequestToken(nil, PurposeReauth, "email", "uid", "recipient"))
+	v, err = p.VerifyToken(nil, PurposeReauth, "uid", "1337")
+	require.NoError(t, err)
+	require.False(t, v)
+	v, err = p.VerifyToken(nil, PurposeLogin, "uid", "4242")
+	require.NoError(t, err)
+	require.False(t, v)
+	v, err = p.VerifyToken(nil, PurposeReauth, "uid", "4242")
+	require.NoError(t, err)
+	require.True(t, v)
+	v, err = p.VerifyToken(nil, PurposeLogin, "uid", "1337")
+	require.NoError(t, err)
+	require.True(t, v)
+
+	// The store defaults to PurposeLogin
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "uid", "recipient"))
+	exists, _, err := store.Exists(nil, "uid")
+	require.NoError(t, err)
+	require.True(t, exists)
+	_, _, err = store.Exists(WithPurpose(nil, PurposeEmailChange), "uid")
+	require.ErrorIs(t, err, ErrTokenNotFound)
+}
@@ -0,0 +1,41 @@
+package passwordless
+
+import (
+	"context"
+)
+
+// Purposes tokens can be scoped to. A token is only accepted for the
+// purpose it was requested for, so that e.g. a sign in token can't be used
+// to delete an account. Applications may define their own purposes.
+const (
+	// PurposeLogin tokens sign the user in
+	PurposeLogin = "login"
+	// PurposeReauth tokens confirm a signed in user before a sensitive
+	// action, i.e. step-up authentication
+	PurposeReauth = "reauth"
+	// PurposeEmailChange tokens confirm a new email address
+	PurposeEmailChange = "email_change"
+	// PurposeAccountDeletion tokens confirm deleting an account
+	PurposeAccountDeletion = "account_deletion"
+)
+
+// WithPurpose returns a Context specifying the purpose of tokens. Token
+// stores keep a separate token per user and purpose. `Passwordless` sets
+// this automatically.
+func WithPurpose(ctx context.Context, purpose string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, purposeKey, purpose)
+}
+
+// PurposeFromContext returns the purpose set with `WithPurpose`, or
+// PurposeLogin if none is set.
+func PurposeFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if p, ok := ctx.Value(purposeKey).(string); ok && p != "" {
+			return p
+		}
+	}
+	return PurposeLogin
+}
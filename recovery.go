@@ -0,0 +1,170 @@
+package passwordless
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrRecoveryCodesNotValid = errors.New("recovery code count and length must be positive")
+	ErrRecoveryCodesLocked   = errors.New("too many failed recovery codes, try again later")
+)
+
+// RecoveryCodeStore keeps hashes of single-use recovery codes.
+type RecoveryCodeStore interface {
+	// SetRecoveryCodes replaces the codes of the user with the given hashes
+	SetRecoveryCodes(ctx context.Context, uid string, hashes []string) error
+	// RecoveryCodeHashes returns the hashes of the codes the user has left
+	RecoveryCodeHashes(ctx context.Context, uid string) ([]string, error)
+	// ConsumeRecoveryCode removes the code with the given hash, as
+	// returned by RecoveryCodeHashes, returning false if the user has no
+	// such code. Failures are reset once a code is removed.
+	ConsumeRecoveryCode(ctx context.Context, uid, hash string) (bool, error)
+	// RecoveryCodesRemaining returns the number of codes the user has left
+	RecoveryCodesRemaining(ctx context.Context, uid string) (int, error)
+	// AddRecoveryCodeFailure counts a failed code of the user at the given
+	// time
+	AddRecoveryCodeFailure(ctx context.Context, uid string, at time.Time) error
+	// RecoveryCodeFailures returns the number of failed codes of the user
+	// since the last accepted one, and the time of the last failure
+	RecoveryCodeFailures(ctx context.Context, uid string) (int, time.Time, error)
+}
+
+// RecoveryCodes is a Strategy for single-use codes the user writes down in
+// advance, as a fallback for when their email or device is not available.
+// Like TOTP, nothing is stored or sent when requesting a token, and codes
+// are verified against the batch created with `GenerateCodes`.
+type RecoveryCodes struct {
+	NopTransport
+	Store RecoveryCodeStore
+	// Count is the number of codes in a batch
+	Count int
+	// Length is the number of characters of each code, from the Crockford
+	// alphabet, see `CrockfordGenerator`
+	Length int
+	// MaxFailures is the number of consecutive failed codes after which
+	// verification is locked for Lockout, so that codes can't be guessed
+	// and each attempt, which compares against every remaining hash,
+	// can't be repeated at will. Zero disables the limit.
+	MaxFailures int
+	Lockout     time.Duration
+	valid       []ValidFunc
+}
+
+// NewRecoveryCodes returns a RecoveryCodes strategy generating batches of
+// 10 codes of 10 characters each. Verification locks like that of TOTP.
+// The strategy is only valid for contexts satisfying all of the
+// predicates.
+func NewRecoveryCodes(store RecoveryCodeStore, valid ...ValidFunc) *RecoveryCodes {
+	return &RecoveryCodes{
+		Store:       store,
+		Count:       10,
+		Length:      10,
+		MaxFailures: DefaultOTPMaxFailures,
+		Lockout:     DefaultOTPLockout,
+		valid:       valid,
+	}
+}
+
+// Generate returns an empty token, as codes are generated in advance.
+func (s *RecoveryCodes) Generate(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// Sanitize removes spaces and dashes from codes, and corrects transcription
+// errors like `CrockfordGenerator`.
+func (s *RecoveryCodes) Sanitize(ctx context.Context, t string) (string, error) {
+	return CrockfordGenerator{}.Sanitize(ctx, sanitizeOTP(t))
+}
+
+// TTL returns zero, as codes don't expire.
+func (s *RecoveryCodes) TTL(context.Context) time.Duration {
+	return 0
+}
+
+// Valid returns true if the context satisfies all validity predicates.
+func (s *RecoveryCodes) Valid(ctx context.Context) bool {
+	return AllOf(s.valid...)(ctx)
+}
+
+// GenerateCodes creates a new batch of codes for the user, replacing any
+// remaining codes. The codes are returned to show the user once, and only
+// their hashes are stored.
+func (s *RecoveryCodes) GenerateCodes(ctx context.Context, uid string) ([]string, error) {
+	if s.Count <= 0 || s.Length <= 0 {
+		return nil, errors.WithStack(ErrRecoveryCodesNotValid)
+	}
+	g := NewCrockfordGenerator(s.Length)
+	codes := make([]string, s.Count)
+	hashes := make([]string, s.Count)
+	for i := range codes {
+		code, err := g.Generate(ctx)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		codes[i] = code
+		if hashes[i], err = hashRecoveryCode(code); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Store.SetRecoveryCodes(ctx, uid, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyToken returns true if code is one of the remaining codes of the
+// user, which is then used up. After MaxFailures failed codes,
+// verification fails with ErrRecoveryCodesLocked until Lockout passed.
+func (s *RecoveryCodes) VerifyToken(ctx context.Context, uid, code string) (bool, error) {
+	code, err := s.Sanitize(ctx, code)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if s.MaxFailures > 0 {
+		failures, last, err := s.Store.RecoveryCodeFailures(ctx, uid)
+		if err != nil {
+			return false, err
+		}
+		if failures >= s.MaxFailures && now.Before(last.Add(s.Lockout)) {
+			return false, errors.WithStack(ErrRecoveryCodesLocked)
+		}
+	}
+	hashes, err := s.Store.RecoveryCodeHashes(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			// False if the code was used concurrently
+			return s.Store.ConsumeRecoveryCode(ctx, uid, hash)
+		}
+	}
+	if s.MaxFailures <= 0 {
+		return false, nil
+	}
+	return false, s.Store.AddRecoveryCodeFailure(ctx, uid, now)
+}
+
+// Remaining returns the number of codes the user has left, e.g. to prompt
+// them to generate a new batch when running low.
+func (s *RecoveryCodes) Remaining(ctx context.Context, uid string) (int, error) {
+	return s.Store.RecoveryCodesRemaining(ctx, uid)
+}
+
+// hashRecoveryCode returns the bcrypt hash of code. A code of the default
+// length has only 50 bits of entropy, and unlike tokens it stays valid
+// until used, so a leaked table must not be searchable with a fast hash.
+// Each code gets its own salt, so codes are found by comparing against
+// all hashes of the user.
+func hashRecoveryCode(code string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(h), nil
+}
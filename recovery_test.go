@@ -0,0 +1,93 @@
+package passwordless
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createRecoveryCodeTable(db))
+	rcs, err := NewSQLiteRecoveryCodeStore(db, "")
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+	s := NewRecoveryCodes(rcs)
+	s.Count = 3
+	p.SetStrategy("recovery", s)
+
+	codes, err := s.GenerateCodes(nil, "42")
+	require.NoError(t, err)
+	require.Len(t, codes, 3)
+	for _, code := range codes {
+		require.Len(t, code, 10)
+		require.Empty(t, strings.Trim(code, string(crockfordBytes)))
+	}
+	// Codes are hashed with a salt each
+	hashes, err := rcs.RecoveryCodeHashes(nil, "42")
+	require.NoError(t, err)
+	require.Len(t, hashes, 3)
+	for _, hash := range hashes {
+		require.NotContains(t, codes, hash, "codes should be hashed")
+		require.True(t, strings.HasPrefix(hash, "$2a$"), "codes should be hashed with bcrypt")
+	}
+
+	// Codes may be entered in upper case, with dashes
+	entered := strings.ToUpper(codes[0][:5] + "-" + codes[0][5:])
+	valid, err := p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", entered)
+	require.NoError(t, err)
+	require.True(t, valid)
+	n, err := s.Remaining(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// Each code is accepted once, and only for its user
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", codes[0])
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "43", codes[1])
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", codes[1])
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// A new batch replaces the remaining codes
+	batch, err := s.GenerateCodes(nil, "42")
+	require.NoError(t, err)
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", codes[2])
+	require.NoError(t, err)
+	require.False(t, valid)
+	n, err = s.Remaining(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	// Failed codes lock verification, also of valid codes
+	s.MaxFailures = 3
+	for i := 0; i < 2; i++ {
+		valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", "0000000000")
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", batch[0])
+	require.True(t, errors.Is(err, ErrRecoveryCodesLocked))
+	require.False(t, valid)
+	s.Lockout = 0
+	valid, err = p.VerifyStrategyToken(nil, PurposeLogin, "recovery", "42", batch[0])
+	require.NoError(t, err)
+	require.True(t, valid)
+	failures, _, err := rcs.RecoveryCodeFailures(nil, "42")
+	require.NoError(t, err)
+	require.Zero(t, failures)
+
+	s.Count = 0
+	_, err = s.GenerateCodes(nil, "42")
+	require.True(t, errors.Is(err, ErrRecoveryCodesNotValid))
+}
@@ -0,0 +1,218 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoRefreshStore       = errors.New("no refresh token store has been configured")
+	ErrRefreshTokenNotValid = errors.New("refresh token is not valid")
+	ErrRefreshTokenExpired  = errors.New("refresh token is expired")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used, its family is revoked")
+)
+
+const (
+	// DefaultRefreshTTL is the sliding lifetime of refresh tokens if
+	// RefreshTTL is not set
+	DefaultRefreshTTL = 14 * 24 * time.Hour
+	// DefaultRefreshMaxTTL is the absolute lifetime of refresh token
+	// families if RefreshMaxTTL is not set
+	DefaultRefreshMaxTTL = 90 * 24 * time.Hour
+)
+
+// RefreshToken is a long-lived token a client exchanges for a new one,
+// e.g. to stay signed in on a mobile device. Each token is used once, and
+// its replacement belongs to the same family.
+type RefreshToken struct {
+	ID string
+	// Token is given to the client. It is only set when the token is
+	// issued, as just a hash of the secret part is stored.
+	Token string
+	// Family is the ID shared by a token and its replacements
+	Family string
+	UID    string
+	// Expires is when the token expires unless used, i.e. sliding
+	Expires time.Time
+	// FamilyExpires is when the family expires, however often it is used
+	FamilyExpires time.Time
+	// Used is when the token was exchanged, or zero
+	Used    time.Time
+	Created time.Time
+}
+
+// RefreshTokenStore is a storage mechanism for refresh tokens.
+type RefreshTokenStore interface {
+	// StoreRefreshToken securely stores the token, keeping a hash of secret
+	StoreRefreshToken(ctx context.Context, t *RefreshToken, secret string) error
+	// VerifyRefreshToken returns the token with the ID if secret matches,
+	// or fails with ErrRefreshTokenNotValid
+	VerifyRefreshToken(ctx context.Context, id, secret string) (*RefreshToken, error)
+	// UseRefreshToken marks the token used, failing with
+	// ErrRefreshTokenReused if it already was
+	UseRefreshToken(ctx context.Context, id string, used time.Time) error
+	// DeleteRefreshFamily removes the tokens of a family
+	DeleteRefreshFamily(ctx context.Context, family string) error
+	// DeleteRefreshTokens removes all tokens of the user
+	DeleteRefreshTokens(ctx context.Context, uid string) error
+}
+
+// IssueRefreshToken starts a new family of refresh tokens for the user,
+// typically once a token was verified.
+func (p *Passwordless) IssueRefreshToken(ctx context.Context, uid string) (*RefreshToken, error) {
+	if p.RefreshTokens == nil {
+		return nil, errors.WithStack(ErrNoRefreshStore)
+	}
+	// Stores keep timestamps to the second
+	now := time.Now().UTC().Truncate(time.Second)
+	family, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	return p.issueRefreshToken(ctx, &RefreshToken{
+		Family:        family,
+		UID:           uid,
+		FamilyExpires: now.Add(p.refreshMaxTTL()),
+	}, now)
+}
+
+// VerifyTokenRefresh verifies the token like `VerifyToken`, and issues a
+// refresh token for the user if it is valid.
+func (p *Passwordless) VerifyTokenRefresh(ctx context.Context, purpose, uid, token string) (*RefreshToken, bool, error) {
+	if p.RefreshTokens == nil {
+		return nil, false, errors.WithStack(ErrNoRefreshStore)
+	}
+	valid, err := p.VerifyToken(ctx, purpose, uid, token)
+	if !valid {
+		return nil, false, err
+	}
+	t, err := p.IssueRefreshToken(ctx, uid)
+	if err != nil {
+		return nil, false, err
+	}
+	return t, true, nil
+}
+
+// Refresh exchanges a refresh token for a new one of the same family. The
+// new token expires after RefreshTTL, but not after the family does. If a
+// token is used twice, which suggests it was stolen, the whole family is
+// revoked and ErrRefreshTokenReused is returned, so that neither the thief
+// nor the user can use it any longer.
+func (p *Passwordless) Refresh(ctx context.Context, token string) (*RefreshToken, error) {
+	if p.RefreshTokens == nil {
+		return nil, errors.WithStack(ErrNoRefreshStore)
+	}
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.WithStack(ErrRefreshTokenNotValid)
+	}
+	t, err := p.RefreshTokens.VerifyRefreshToken(ctx, id, secret)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if !t.Used.IsZero() {
+		return nil, p.revokeReused(ctx, t.Family)
+	}
+	if now.After(t.Expires) || now.After(t.FamilyExpires) {
+		return nil, errors.WithStack(ErrRefreshTokenExpired)
+	}
+	err = p.RefreshTokens.UseRefreshToken(ctx, t.ID, now)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		// Used concurrently
+		return nil, p.revokeReused(ctx, t.Family)
+	} else if err != nil {
+		return nil, err
+	}
+	return p.issueRefreshToken(ctx, &RefreshToken{
+		Family:        t.Family,
+		UID:           t.UID,
+		FamilyExpires: t.FamilyExpires,
+	}, now)
+}
+
+// RevokeRefreshToken revokes the family of the refresh token, e.g. when
+// signing out on a device.
+func (p *Passwordless) RevokeRefreshToken(ctx context.Context, token string) error {
+	if p.RefreshTokens == nil {
+		return errors.WithStack(ErrNoRefreshStore)
+	}
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return errors.WithStack(ErrRefreshTokenNotValid)
+	}
+	t, err := p.RefreshTokens.VerifyRefreshToken(ctx, id, secret)
+	if err != nil {
+		return err
+	}
+	return p.RefreshTokens.DeleteRefreshFamily(ctx, t.Family)
+}
+
+// RevokeRefreshTokens revokes all refresh tokens of the user.
+func (p *Passwordless) RevokeRefreshTokens(ctx context.Context, uid string) error {
+	if p.RefreshTokens == nil {
+		return errors.WithStack(ErrNoRefreshStore)
+	}
+	return p.RefreshTokens.DeleteRefreshTokens(ctx, uid)
+}
+
+// issueRefreshToken generates and stores the next token of a family.
+func (p *Passwordless) issueRefreshToken(ctx context.Context, t *RefreshToken, now time.Time) (*RefreshToken, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	t.ID = id
+	t.Token = id + "." + secret
+	t.Created = now
+	t.Expires = now.Add(p.refreshTTL())
+	if t.Expires.After(t.FamilyExpires) {
+		t.Expires = t.FamilyExpires
+	}
+	if err := p.RefreshTokens.StoreRefreshToken(ctx, t, secret); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// revokeReused revokes a family after one of its tokens was reused.
+func (p *Passwordless) revokeReused(ctx context.Context, family string) error {
+	if err := p.RefreshTokens.DeleteRefreshFamily(ctx, family); err != nil {
+		return err
+	}
+	return errors.WithStack(ErrRefreshTokenReused)
+}
+
+func (p *Passwordless) refreshTTL() time.Duration {
+	if p.RefreshTTL == 0 {
+		return DefaultRefreshTTL
+	}
+	return p.RefreshTTL
+}
+
+func (p *Passwordless) refreshMaxTTL() time.Duration {
+	if p.RefreshMaxTTL == 0 {
+		return DefaultRefreshMaxTTL
+	}
+	return p.RefreshMaxTTL
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
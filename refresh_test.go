@@ -0,0 +1,87 @@
+package passwordless
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createRefreshTokenTable(db))
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+
+	_, err = p.IssueRefreshToken(nil, "42")
+	require.True(t, errors.Is(err, ErrNoRefreshStore))
+	p.RefreshTokens, err = NewSQLiteRefreshTokenStore(db, "")
+	require.NoError(t, err)
+
+	// A refresh token is issued once the token is verified
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	_, valid, err := p.VerifyTokenRefresh(nil, PurposeLogin, "42", "0000")
+	require.NoError(t, err)
+	require.False(t, valid)
+	first, valid, err := p.VerifyTokenRefresh(nil, PurposeLogin, "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", first.UID)
+	require.WithinDuration(t, time.Now().Add(DefaultRefreshTTL), first.Expires, time.Minute)
+	require.WithinDuration(t, time.Now().Add(DefaultRefreshMaxTTL), first.FamilyExpires, time.Minute)
+
+	// Refreshing rotates the token within the family
+	second, err := p.Refresh(nil, first.Token)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Token, second.Token)
+	require.Equal(t, first.Family, second.Family)
+	require.Equal(t, first.FamilyExpires, second.FamilyExpires)
+	third, err := p.Refresh(nil, second.Token)
+	require.NoError(t, err)
+
+	// Reusing a rotated token revokes the family
+	_, err = p.Refresh(nil, first.Token)
+	require.True(t, errors.Is(err, ErrRefreshTokenReused))
+	_, err = p.Refresh(nil, third.Token)
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+
+	for _, token := range []string{"", "nodot", "abc.def", third.ID + ".forged"} {
+		_, err = p.Refresh(nil, token)
+		require.True(t, errors.Is(err, ErrRefreshTokenNotValid), token)
+	}
+
+	// Tokens expire unless used
+	p.RefreshTTL = -time.Second
+	expired, err := p.IssueRefreshToken(nil, "42")
+	require.NoError(t, err)
+	_, err = p.Refresh(nil, expired.Token)
+	require.True(t, errors.Is(err, ErrRefreshTokenExpired))
+
+	// And are not extended past the family lifetime
+	p.RefreshTTL = time.Hour
+	p.RefreshMaxTTL = time.Minute
+	short, err := p.IssueRefreshToken(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, short.FamilyExpires, short.Expires)
+	next, err := p.Refresh(nil, short.Token)
+	require.NoError(t, err)
+	require.Equal(t, short.FamilyExpires, next.Expires)
+
+	// Signing out revokes the family, and all of them can be revoked
+	require.NoError(t, p.RevokeRefreshToken(nil, next.Token))
+	_, err = p.Refresh(nil, next.Token)
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+	a, err := p.IssueRefreshToken(nil, "42")
+	require.NoError(t, err)
+	b, err := p.IssueRefreshToken(nil, "43")
+	require.NoError(t, err)
+	require.NoError(t, p.RevokeRefreshTokens(nil, "42"))
+	_, err = p.Refresh(nil, a.Token)
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+	_, err = p.Refresh(nil, b.Token)
+	require.NoError(t, err)
+}
@@ -0,0 +1,131 @@
+package passwordless
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrStrategyExists = errors.New("strategy already registered")
+)
+
+// StrategyInfo holds display metadata of a strategy, e.g. for rendering a
+// sign in page.
+type StrategyInfo struct {
+	// Label is a human readable name, e.g. "Send me an email"
+	Label string
+	// Icon is an application defined icon name or URL
+	Icon string
+}
+
+// StrategyEntry is a strategy registered under a name.
+type StrategyEntry struct {
+	Name string
+	Info StrategyInfo
+	Strategy
+}
+
+// StrategyRegistry is a set of named strategies, safe for concurrent use.
+// Strategies are listed in the order they were added.
+type StrategyRegistry struct {
+	mu      sync.RWMutex
+	names   []string
+	entries map[string]StrategyEntry
+}
+
+// NewStrategyRegistry returns an empty registry.
+func NewStrategyRegistry() *StrategyRegistry {
+	return &StrategyRegistry{
+		entries: make(map[string]StrategyEntry),
+	}
+}
+
+// Add registers a strategy. It fails if the name is already taken.
+func (r *StrategyRegistry) Add(name string, s Strategy, info StrategyInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; ok {
+		return errors.Wrap(ErrStrategyExists, name)
+	}
+	r.names = append(r.names, name)
+	r.entries[name] = StrategyEntry{Name: name, Info: info, Strategy: s}
+	return nil
+}
+
+// Replace swaps the strategy registered under name, keeping its position
+// and metadata. It fails if the name is not registered.
+func (r *StrategyRegistry) Replace(name string, s Strategy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[name]
+	if !ok {
+		return errors.Wrap(ErrUnknownStrategy, name)
+	}
+	e.Strategy = s
+	r.entries[name] = e
+	return nil
+}
+
+// Set adds the strategy, or replaces it if the name is already registered.
+func (r *StrategyRegistry) Set(name string, s Strategy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[name]
+	if !ok {
+		r.names = append(r.names, name)
+		e.Name = name
+	}
+	e.Strategy = s
+	r.entries[name] = e
+}
+
+// SetInfo updates the metadata of a registered strategy.
+func (r *StrategyRegistry) SetInfo(name string, info StrategyInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[name]
+	if !ok {
+		return errors.Wrap(ErrUnknownStrategy, name)
+	}
+	e.Info = info
+	r.entries[name] = e
+	return nil
+}
+
+// Remove unregisters a strategy, returning false if it was not registered.
+// Tokens already issued with it can still be verified.
+func (r *StrategyRegistry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; !ok {
+		return false
+	}
+	delete(r.entries, name)
+	for i, n := range r.names {
+		if n == name {
+			r.names = append(r.names[:i:i], r.names[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Get returns the strategy registered under name.
+func (r *StrategyRegistry) Get(name string) (StrategyEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[name]
+	return e, ok
+}
+
+// List returns all registered strategies in order.
+func (r *StrategyRegistry) List() []StrategyEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l := make([]StrategyEntry, len(r.names))
+	for i, n := range r.names {
+		l[i] = r.entries[n]
+	}
+	return l
+}
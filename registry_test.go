@@ -0,0 +1,86 @@
+package passwordless
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func strategyNames(entries []StrategyEntry) []string {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func TestStrategyRegistry(t *testing.T) {
+	r := NewStrategyRegistry()
+	email := NewSimpleStrategy(&testTransport{}, testGenerator{token: "email"}, time.Minute)
+	sms := NewSimpleStrategy(&testTransport{}, testGenerator{token: "sms"}, time.Minute)
+	debug := NewSimpleStrategy(&testTransport{}, testGenerator{token: "debug"}, time.Minute)
+
+	require.NoError(t, r.Add("sms", sms, StrategyInfo{Label: "SMS", Icon: "phone"}))
+	require.NoError(t, r.Add("email", email, StrategyInfo{Label: "Email", Icon: "envelope"}))
+	r.Set("debug", debug)
+	require.True(t, errors.Is(r.Add("email", email, StrategyInfo{}), ErrStrategyExists))
+	require.Equal(t, []string{"sms", "email", "debug"}, strategyNames(r.List()))
+
+	// Replace keeps position and metadata
+	require.NoError(t, r.Replace("sms", debug))
+	e, ok := r.Get("sms")
+	require.True(t, ok)
+	require.Equal(t, StrategyInfo{Label: "SMS", Icon: "phone"}, e.Info)
+	require.Equal(t, Strategy(debug), e.Strategy)
+	require.Equal(t, []string{"sms", "email", "debug"}, strategyNames(r.List()))
+	require.True(t, errors.Is(r.Replace("voice", sms), ErrUnknownStrategy))
+
+	r.Set("sms", sms)
+	e, _ = r.Get("sms")
+	require.Equal(t, "SMS", e.Info.Label)
+	require.Equal(t, Strategy(sms), e.Strategy)
+
+	require.NoError(t, r.SetInfo("debug", StrategyInfo{Label: "Debug"}))
+	e, _ = r.Get("debug")
+	require.Equal(t, "Debug", e.Info.Label)
+	require.True(t, errors.Is(r.SetInfo("voice", StrategyInfo{}), ErrUnknownStrategy))
+
+	list := r.List()
+	require.True(t, r.Remove("sms"))
+	require.False(t, r.Remove("sms"))
+	_, ok = r.Get("sms")
+	require.False(t, ok)
+	require.Equal(t, []string{"email", "debug"}, strategyNames(r.List()))
+	require.Equal(t, []string{"sms", "email", "debug"}, strategyNames(list),
+		"previously listed strategies should be unaffected")
+}
+
+func TestStrategyRegistryConcurrency(t *testing.T) {
+	p := New(nil)
+	s := NewSimpleStrategy(&testTransport{}, testGenerator{token: "1337"}, time.Minute)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("s", i)
+			for j := 0; j < 100; j++ {
+				p.SetStrategy(name, s)
+				p.Strategies.Remove(name)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.ListStrategies(nil)
+				p.GetStrategy(nil, "s0")
+			}
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, p.ListStrategies(nil))
+}
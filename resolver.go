@@ -0,0 +1,46 @@
+package passwordless
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// UserResolver maps between users and the addresses tokens are delivered
+// to, e.g. by querying a user table. Implementations should return
+// ErrUnknownUser if no matching user exists.
+type UserResolver interface {
+	// ResolveUID returns the uid of the user that receives tokens of the
+	// named strategy at recipient.
+	ResolveUID(ctx context.Context, strategy, recipient string) (string, error)
+	// ResolveRecipient returns the address tokens of the named strategy are
+	// delivered to for the user.
+	ResolveRecipient(ctx context.Context, strategy, uid string) (string, error)
+}
+
+// resolve fills in a missing uid or recipient using the resolver. It
+// returns ErrUnknownUser if either can't be resolved.
+func (p *Passwordless) resolve(ctx context.Context, strategy, uid, recipient string) (string, string, error) {
+	var err error
+	if p.Resolver == nil {
+		return uid, recipient, nil
+	}
+	if uid == "" {
+		if uid, err = p.Resolver.ResolveUID(ctx, strategy, recipient); err != nil {
+			return "", "", err
+		}
+	}
+	if recipient == "" {
+		if recipient, err = p.Resolver.ResolveRecipient(ctx, strategy, uid); err != nil {
+			return "", "", err
+		}
+	}
+	if uid == "" || recipient == "" {
+		return "", "", errors.WithStack(ErrUnknownUser)
+	}
+	return uid, recipient, nil
+}
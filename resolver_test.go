@@ -0,0 +1,89 @@
+package passwordless
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// mapResolver resolves users from a map of uid to recipient.
+type mapResolver struct {
+	users map[string]string
+	err   error
+}
+
+func (r mapResolver) ResolveUID(ctx context.Context, strategy, recipient string) (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	for uid, rcpt := range r.users {
+		if rcpt == recipient {
+			return uid, nil
+		}
+	}
+	return "", ErrUnknownUser
+}
+
+func (r mapResolver) ResolveRecipient(ctx context.Context, strategy, uid string) (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	if rcpt, ok := r.users[uid]; ok {
+		return rcpt, nil
+	}
+	return "", ErrUnknownUser
+}
+
+func TestUserResolver(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+
+	tt := &testTransport{}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, 5*time.Minute)
+
+	_, _, err = p.VerifyRecipient(nil, PurposeLogin, "email", "bender@ilovebender.com", "1337")
+	require.True(t, errors.Is(err, ErrNoResolver))
+
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+
+	// Resolve uid from recipient
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "", "bender@ilovebender.com"))
+	require.Equal(t, "bender@ilovebender.com", tt.recipient)
+	exists, _, err := store.Exists(nil, "42")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Unknown recipients don't fail, but nothing is sent
+	*tt = testTransport{}
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "", "fry@planetexpress.com"))
+	require.Empty(t, tt.token)
+
+	// Verify without the uid
+	uid, valid, err := p.VerifyRecipient(nil, PurposeLogin, "email", "fry@planetexpress.com", "1337")
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Empty(t, uid)
+	uid, valid, err = p.VerifyRecipient(nil, PurposeLogin, "email", "bender@ilovebender.com", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", uid)
+
+	// Resolve recipient from uid
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "42", ""))
+	require.Equal(t, "bender@ilovebender.com", tt.recipient)
+	*tt = testTransport{}
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "7", ""))
+	require.Empty(t, tt.token)
+
+	// Resolver failures are reported
+	p.Resolver = mapResolver{err: errors.New("db down")}
+	require.EqualError(t, p.RequestToken(nil, PurposeLogin, "email", "", "bender@ilovebender.com"), "db down")
+	_, _, err = p.VerifyRecipient(nil, PurposeLogin, "email", "bender@ilovebender.com", "1337")
+	require.EqualError(t, err, "db down")
+}
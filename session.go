@@ -0,0 +1,272 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoSessionStore  = errors.New("no session store has been configured")
+	ErrSessionNotFound = errors.New("session does not exist")
+	ErrSessionExpired  = errors.New("session is expired")
+)
+
+// SessionCookieName is the cookie holding the session token issued by
+// `IssueSession`.
+const SessionCookieName = "pwl_session"
+
+// DefaultSessionTTL is the lifetime of sessions if SessionTTL is not set.
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// sessionTouchInterval limits how often the last seen time is updated.
+const sessionTouchInterval = time.Minute
+
+// UserSession is a signed in session of a user, e.g. on one browser.
+type UserSession struct {
+	// ID identifies the session, e.g. to revoke it. It is not a secret and
+	// can't be used to authenticate.
+	ID string
+	// Token authenticates requests of the session. It is only set when the
+	// session is issued, as just a hash is stored.
+	Token string
+	UID   string
+	// IP and UserAgent of the client the session was issued to
+	IP        string
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+}
+
+// SessionStore persists sessions, keyed by a hash of their token.
+type SessionStore interface {
+	// CreateSession stores a new session with the hash of its token
+	CreateSession(ctx context.Context, s *UserSession, hash string) error
+	// SessionByHash returns the session with the token hash, or
+	// ErrSessionNotFound
+	SessionByHash(ctx context.Context, hash string) (*UserSession, error)
+	// TouchSession sets the last seen time of the session
+	TouchSession(ctx context.Context, id string, lastSeen time.Time) error
+	// Sessions returns the sessions of the user
+	Sessions(ctx context.Context, uid string) ([]*UserSession, error)
+	// DeleteSession removes a session of the user, or returns
+	// ErrSessionNotFound
+	DeleteSession(ctx context.Context, uid, id string) error
+	// DeleteSessions removes all sessions of the user
+	DeleteSessions(ctx context.Context, uid string) error
+}
+
+// WithUserSession returns a Context with the authenticated session.
+// `SessionMiddleware` sets this automatically.
+func WithUserSession(ctx context.Context, s *UserSession) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, sessionKey, s)
+}
+
+// UserSessionFromContext returns the session set with `WithUserSession`,
+// or nil if the request is not authenticated.
+func UserSessionFromContext(ctx context.Context) *UserSession {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(sessionKey).(*UserSession)
+	return s
+}
+
+// IssueSession starts a session for the user, typically once a token was
+// verified. If the context has a response writer, see `SetContext`, the
+// token is set as an HttpOnly cookie, otherwise the caller passes the
+// returned token to the client.
+func (p *Passwordless) IssueSession(ctx context.Context, uid string) (*UserSession, error) {
+	if p.Sessions == nil {
+		return nil, errors.WithStack(ErrNoSessionStore)
+	}
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ttl := p.SessionTTL
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+	now := time.Now().UTC()
+	s := &UserSession{
+		ID:       hex.EncodeToString(b[:16]),
+		Token:    base64.RawURLEncoding.EncodeToString(b[16:]),
+		UID:      uid,
+		Created:  now,
+		LastSeen: now,
+		Expires:  now.Add(ttl),
+	}
+	rw, r := fromContext(ctx)
+	if r != nil {
+		s.IP = remoteHost(r)
+		s.UserAgent = r.UserAgent()
+	}
+	if err := p.Sessions.CreateSession(ctx, s, hashSessionToken(s.Token)); err != nil {
+		return nil, err
+	}
+	if rw != nil {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     SessionCookieName,
+			Value:    s.Token,
+			Path:     "/",
+			Expires:  s.Expires,
+			HttpOnly: true,
+			Secure:   r != nil && r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return s, nil
+}
+
+// SignIn verifies a PurposeLogin token sent to recipient, see
+// `VerifyRecipient`, and issues a session for the user if it is valid.
+func (p *Passwordless) SignIn(ctx context.Context, s, recipient, token string) (*UserSession, bool, error) {
+	uid, valid, err := p.VerifyRecipient(ctx, PurposeLogin, s, recipient, token)
+	if !valid {
+		return nil, false, err
+	}
+	session, err := p.IssueSession(ctx, uid)
+	if err != nil {
+		return nil, false, err
+	}
+	return session, true, nil
+}
+
+// AuthenticateSession returns the session of the token. Expired sessions
+// are removed, and fail with ErrSessionExpired.
+func (p *Passwordless) AuthenticateSession(ctx context.Context, token string) (*UserSession, error) {
+	if p.Sessions == nil {
+		return nil, errors.WithStack(ErrNoSessionStore)
+	}
+	s, err := p.Sessions.SessionByHash(ctx, hashSessionToken(token))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if now.After(s.Expires) {
+		if err := p.Sessions.DeleteSession(ctx, s.UID, s.ID); err != nil &&
+			!errors.Is(err, ErrSessionNotFound) {
+			return nil, err
+		}
+		return nil, errors.WithStack(ErrSessionExpired)
+	}
+	if now.Sub(s.LastSeen) >= sessionTouchInterval {
+		if err := p.Sessions.TouchSession(ctx, s.ID, now); err != nil {
+			return nil, err
+		}
+		s.LastSeen = now
+	}
+	return s, nil
+}
+
+// SessionMiddleware authenticates requests with the session cookie, and
+// adds the session to the request context, see `UserSessionFromContext`.
+// Requests without a valid session are passed on without one, use
+// `RequireSession` to reject them.
+func (p *Passwordless) SessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(SessionCookieName)
+		if err != nil || c.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s, err := p.AuthenticateSession(r.Context(), c.Value)
+		if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+			// Clear the stale cookie
+			http.SetCookie(w, &http.Cookie{
+				Name: SessionCookieName, Path: "/", MaxAge: -1})
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUserSession(r.Context(), s)))
+	})
+}
+
+// RequireSession responds with 401 Unauthorized to requests without a
+// session, see `SessionMiddleware`.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if UserSessionFromContext(r.Context()) == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EndSession revokes the session of the request, i.e. signs out, and
+// clears the cookie. The context must be set with `SetContext`, on a
+// request that passed `SessionMiddleware`, or have a session set with
+// `WithUserSession`.
+func (p *Passwordless) EndSession(ctx context.Context) error {
+	if p.Sessions == nil {
+		return errors.WithStack(ErrNoSessionStore)
+	}
+	rw, r := fromContext(ctx)
+	if rw != nil {
+		http.SetCookie(rw, &http.Cookie{
+			Name: SessionCookieName, Path: "/", MaxAge: -1})
+	}
+	s := UserSessionFromContext(ctx)
+	if s == nil && r != nil {
+		s = UserSessionFromContext(r.Context())
+	}
+	if s == nil {
+		return nil
+	}
+	err := p.Sessions.DeleteSession(ctx, s.UID, s.ID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// ListSessions returns the sessions of the user, e.g. to show where they
+// are signed in.
+func (p *Passwordless) ListSessions(ctx context.Context, uid string) ([]*UserSession, error) {
+	if p.Sessions == nil {
+		return nil, errors.WithStack(ErrNoSessionStore)
+	}
+	return p.Sessions.Sessions(ctx, uid)
+}
+
+// RevokeSession ends the session with the given ID, if it belongs to the
+// user.
+func (p *Passwordless) RevokeSession(ctx context.Context, uid, id string) error {
+	if p.Sessions == nil {
+		return errors.WithStack(ErrNoSessionStore)
+	}
+	return p.Sessions.DeleteSession(ctx, uid, id)
+}
+
+// RevokeSessions ends all sessions of the user, e.g. after their account
+// was compromised.
+func (p *Passwordless) RevokeSessions(ctx context.Context, uid string) error {
+	if p.Sessions == nil {
+		return errors.WithStack(ErrNoSessionStore)
+	}
+	return p.Sessions.DeleteSessions(ctx, uid)
+}
+
+// hashSessionToken returns the hex encoded SHA-256 of token. Tokens are
+// random, so a fast hash suffices and allows looking sessions up.
+func hashSessionToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,127 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createUserSessionTable(db))
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	p.SetTransport("email", &testTransport{}, testGenerator{token: "1337"}, time.Minute)
+
+	_, err = p.IssueSession(nil, "42")
+	require.True(t, errors.Is(err, ErrNoSessionStore))
+	p.Sessions, err = NewSQLiteSessionStore(db, "")
+	require.NoError(t, err)
+
+	// Signing in sets the session cookie
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "", "bender@ilovebender.com"))
+	r := httptest.NewRequest(http.MethodPost, "/account/token", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	rec := httptest.NewRecorder()
+	ctx := SetContext(context.Background(), rec, r)
+	_, valid, err := p.SignIn(ctx, "email", "bender@ilovebender.com", "0000")
+	require.NoError(t, err)
+	require.False(t, valid)
+	s, valid, err := p.SignIn(ctx, "email", "bender@ilovebender.com", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", s.UID)
+	require.Equal(t, "192.0.2.1", s.IP)
+	require.Equal(t, "Mozilla/5.0", s.UserAgent)
+	require.WithinDuration(t, time.Now().Add(DefaultSessionTTL), s.Expires, time.Minute)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	require.Equal(t, SessionCookieName, cookie.Name)
+	require.Equal(t, s.Token, cookie.Value)
+	require.True(t, cookie.HttpOnly)
+
+	// Only the hash of the token is stored
+	var hash string
+	require.NoError(t, db.QueryRow("select hash from user_session").Scan(&hash))
+	require.NotEqual(t, s.Token, hash)
+
+	// The middleware authenticates requests with the cookie
+	var seen *UserSession
+	h := p.SessionMiddleware(RequireSession(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seen = UserSessionFromContext(r.Context())
+		})))
+	get := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		seen = nil
+		r := httptest.NewRequest(http.MethodGet, "/restricted", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	rec = get(cookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, seen)
+	require.Equal(t, s.ID, seen.ID)
+	require.Empty(t, seen.Token)
+	rec = get()
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = get(&http.Cookie{Name: SessionCookieName, Value: "forged"})
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, -1, rec.Result().Cookies()[0].MaxAge, "stale cookies are cleared")
+
+	// The last seen time is updated
+	_, err = db.Exec("update user_session set last_seen = '2000-01-01T00:00:00Z'")
+	require.NoError(t, err)
+	seen2, err := p.AuthenticateSession(nil, s.Token)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), seen2.LastSeen, time.Minute)
+
+	// Sessions are listed and revoked individually
+	other, err := p.IssueSession(nil, "42")
+	require.NoError(t, err)
+	third, err := p.IssueSession(nil, "42")
+	require.NoError(t, err)
+	sessions, err := p.ListSessions(nil, "42")
+	require.NoError(t, err)
+	require.Len(t, sessions, 3)
+	err = p.RevokeSession(nil, "43", other.ID)
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+	require.NoError(t, p.RevokeSession(nil, "42", other.ID))
+	_, err = p.AuthenticateSession(nil, other.Token)
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+
+	// Signing out ends the current session only
+	r = httptest.NewRequest(http.MethodGet, "/account/signout", nil)
+	rec = httptest.NewRecorder()
+	require.NoError(t, p.EndSession(WithUserSession(SetContext(nil, rec, r), seen2)))
+	require.Equal(t, -1, rec.Result().Cookies()[0].MaxAge)
+	require.Equal(t, http.StatusUnauthorized, get(cookie).Code)
+	_, err = p.AuthenticateSession(nil, third.Token)
+	require.NoError(t, err)
+
+	// Or all at once
+	require.NoError(t, p.RevokeSessions(nil, "42"))
+	_, err = p.AuthenticateSession(nil, third.Token)
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+
+	// Expired sessions are removed
+	p.SessionTTL = -time.Second
+	expired, err := p.IssueSession(nil, "42")
+	require.NoError(t, err)
+	_, err = p.AuthenticateSession(nil, expired.Token)
+	require.True(t, errors.Is(err, ErrSessionExpired))
+	_, err = p.AuthenticateSession(nil, expired.Token)
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+}
@@ -0,0 +1,440 @@
+// Package smtptest provides an in-process SMTP server for testing code
+// that sends email, in the spirit of net/http/httptest.
+package smtptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email received by the server.
+type Message struct {
+	From string
+	To   []string
+	// Data is the raw message, including headers
+	Data []byte
+	// User that authenticated the session, if any
+	User string
+	// TLS is true if the message was received over an encrypted connection
+	TLS bool
+}
+
+// Parse parses the message data.
+func (m Message) Parse() (*mail.Message, error) {
+	return mail.ReadMessage(bytes.NewReader(m.Data))
+}
+
+// Server is an SMTP server listening on a local loopback interface. It
+// captures received messages and records commands, and may be configured
+// to reject commands in order to test failure handling.
+type Server struct {
+	// Addr in the form "host:port"
+	Addr     string
+	Listener net.Listener
+
+	// Users that may authenticate with AUTH PLAIN, mapped to passwords.
+	// AUTH is not advertised if empty.
+	Users map[string]string
+	// Reject replies to the given commands with the mapped code. Use
+	// "GREETING" to reject connections and "." to reject message data.
+	Reject map[string]int
+
+	// TLS is the server configuration used for STARTTLS and implicit TLS
+	// connections, generated by StartTLS or StartImplicitTLS if nil.
+	TLS *tls.Config
+
+	certificate *x509.Certificate
+	startTLS    bool
+	mu          sync.Mutex
+	conns       map[net.Conn]bool
+	accepted    int
+	closed      int
+	commands    []string
+	messages    []Message
+	received    chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewServer starts and returns a new Server without encryption. The
+// caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server advertising STARTTLS with
+// a generated certificate. Use ClientTLSConfig to trust it.
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new Server but doesn't start it. After
+// changing its configuration, the caller should call Start, StartTLS or
+// StartImplicitTLS.
+func NewUnstartedServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+	}
+	return &Server{
+		Listener: l,
+		Addr:     l.Addr().String(),
+		conns:    map[net.Conn]bool{},
+		received: make(chan struct{}, 1),
+	}
+}
+
+// Start starts a server from NewUnstartedServer.
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.accept()
+}
+
+// StartTLS starts a server from NewUnstartedServer, advertising STARTTLS.
+func (s *Server) StartTLS() {
+	s.initTLS()
+	s.startTLS = true
+	s.Start()
+}
+
+// StartImplicitTLS starts a server from NewUnstartedServer that accepts
+// TLS connections only, as on port 465.
+func (s *Server) StartImplicitTLS() {
+	s.initTLS()
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.Start()
+}
+
+// Certificate returns the generated certificate used by the server, or nil
+// if the server doesn't use TLS.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// ClientTLSConfig returns a client configuration that trusts the server
+// certificate.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	if s.certificate != nil {
+		pool.AddCert(s.certificate)
+	}
+	return &tls.Config{RootCAs: pool}
+}
+
+// Close shuts down the server and closes all connections, blocking until
+// all connections have been handled.
+func (s *Server) Close() {
+	s.Listener.Close()
+	s.CloseClientConnections()
+	s.wg.Wait()
+}
+
+// CloseClientConnections closes all open connections without notifying
+// clients, simulating a dropped connection.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Conns returns the number of connections accepted and closed so far.
+func (s *Server) Conns() (accepted, closed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted, s.closed
+}
+
+// Commands returns the verbs of the commands received so far, e.g.
+// "EHLO" or "MAIL".
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message{}, s.messages...)
+}
+
+// WaitMessages blocks until at least n messages have been received, or the
+// timeout elapses, and returns the messages received.
+func (s *Server) WaitMessages(n int, timeout time.Duration) []Message {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		if m := s.Messages(); len(m) >= n {
+			return m
+		}
+		select {
+		case <-s.received:
+		case <-deadline.C:
+			return s.Messages()
+		}
+	}
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// session holds the state of a single connection.
+type session struct {
+	tp   *textproto.Conn
+	tls  bool
+	user string
+	from string
+	to   []string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		s.closed++
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	sess := &session{tp: textproto.NewConn(conn)}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		sess.tls = true
+	}
+	if code := s.Reject["GREETING"]; code != 0 {
+		sess.tp.PrintfLine("%d go away", code)
+		sess.tp.ReadLine()
+		return
+	}
+	sess.tp.PrintfLine("220 localhost ESMTP smtptest")
+
+	for {
+		line, err := sess.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		verb = strings.ToUpper(verb)
+		s.mu.Lock()
+		s.commands = append(s.commands, verb)
+		s.mu.Unlock()
+
+		if code := s.Reject[verb]; code != 0 {
+			sess.tp.PrintfLine("%d %s rejected", code, verb)
+			continue
+		}
+
+		switch verb {
+		case "EHLO", "HELO":
+			sess.from, sess.to = "", nil
+			s.hello(sess)
+		case "STARTTLS":
+			if !s.startTLS || sess.tls {
+				sess.tp.PrintfLine("502 not supported")
+				continue
+			}
+			sess.tp.PrintfLine("220 ready to start TLS")
+			tc := tls.Server(conn, s.TLS)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			sess.tp = textproto.NewConn(tc)
+			sess.tls = true
+		case "AUTH":
+			s.auth(sess, arg)
+		case "MAIL":
+			sess.from = addrArg(arg)
+			sess.to = nil
+			sess.tp.PrintfLine("250 ok")
+		case "RCPT":
+			if sess.from == "" {
+				sess.tp.PrintfLine("503 need MAIL first")
+				continue
+			}
+			sess.to = append(sess.to, addrArg(arg))
+			sess.tp.PrintfLine("250 ok")
+		case "DATA":
+			if len(sess.to) == 0 {
+				sess.tp.PrintfLine("503 need RCPT first")
+				continue
+			}
+			sess.tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := sess.tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if code := s.Reject["."]; code != 0 {
+				sess.tp.PrintfLine("%d message rejected", code)
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, Message{
+				From: sess.from,
+				To:   sess.to,
+				Data: bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")),
+				User: sess.user,
+				TLS:  sess.tls,
+			})
+			s.mu.Unlock()
+			select {
+			case s.received <- struct{}{}:
+			default:
+			}
+			sess.from, sess.to = "", nil
+			sess.tp.PrintfLine("250 queued")
+		case "RSET":
+			sess.from, sess.to = "", nil
+			sess.tp.PrintfLine("250 ok")
+		case "NOOP":
+			sess.tp.PrintfLine("250 ok")
+		case "QUIT":
+			sess.tp.PrintfLine("221 bye")
+			return
+		default:
+			sess.tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+func (s *Server) hello(sess *session) {
+	ext := []string{"localhost", "8BITMIME"}
+	if s.startTLS && !sess.tls {
+		ext = append(ext, "STARTTLS")
+	}
+	if len(s.Users) > 0 {
+		ext = append(ext, "AUTH PLAIN")
+	}
+	for i, e := range ext {
+		sep := "-"
+		if i == len(ext)-1 {
+			sep = " "
+		}
+		sess.tp.PrintfLine("250%s%s", sep, e)
+	}
+}
+
+func (s *Server) auth(sess *session, arg string) {
+	fields := strings.Fields(arg)
+	if len(s.Users) == 0 || len(fields) == 0 || !strings.EqualFold(fields[0], "PLAIN") {
+		sess.tp.PrintfLine("504 unrecognized authentication type")
+		return
+	}
+	resp := ""
+	if len(fields) > 1 {
+		resp = fields[1]
+	} else {
+		sess.tp.PrintfLine("334 ")
+		line, err := sess.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		resp = line
+	}
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		sess.tp.PrintfLine("501 malformed response")
+		return
+	}
+	// [authzid] NUL authcid NUL passwd
+	parts := strings.Split(string(b), "\x00")
+	if len(parts) != 3 {
+		sess.tp.PrintfLine("501 malformed response")
+		return
+	}
+	if pass, ok := s.Users[parts[1]]; !ok || pass != parts[2] {
+		sess.tp.PrintfLine("535 authentication failed")
+		return
+	}
+	sess.user = parts[1]
+	sess.tp.PrintfLine("235 authenticated")
+}
+
+// addrArg returns the address of a MAIL FROM or RCPT TO argument.
+func addrArg(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		if j := strings.IndexByte(arg[i:], '>'); j >= 0 {
+			return arg[i+1 : i+j]
+		}
+	}
+	if i := strings.IndexByte(arg, ':'); i >= 0 {
+		return strings.TrimSpace(arg[i+1:])
+	}
+	return arg
+}
+
+// initTLS generates a self-signed certificate for the loopback address if
+// no TLS configuration is set.
+func (s *Server) initTLS() {
+	if s.TLS != nil {
+		if len(s.TLS.Certificates) > 0 && len(s.TLS.Certificates[0].Certificate) > 0 {
+			s.certificate, _ = x509.ParseCertificate(s.TLS.Certificates[0].Certificate[0])
+		}
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to generate key: %v", err))
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "smtptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to create certificate: %v", err))
+	}
+	s.certificate, _ = x509.ParseCertificate(der)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+}
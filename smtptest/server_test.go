@@ -0,0 +1,142 @@
+package smtptest
+
+import (
+	"crypto/tls"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	msg := "Subject: Hello\r\n\r\nYour PIN is 1337\r\n"
+	require.NoError(t, smtp.SendMail(s.Addr, nil, "noreply@example.com",
+		[]string{"bender@ilovebender.com", "fry@planetexpress.com"}, []byte(msg)))
+
+	messages := s.WaitMessages(1, time.Second)
+	require.Len(t, messages, 1)
+	m := messages[0]
+	require.Equal(t, "noreply@example.com", m.From)
+	require.Equal(t, []string{"bender@ilovebender.com", "fry@planetexpress.com"}, m.To)
+	require.Equal(t, msg, string(m.Data))
+	require.False(t, m.TLS)
+	require.Empty(t, m.User)
+
+	pm, err := m.Parse()
+	require.NoError(t, err)
+	require.Equal(t, "Hello", pm.Header.Get("Subject"))
+
+	require.Equal(t, []string{"EHLO", "MAIL", "RCPT", "RCPT", "DATA", "QUIT"}, s.Commands())
+	require.Eventually(t, func() bool {
+		accepted, closed := s.Conns()
+		return accepted == 1 && closed == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerStartTLS(t *testing.T) {
+	s := NewUnstartedServer()
+	s.Users = map[string]string{"user": "pass"}
+	s.StartTLS()
+	defer s.Close()
+	require.NotNil(t, s.Certificate())
+
+	c, err := smtp.Dial(s.Addr)
+	require.NoError(t, err)
+	ok, _ := c.Extension("STARTTLS")
+	require.True(t, ok)
+	require.Error(t, c.StartTLS(&tls.Config{ServerName: "127.0.0.1"}),
+		"generated certificate should not be trusted by default")
+
+	config := s.ClientTLSConfig()
+	config.ServerName = "127.0.0.1"
+
+	// Bad credentials
+	c, err = smtp.Dial(s.Addr)
+	require.NoError(t, err)
+	require.NoError(t, c.StartTLS(config))
+	err = c.Auth(smtp.PlainAuth("", "user", "wrong", "127.0.0.1"))
+	var tpErr *textproto.Error
+	require.ErrorAs(t, err, &tpErr)
+	require.Equal(t, 535, tpErr.Code)
+
+	c, err = smtp.Dial(s.Addr)
+	require.NoError(t, err)
+	require.NoError(t, c.StartTLS(config))
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "user", "pass", "127.0.0.1")))
+	require.NoError(t, c.Mail("noreply@example.com"))
+	require.NoError(t, c.Rcpt("bender@ilovebender.com"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Hello\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	m := s.WaitMessages(1, time.Second)[0]
+	require.True(t, m.TLS)
+	require.Equal(t, "user", m.User)
+}
+
+func TestServerImplicitTLS(t *testing.T) {
+	s := NewUnstartedServer()
+	s.StartImplicitTLS()
+	defer s.Close()
+
+	config := s.ClientTLSConfig()
+	conn, err := tls.Dial("tcp", s.Addr, config)
+	require.NoError(t, err)
+	c, err := smtp.NewClient(conn, "127.0.0.1")
+	require.NoError(t, err)
+	ok, _ := c.Extension("STARTTLS")
+	require.False(t, ok)
+	require.NoError(t, c.Mail("noreply@example.com"))
+	require.NoError(t, c.Rcpt("bender@ilovebender.com"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	w.Write([]byte("Subject: Hello\r\n\r\nHi\r\n"))
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+	require.True(t, s.WaitMessages(1, time.Second)[0].TLS)
+}
+
+func TestServerReject(t *testing.T) {
+	s := NewUnstartedServer()
+	s.Reject = map[string]int{"RCPT": 550, ".": 552}
+	s.Start()
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("noreply@example.com"))
+	err = c.Rcpt("bender@ilovebender.com")
+	var tpErr *textproto.Error
+	require.ErrorAs(t, err, &tpErr)
+	require.Equal(t, 550, tpErr.Code)
+	require.NoError(t, c.Quit())
+	require.Empty(t, s.Messages())
+
+	s = NewUnstartedServer()
+	s.Reject = map[string]int{"GREETING": 554}
+	s.Start()
+	defer s.Close()
+	_, err = smtp.Dial(s.Addr)
+	require.ErrorAs(t, err, &tpErr)
+	require.Equal(t, 554, tpErr.Code)
+}
+
+func TestServerCloseClientConnections(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	require.NoError(t, err)
+	require.NoError(t, c.Noop())
+	s.CloseClientConnections()
+	require.Error(t, c.Noop())
+	c.Close()
+}
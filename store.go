@@ -14,7 +14,8 @@ var (
 	ErrTableNameNotValid    = errors.New("table name is not valid")
 )
 
-// TokenStore is a storage mechanism for tokens.
+// TokenStore is a storage mechanism for tokens. Tokens are stored per user
+// and purpose, where the purpose is given by `PurposeFromContext`.
 type TokenStore interface {
 	// Store securely stores the given token with the given expiry time
 	Store(ctx context.Context, token, uid string, ttl time.Duration) error
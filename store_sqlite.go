@@ -14,6 +14,7 @@ import (
 type Session struct {
 	TokenHash string
 	UID       string
+	Purpose   string
 	Expires   time.Time
 	Created   time.Time
 }
@@ -49,14 +50,16 @@ func NewSQLiteStore(db *sql.DB, tableName string) (store *SQLiteStore, err error
 	}, nil
 }
 
-// Store a generated token in SQLite for a user
+// Store a generated token in SQLite for a user, replacing any token for
+// the same purpose along with its binding and pending recipient, see
+// `WithBinding` and `WithPendingRecipient`.
 func (s SQLiteStore) Store(ctx context.Context, token, uid string, ttl time.Duration) (err error) {
-	query := fmt.Sprintf(
-		`insert into %s (uid, token, expires, created) values (:values)
-on conflict(uid) do update set 
+	update := `
 token = excluded.token, 
-expires = excluded.expires`,
-		s.tableName)
+expires = excluded.expires,
+created = excluded.created,
+binding = excluded.binding,
+recipient = excluded.recipient`
 
 	hashedToken, err := bcrypt.GenerateFromPassword(
 		[]byte(token), bcrypt.DefaultCost)
@@ -65,13 +68,24 @@ expires = excluded.expires`,
 	}
 
 	values := make([]interface{}, 0, 1)
-	row := make([]interface{}, 4)
+	row := make([]interface{}, 7)
 	row[0] = uid
 	row[1] = hashedToken
 	row[2] = time.Now().UTC().Add(ttl).Format(s.dateFormat)
 	row[3] = time.Now().UTC().Format(s.dateFormat)
+	row[4] = PurposeFromContext(ctx)
+	// Tokens without a binding or pending recipient must not keep those of
+	// the token they replace
+	row[5] = BindingFromContext(ctx)
+	row[6] = PendingRecipientFromContext(ctx)
 	values = append(values, row)
 
+	query := fmt.Sprintf(
+		`insert into %s (uid, token, expires, created, purpose, binding, recipient)
+values (:values)
+on conflict(uid, purpose) do update set %s`,
+		s.tableName, update)
+
 	query, _, err = sqlx.Named(query, map[string]interface{}{
 		"values": row,
 	})
@@ -96,7 +110,7 @@ expires = excluded.expires`,
 func (s SQLiteStore) Exists(ctx context.Context, uid string) (
 	exists bool, expires time.Time, err error) {
 
-	session, err := s.getSessionByUID(uid)
+	session, err := s.getSessionByUID(ctx, uid)
 	if err != nil {
 		return false, expires, errors.WithStack(err)
 	}
@@ -114,7 +128,7 @@ func (s SQLiteStore) Exists(ctx context.Context, uid string) (
 func (s SQLiteStore) Verify(ctx context.Context, token, uid string) (
 	valid bool, err error) {
 
-	session, err := s.getSessionByUID(uid)
+	session, err := s.getSessionByUID(ctx, uid)
 	if err != nil {
 		return false, errors.WithStack(err)
 	}
@@ -138,7 +152,8 @@ func (s SQLiteStore) Verify(ctx context.Context, token, uid string) (
 // Delete removes a key from the store
 func (s SQLiteStore) Delete(ctx context.Context, uid string) error {
 	r, err := s.db.Exec(
-		fmt.Sprintf("delete from %s where uid = ?", s.tableName), uid)
+		fmt.Sprintf("delete from %s where uid = ? and purpose = ?", s.tableName),
+		uid, PurposeFromContext(ctx))
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -152,10 +167,76 @@ func (s SQLiteStore) Delete(ctx context.Context, uid string) error {
 	return nil
 }
 
-func (s SQLiteStore) getSessionByUID(uid string) (session Session, err error) {
+// Binding returns the session the token stored for a user is bound to
+func (s SQLiteStore) Binding(ctx context.Context, uid string) (binding string, err error) {
+	err = s.db.QueryRow(
+		fmt.Sprintf("select binding from %s where uid = ? and purpose = ?",
+			s.tableName),
+		uid, PurposeFromContext(ctx)).Scan(&binding)
+	if err == sql.ErrNoRows {
+		return "", errors.WithStack(ErrTokenNotFound)
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return binding, nil
+}
+
+// ConsumePendingRecipient verifies the token stored for a user, and if it
+// is valid removes it, returning the recipient kept with it
+func (s SQLiteStore) ConsumePendingRecipient(ctx context.Context, token, uid string) (
+	recipient string, valid bool, err error) {
+
+	purpose := PurposeFromContext(ctx)
+	var hash []byte
+	var expires string
+	err = s.db.QueryRow(
+		fmt.Sprintf("select token, expires, recipient from %s where uid = ? and purpose = ?",
+			s.tableName),
+		uid, purpose).Scan(&hash, &expires, &recipient)
+	if err == sql.ErrNoRows {
+		return "", false, errors.WithStack(ErrTokenNotFound)
+	} else if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+
+	// Check token expiry
+	exp, err := time.Parse(DateFormatISO8601, expires)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	if time.Now().UTC().Unix() > exp.Unix() {
+		return "", false, errors.WithStack(ErrTokenExpired)
+	}
+
+	// Compare token hash
+	if bcrypt.CompareHashAndPassword(hash, []byte(token)) != nil {
+		return "", false, nil
+	}
+
+	// Only remove the token read above, so that the recipient returned is
+	// the one kept with it even if the token was replaced in between
+	r, err := s.db.Exec(
+		fmt.Sprintf("delete from %s where uid = ? and purpose = ? and token = ?",
+			s.tableName),
+		uid, purpose, hash)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return "", false, errors.WithStack(ErrTokenNotFound)
+	}
+	return recipient, true, nil
+}
+
+func (s SQLiteStore) getSessionByUID(ctx context.Context, uid string) (session Session, err error) {
+	purpose := PurposeFromContext(ctx)
 	rows, err := s.db.Query(fmt.Sprintf(
-		"select token, expires, created from %s where uid = ?",
-		s.tableName), uid)
+		"select token, expires, created from %s where uid = ? and purpose = ?",
+		s.tableName), uid, purpose)
 	if err != nil {
 		return session, errors.WithStack(err)
 	}
@@ -177,6 +258,7 @@ func (s SQLiteStore) getSessionByUID(uid string) (session Session, err error) {
 	}
 	session.TokenHash = token
 	session.UID = uid
+	session.Purpose = purpose
 	session.Expires, err = time.Parse(DateFormatISO8601, expires)
 	if err != nil {
 		return session, errors.WithStack(err)
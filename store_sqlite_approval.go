@@ -0,0 +1,105 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const ApprovalTableName = "approval"
+
+// SQLiteApprovalStore is an ApprovalStore that keeps approval requests in
+// SQLite. The table must exist, e.g.
+//
+//	create table approval (
+//		id varchar(64) primary key,
+//		poll_hash varchar(64) not null,
+//		uid string not null,
+//		status varchar(16) not null,
+//		ip varchar(64) not null,
+//		user_agent text not null,
+//		expires datetime not null,
+//		created datetime not null
+//	);
+type SQLiteApprovalStore struct {
+	db *sql.DB
+	// tableName for approval table
+	tableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteApprovalStore creates and returns a new SQLiteApprovalStore
+func NewSQLiteApprovalStore(db *sql.DB, tableName string) (*SQLiteApprovalStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = ApprovalTableName
+	}
+	return &SQLiteApprovalStore{
+		db:         db,
+		tableName:  tableName,
+		dateFormat: DateFormatISO8601,
+	}, nil
+}
+
+// CreateApproval inserts a new approval request
+func (s SQLiteApprovalStore) CreateApproval(ctx context.Context, a *Approval) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (id, poll_hash, uid, status, ip, user_agent, expires, created)
+values (?, ?, ?, ?, ?, ?, ?, ?)`, s.tableName),
+		a.ID, a.PollHash, a.UID, string(a.Status), a.IP, a.UserAgent,
+		a.Expires.UTC().Format(s.dateFormat), a.Created.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// GetApproval returns the approval request with the given ID
+func (s SQLiteApprovalStore) GetApproval(ctx context.Context, id string) (*Approval, error) {
+	a := &Approval{ID: id}
+	var status, expires, created string
+	err := s.db.QueryRow(fmt.Sprintf(
+		"select poll_hash, uid, status, ip, user_agent, expires, created from %s where id = ?",
+		s.tableName), id).Scan(
+		&a.PollHash, &a.UID, &status, &a.IP, &a.UserAgent, &expires, &created)
+	if err == sql.ErrNoRows {
+		return nil, errors.WithStack(ErrApprovalNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	a.Status = ApprovalStatus(status)
+	if a.Expires, err = time.Parse(s.dateFormat, expires); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if a.Created, err = time.Parse(s.dateFormat, created); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return a, nil
+}
+
+// TransitionApproval atomically changes the status of an approval request
+func (s SQLiteApprovalStore) TransitionApproval(ctx context.Context, id string, from, to ApprovalStatus) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set status = ? where id = ? and status = ?", s.tableName),
+		string(to), id, string(from))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		if _, err := s.GetApproval(ctx, id); err != nil {
+			return err
+		}
+		return errors.WithStack(ErrApprovalStatusChanged)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createApprovalTable(db *sql.DB) error {
+	_, err := db.Exec(`create table approval (
+	id varchar(64) primary key,
+	poll_hash varchar(64) not null,
+	uid string not null,
+	status varchar(16) not null,
+	ip varchar(64) not null,
+	user_agent text not null,
+	expires datetime not null,
+	created datetime not null
+);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteApprovalStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createApprovalTable(db))
+	_, err = NewSQLiteApprovalStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteApprovalStore(db, "")
+	require.NoError(t, err)
+
+	_, err = s.GetApproval(nil, "abc")
+	require.True(t, errors.Is(err, ErrApprovalNotFound))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	a := &Approval{
+		ID:        "abc",
+		PollHash:  hashPollSecret("secret"),
+		UID:       "42",
+		Status:    ApprovalPending,
+		IP:        "192.0.2.1",
+		UserAgent: "Mozilla/5.0",
+		Expires:   now.Add(time.Minute),
+		Created:   now,
+	}
+	require.NoError(t, s.CreateApproval(nil, a))
+	a2, err := s.GetApproval(nil, "abc")
+	require.NoError(t, err)
+	require.Equal(t, a, a2)
+
+	require.NoError(t, s.TransitionApproval(nil, "abc", ApprovalPending, ApprovalApproved))
+	a2, err = s.GetApproval(nil, "abc")
+	require.NoError(t, err)
+	require.Equal(t, ApprovalApproved, a2.Status)
+	require.Equal(t, "42", a2.UID)
+
+	// Transitions happen once
+	err = s.TransitionApproval(nil, "abc", ApprovalPending, ApprovalDenied)
+	require.True(t, errors.Is(err, ErrApprovalStatusChanged))
+	require.NoError(t, s.TransitionApproval(nil, "abc", ApprovalApproved, ApprovalCompleted))
+	a2, err = s.GetApproval(nil, "abc")
+	require.NoError(t, err)
+	require.Equal(t, ApprovalCompleted, a2.Status)
+
+	err = s.TransitionApproval(nil, "xyz", ApprovalPending, ApprovalDenied)
+	require.True(t, errors.Is(err, ErrApprovalNotFound))
+}
@@ -0,0 +1,128 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const OIDCClientTableName = "oidc_client"
+
+// SQLiteOIDCClientStore is an OIDCClientStore that keeps registered clients
+// in SQLite. Client secrets are hashed with bcrypt. The table must exist,
+// e.g.
+//
+//	create table oidc_client (
+//		id varchar(64) primary key,
+//		name varchar(255) not null,
+//		secret varchar(255) not null,
+//		redirect_uris text not null,
+//		created datetime not null
+//	);
+type SQLiteOIDCClientStore struct {
+	db *sql.DB
+	// tableName for clients table
+	tableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteOIDCClientStore creates and returns a new SQLiteOIDCClientStore
+func NewSQLiteOIDCClientStore(db *sql.DB, tableName string) (*SQLiteOIDCClientStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = OIDCClientTableName
+	}
+	return &SQLiteOIDCClientStore{
+		db:         db,
+		tableName:  tableName,
+		dateFormat: DateFormatISO8601,
+	}, nil
+}
+
+// CreateClient inserts a new client, hashing the secret unless the client
+// is public
+func (s SQLiteOIDCClientStore) CreateClient(ctx context.Context, c *OIDCClient, secret string) error {
+	hash := []byte{}
+	if !c.Public {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword(
+			[]byte(secret), bcrypt.DefaultCost); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	// Redirect URIs can't contain spaces
+	_, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (id, name, secret, redirect_uris, created)
+values (?, ?, ?, ?, ?)`, s.tableName),
+		c.ID, c.Name, string(hash), strings.Join(c.RedirectURIs, " "),
+		c.Created.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// GetClient returns the client with the given ID
+func (s SQLiteOIDCClientStore) GetClient(ctx context.Context, id string) (*OIDCClient, error) {
+	c := &OIDCClient{ID: id}
+	var secret, redirectURIs, created string
+	err := s.db.QueryRow(fmt.Sprintf(
+		"select name, secret, redirect_uris, created from %s where id = ?",
+		s.tableName), id).Scan(&c.Name, &secret, &redirectURIs, &created)
+	if err == sql.ErrNoRows {
+		return nil, errors.WithStack(ErrOIDCClientNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.Public = secret == ""
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	if c.Created, err = time.Parse(s.dateFormat, created); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return c, nil
+}
+
+// VerifyClientSecret compares the secret with the hash stored for a
+// confidential client
+func (s SQLiteOIDCClientStore) VerifyClientSecret(ctx context.Context, id, secret string) (bool, error) {
+	var hash string
+	err := s.db.QueryRow(fmt.Sprintf(
+		"select secret from %s where id = ?", s.tableName), id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, errors.WithStack(ErrOIDCClientNotFound)
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if hash == "" {
+		return false, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// DeleteClient removes a client
+func (s SQLiteOIDCClientStore) DeleteClient(ctx context.Context, id string) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where id = ?", s.tableName), id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrOIDCClientNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createOIDCClientTable(db *sql.DB) error {
+	_, err := db.Exec(`create table oidc_client (
+	id varchar(64) primary key,
+	name varchar(255) not null,
+	secret varchar(255) not null,
+	redirect_uris text not null,
+	created datetime not null
+);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteOIDCClientStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOIDCClientTable(db))
+	_, err = NewSQLiteOIDCClientStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteOIDCClientStore(db, "")
+	require.NoError(t, err)
+
+	_, err = s.GetClient(nil, "abc")
+	require.True(t, errors.Is(err, ErrOIDCClientNotFound))
+	_, err = s.VerifyClientSecret(nil, "abc", "secret")
+	require.True(t, errors.Is(err, ErrOIDCClientNotFound))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	a := &OIDCClient{
+		ID:           "a",
+		Name:         "Wiki",
+		RedirectURIs: []string{"https://wiki.example.com/callback", "http://localhost:8080/cb?x=1,2"},
+		Created:      now,
+	}
+	require.NoError(t, s.CreateClient(nil, a, "secret"))
+	require.Error(t, s.CreateClient(nil, a, "secret"))
+	b := &OIDCClient{
+		ID:           "b",
+		Name:         "App",
+		RedirectURIs: []string{"com.example.app:/callback"},
+		Public:       true,
+		Created:      now,
+	}
+	require.NoError(t, s.CreateClient(nil, b, ""))
+
+	c, err := s.GetClient(nil, "a")
+	require.NoError(t, err)
+	require.Equal(t, a, c)
+	c, err = s.GetClient(nil, "b")
+	require.NoError(t, err)
+	require.Equal(t, b, c)
+
+	// Secrets are compared with the hash, public clients have none
+	valid, err := s.VerifyClientSecret(nil, "a", "secret")
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = s.VerifyClientSecret(nil, "a", "wrong")
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = s.VerifyClientSecret(nil, "b", "")
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	require.NoError(t, s.DeleteClient(nil, "a"))
+	require.True(t, errors.Is(s.DeleteClient(nil, "a"), ErrOIDCClientNotFound))
+	_, err = s.GetClient(nil, "a")
+	require.True(t, errors.Is(err, ErrOIDCClientNotFound))
+}
@@ -0,0 +1,184 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const CredentialTableName = "credential"
+
+// WebAuthnUserHandleSize is the size in bytes of generated user handles.
+const WebAuthnUserHandleSize = 32
+
+// SQLiteCredentialStore is a CredentialStore that keeps WebAuthn
+// credentials in SQLite. User handles are kept in a second table, named
+// after the first with a "_user" suffix. The tables must exist, e.g.
+//
+//	create table credential (
+//		id varchar(255) primary key,
+//		uid string not null,
+//		public_key blob not null,
+//		sign_count integer not null default 0,
+//		transports varchar(255) not null default '',
+//		created datetime not null,
+//		last_used datetime not null
+//	);
+//	create index credential_uid on credential (uid);
+//	create table credential_user (
+//		uid string primary key,
+//		handle varchar(64) not null unique
+//	);
+type SQLiteCredentialStore struct {
+	db *sql.DB
+	// tableName for credentials table
+	tableName string
+	// userTableName for user handles table
+	userTableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteCredentialStore creates and returns a new SQLiteCredentialStore
+func NewSQLiteCredentialStore(db *sql.DB, tableName string) (*SQLiteCredentialStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = CredentialTableName
+	}
+	return &SQLiteCredentialStore{
+		db:            db,
+		tableName:     tableName,
+		userTableName: tableName + "_user",
+		dateFormat:    DateFormatISO8601,
+	}, nil
+}
+
+// AddCredential inserts a new credential
+func (s SQLiteCredentialStore) AddCredential(ctx context.Context, c *Credential) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (id, uid, public_key, sign_count, transports, created, last_used)
+values (?, ?, ?, ?, ?, ?, ?)
+on conflict (id) do nothing`, s.tableName),
+		base64.RawURLEncoding.EncodeToString(c.ID), c.UID, c.PublicKey,
+		int64(c.SignCount), strings.Join(c.Transports, ","),
+		c.Created.UTC().Format(s.dateFormat), c.LastUsed.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrCredentialExists)
+	}
+	return nil
+}
+
+// Credentials returns the credentials of a user, oldest first
+func (s SQLiteCredentialStore) Credentials(ctx context.Context, uid string) ([]*Credential, error) {
+	rows, err := s.db.Query(fmt.Sprintf(
+		`select id, public_key, sign_count, transports, created, last_used
+from %s where uid = ? order by created, id`, s.tableName), uid)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	creds := []*Credential{}
+	for rows.Next() {
+		c := &Credential{UID: uid}
+		var id, transports, created, lastUsed string
+		var signCount int64
+		if err := rows.Scan(&id, &c.PublicKey, &signCount, &transports,
+			&created, &lastUsed); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if c.ID, err = base64.RawURLEncoding.DecodeString(id); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.SignCount = uint32(signCount)
+		if transports != "" {
+			c.Transports = strings.Split(transports, ",")
+		}
+		if c.Created, err = time.Parse(s.dateFormat, created); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if c.LastUsed, err = time.Parse(s.dateFormat, lastUsed); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		creds = append(creds, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return creds, nil
+}
+
+// UpdateCredential sets the sign count and last use of a credential
+func (s SQLiteCredentialStore) UpdateCredential(ctx context.Context, uid string, id []byte, signCount uint32, lastUsed time.Time) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set sign_count = ?, last_used = ? where id = ? and uid = ?",
+		s.tableName),
+		int64(signCount), lastUsed.UTC().Format(s.dateFormat),
+		base64.RawURLEncoding.EncodeToString(id), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.checkFound(r)
+}
+
+// DeleteCredential removes a credential of a user
+func (s SQLiteCredentialStore) DeleteCredential(ctx context.Context, uid string, id []byte) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where id = ? and uid = ?", s.tableName),
+		base64.RawURLEncoding.EncodeToString(id), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.checkFound(r)
+}
+
+// UserHandle returns the user handle of a user, creating it if needed
+func (s SQLiteCredentialStore) UserHandle(ctx context.Context, uid string) ([]byte, error) {
+	b := make([]byte, WebAuthnUserHandleSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err := s.db.Exec(fmt.Sprintf(
+		"insert into %s (uid, handle) values (?, ?) on conflict (uid) do nothing",
+		s.userTableName), uid, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var handle string
+	if err := s.db.QueryRow(fmt.Sprintf(
+		"select handle from %s where uid = ?", s.userTableName),
+		uid).Scan(&handle); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b, err = base64.RawURLEncoding.DecodeString(handle)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+// checkFound returns ErrCredentialNotFound if no rows were affected
+func (s SQLiteCredentialStore) checkFound(r sql.Result) error {
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrCredentialNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createCredentialTable(db *sql.DB) error {
+	_, err := db.Exec(`create table credential (
+	id varchar(255) primary key,
+	uid string not null,
+	public_key blob not null,
+	sign_count integer not null default 0,
+	transports varchar(255) not null default '',
+	created datetime not null,
+	last_used datetime not null
+);
+create index credential_uid on credential (uid);
+create table credential_user (
+	uid string primary key,
+	handle varchar(64) not null unique
+);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteCredentialStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createCredentialTable(db))
+	_, err = NewSQLiteCredentialStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteCredentialStore(db, "")
+	require.NoError(t, err)
+
+	creds, err := s.Credentials(nil, "42")
+	require.NoError(t, err)
+	require.Empty(t, creds)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	c := &Credential{
+		ID:         []byte{1, 2, 3},
+		UID:        "42",
+		PublicKey:  []byte{0xa0},
+		SignCount:  7,
+		Transports: []string{"usb", "nfc"},
+		Created:    now,
+		LastUsed:   now,
+	}
+	require.NoError(t, s.AddCredential(nil, c))
+	err = s.AddCredential(nil, &Credential{ID: c.ID, UID: "43", PublicKey: []byte{0xa0}})
+	require.True(t, errors.Is(err, ErrCredentialExists))
+	creds, err = s.Credentials(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, []*Credential{c}, creds)
+
+	later := now.Add(time.Hour)
+	require.NoError(t, s.UpdateCredential(nil, "42", c.ID, 8, later))
+	creds, err = s.Credentials(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, uint32(8), creds[0].SignCount)
+	require.Equal(t, later, creds[0].LastUsed)
+
+	// Credentials of other users can't be changed
+	err = s.UpdateCredential(nil, "43", c.ID, 9, later)
+	require.True(t, errors.Is(err, ErrCredentialNotFound))
+	err = s.DeleteCredential(nil, "43", c.ID)
+	require.True(t, errors.Is(err, ErrCredentialNotFound))
+
+	require.NoError(t, s.DeleteCredential(nil, "42", c.ID))
+	creds, err = s.Credentials(nil, "42")
+	require.NoError(t, err)
+	require.Empty(t, creds)
+
+	// User handles are random, and kept per user
+	h, err := s.UserHandle(nil, "42")
+	require.NoError(t, err)
+	require.Len(t, h, WebAuthnUserHandleSize)
+	h2, err := s.UserHandle(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, h, h2)
+	h2, err = s.UserHandle(nil, "43")
+	require.NoError(t, err)
+	require.NotEqual(t, h, h2)
+}
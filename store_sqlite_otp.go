@@ -0,0 +1,194 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TOTPTableName = "totp"
+	HOTPTableName = "hotp"
+)
+
+// SQLiteOTPStore is an OTPStore that keeps authenticator secrets in SQLite,
+// alongside the session table. Use a separate table for each strategy,
+// e.g. TOTPTableName and HOTPTableName. The table must exist, e.g.
+//
+//	create table totp (
+//		uid string primary key,
+//		secret varchar(128) not null default '',
+//		pending varchar(128) not null default '',
+//		counter integer not null default 0,
+//		failures integer not null default 0,
+//		failed datetime not null default '',
+//		created datetime not null
+//	);
+type SQLiteOTPStore struct {
+	db *sql.DB
+	// tableName for secrets table
+	tableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteOTPStore creates and returns a new SQLiteOTPStore. The table
+// name defaults to TOTPTableName.
+func NewSQLiteOTPStore(db *sql.DB, tableName string) (*SQLiteOTPStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = TOTPTableName
+	}
+	return &SQLiteOTPStore{
+		db:         db,
+		tableName:  tableName,
+		dateFormat: DateFormatISO8601,
+	}, nil
+}
+
+// SetOTPSecret upserts the pending secret of a user
+func (s SQLiteOTPStore) SetOTPSecret(ctx context.Context, uid string, secret []byte) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (uid, pending, created) values (?, ?, ?)
+on conflict (uid) do update set
+pending = excluded.pending`, s.tableName),
+		uid, base32.StdEncoding.EncodeToString(secret),
+		time.Now().UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// PendingOTPSecret returns the pending secret of a user
+func (s SQLiteOTPStore) PendingOTPSecret(ctx context.Context, uid string) ([]byte, error) {
+	var enc string
+	err := s.db.QueryRow(fmt.Sprintf(
+		"select pending from %s where uid = ?", s.tableName),
+		uid).Scan(&enc)
+	if err == sql.ErrNoRows || (err == nil && enc == "") {
+		return nil, errors.WithStack(ErrOTPNotEnrolled)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	secret, err := base32.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return secret, nil
+}
+
+// ActivateOTPSecret atomically replaces the secret of a user with the
+// pending one
+func (s SQLiteOTPStore) ActivateOTPSecret(ctx context.Context, uid string, counter uint64) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		`update %s set secret = pending, pending = '', counter = ?, failures = 0,
+created = ? where uid = ? and pending != ''`, s.tableName),
+		int64(counter), time.Now().UTC().Format(s.dateFormat), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrOTPNotEnrolled)
+	}
+	return nil
+}
+
+// OTPSecret returns the secret and counter of a user
+func (s SQLiteOTPStore) OTPSecret(ctx context.Context, uid string) ([]byte, uint64, error) {
+	var enc string
+	var counter int64
+	err := s.db.QueryRow(fmt.Sprintf(
+		"select secret, counter from %s where uid = ?", s.tableName),
+		uid).Scan(&enc, &counter)
+	if err == sql.ErrNoRows || (err == nil && enc == "") {
+		return nil, 0, errors.WithStack(ErrOTPNotEnrolled)
+	} else if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	secret, err := base32.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return secret, uint64(counter), nil
+}
+
+// AdvanceOTPCounter atomically raises the counter of a user
+func (s SQLiteOTPStore) AdvanceOTPCounter(ctx context.Context, uid string, counter uint64) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set counter = ?, failures = 0 where uid = ? and counter < ?",
+		s.tableName),
+		int64(counter), uid, int64(counter))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		if _, _, err := s.OTPSecret(ctx, uid); err != nil {
+			return err
+		}
+		return errors.WithStack(ErrOTPCodeReused)
+	}
+	return nil
+}
+
+// AddOTPFailure counts a failed code of a user
+func (s SQLiteOTPStore) AddOTPFailure(ctx context.Context, uid string, at time.Time) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set failures = failures + 1, failed = ? where uid = ?",
+		s.tableName),
+		at.UTC().Format(s.dateFormat), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrOTPNotEnrolled)
+	}
+	return nil
+}
+
+// OTPFailures returns the failed codes of a user since the last accepted one
+func (s SQLiteOTPStore) OTPFailures(ctx context.Context, uid string) (failures int, failed time.Time, err error) {
+	var at string
+	err = s.db.QueryRow(fmt.Sprintf(
+		"select failures, failed from %s where uid = ?", s.tableName),
+		uid).Scan(&failures, &at)
+	if err == sql.ErrNoRows {
+		return 0, failed, errors.WithStack(ErrOTPNotEnrolled)
+	} else if err != nil {
+		return 0, failed, errors.WithStack(err)
+	}
+	if at != "" {
+		if failed, err = time.Parse(s.dateFormat, at); err != nil {
+			return 0, failed, errors.WithStack(err)
+		}
+	}
+	return failures, failed, nil
+}
+
+// DeleteOTPSecret removes the secrets of a user
+func (s SQLiteOTPStore) DeleteOTPSecret(ctx context.Context, uid string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where uid = ?", s.tableName), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
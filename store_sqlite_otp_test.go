@@ -0,0 +1,101 @@
+package passwordless
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createOTPTable(db *sql.DB, tableName string) error {
+	_, err := db.Exec(fmt.Sprintf(`create table %s (
+	uid string primary key,
+	secret varchar(128) not null default '',
+	pending varchar(128) not null default '',
+	counter integer not null default 0,
+	failures integer not null default 0,
+	failed datetime not null default '',
+	created datetime not null
+);`, tableName))
+	return errors.WithStack(err)
+}
+
+func TestSQLiteOTPStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOTPTable(db, TOTPTableName))
+	_, err = NewSQLiteOTPStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteOTPStore(db, "")
+	require.NoError(t, err)
+
+	_, _, err = s.OTPSecret(nil, "42")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	err = s.AdvanceOTPCounter(nil, "42", 1)
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	_, _, err = s.OTPFailures(nil, "42")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	err = s.ActivateOTPSecret(nil, "42", 0)
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+
+	// Secrets are pending until activated
+	require.NoError(t, s.SetOTPSecret(nil, "42", []byte("secret")))
+	_, _, err = s.OTPSecret(nil, "42")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	pending, err := s.PendingOTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), pending)
+	require.NoError(t, s.ActivateOTPSecret(nil, "42", 0))
+	_, err = s.PendingOTPSecret(nil, "42")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	secret, counter, err := s.OTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), secret)
+	require.Equal(t, uint64(0), counter)
+
+	// Failures are counted until a code is accepted
+	failures, _, err := s.OTPFailures(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 0, failures)
+	at := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, s.AddOTPFailure(nil, "42", at.Add(-time.Second)))
+	require.NoError(t, s.AddOTPFailure(nil, "42", at))
+	failures, failed, err := s.OTPFailures(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, failures)
+	require.Equal(t, at, failed)
+	err = s.AddOTPFailure(nil, "43", at)
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+
+	// The counter only moves forward
+	require.NoError(t, s.AdvanceOTPCounter(nil, "42", 5))
+	err = s.AdvanceOTPCounter(nil, "42", 5)
+	require.True(t, errors.Is(err, ErrOTPCodeReused))
+	err = s.AdvanceOTPCounter(nil, "42", 3)
+	require.True(t, errors.Is(err, ErrOTPCodeReused))
+	_, counter, err = s.OTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), counter)
+	failures, _, err = s.OTPFailures(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 0, failures)
+
+	// Enrolling again keeps the active secret until activated, which sets
+	// the counter
+	require.NoError(t, s.SetOTPSecret(nil, "42", []byte("other")))
+	secret, _, err = s.OTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), secret)
+	require.NoError(t, s.ActivateOTPSecret(nil, "42", 2))
+	secret, counter, err = s.OTPSecret(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), secret)
+	require.Equal(t, uint64(2), counter)
+
+	require.NoError(t, s.DeleteOTPSecret(nil, "42"))
+	_, _, err = s.OTPSecret(nil, "42")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+}
@@ -0,0 +1,170 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const RecoveryCodeTableName = "recovery_code"
+
+// SQLiteRecoveryCodeStore is a RecoveryCodeStore that keeps hashes of
+// recovery codes in SQLite. Failed codes are counted in a second table,
+// named after the first with a "_failure" suffix. The tables must exist,
+// e.g.
+//
+//	create table recovery_code (
+//		uid string not null,
+//		hash varchar(64) not null,
+//		created datetime not null,
+//		primary key (uid, hash)
+//	);
+//	create table recovery_code_failure (
+//		uid string primary key,
+//		failures integer not null,
+//		failed datetime not null
+//	);
+type SQLiteRecoveryCodeStore struct {
+	db *sql.DB
+	// tableName for recovery codes table
+	tableName string
+	// failureTableName for failed codes table
+	failureTableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteRecoveryCodeStore creates and returns a new
+// SQLiteRecoveryCodeStore
+func NewSQLiteRecoveryCodeStore(db *sql.DB, tableName string) (*SQLiteRecoveryCodeStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = RecoveryCodeTableName
+	}
+	return &SQLiteRecoveryCodeStore{
+		db:               db,
+		tableName:        tableName,
+		failureTableName: tableName + "_failure",
+		dateFormat:       DateFormatISO8601,
+	}, nil
+}
+
+// SetRecoveryCodes replaces the codes of a user in a transaction
+func (s SQLiteRecoveryCodeStore) SetRecoveryCodes(ctx context.Context, uid string, hashes []string) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if _, err = tx.Exec(fmt.Sprintf(
+		"delete from %s where uid = ?", s.tableName), uid); err != nil {
+		return errors.WithStack(err)
+	}
+	created := time.Now().UTC().Format(s.dateFormat)
+	for _, hash := range hashes {
+		if _, err = tx.Exec(fmt.Sprintf(
+			"insert into %s (uid, hash, created) values (?, ?, ?)", s.tableName),
+			uid, hash, created); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// RecoveryCodeHashes returns the hashes of the codes of a user
+func (s SQLiteRecoveryCodeStore) RecoveryCodeHashes(ctx context.Context, uid string) ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf(
+		"select hash from %s where uid = ?", s.tableName), uid)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return hashes, nil
+}
+
+// ConsumeRecoveryCode atomically removes a code of a user, and resets
+// failures
+func (s SQLiteRecoveryCodeStore) ConsumeRecoveryCode(ctx context.Context, uid, hash string) (bool, error) {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where uid = ? and hash = ?", s.tableName), uid, hash)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return false, nil
+	}
+	_, err = s.db.Exec(fmt.Sprintf(
+		"delete from %s where uid = ?", s.failureTableName), uid)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// RecoveryCodesRemaining counts the codes of a user
+func (s SQLiteRecoveryCodeStore) RecoveryCodesRemaining(ctx context.Context, uid string) (n int, err error) {
+	err = s.db.QueryRow(fmt.Sprintf(
+		"select count(*) from %s where uid = ?", s.tableName), uid).Scan(&n)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// AddRecoveryCodeFailure counts a failed code of a user
+func (s SQLiteRecoveryCodeStore) AddRecoveryCodeFailure(ctx context.Context, uid string, at time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (uid, failures, failed) values (?, 1, ?)
+on conflict(uid) do update set failures = failures + 1, failed = excluded.failed`,
+		s.failureTableName),
+		uid, at.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// RecoveryCodeFailures returns the failed codes of a user since the last
+// accepted one
+func (s SQLiteRecoveryCodeStore) RecoveryCodeFailures(ctx context.Context, uid string) (failures int, failed time.Time, err error) {
+	var at string
+	err = s.db.QueryRow(fmt.Sprintf(
+		"select failures, failed from %s where uid = ?", s.failureTableName),
+		uid).Scan(&failures, &at)
+	if err == sql.ErrNoRows {
+		return 0, failed, nil
+	} else if err != nil {
+		return 0, failed, errors.WithStack(err)
+	}
+	if failed, err = time.Parse(s.dateFormat, at); err != nil {
+		return 0, failed, errors.WithStack(err)
+	}
+	return failures, failed, nil
+}
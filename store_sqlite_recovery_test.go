@@ -0,0 +1,101 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createRecoveryCodeTable(db *sql.DB) error {
+	_, err := db.Exec(`create table recovery_code (
+	uid string not null,
+	hash varchar(64) not null,
+	created datetime not null,
+	primary key (uid, hash)
+);
+create table recovery_code_failure (
+	uid string primary key,
+	failures integer not null,
+	failed datetime not null
+);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteRecoveryCodeStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createRecoveryCodeTable(db))
+	_, err = NewSQLiteRecoveryCodeStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteRecoveryCodeStore(db, "")
+	require.NoError(t, err)
+
+	n, err := s.RecoveryCodesRemaining(nil, "42")
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.NoError(t, s.SetRecoveryCodes(nil, "42", []string{"a", "b", "c"}))
+	require.NoError(t, s.SetRecoveryCodes(nil, "43", []string{"a"}))
+	n, err = s.RecoveryCodesRemaining(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	hashes, err := s.RecoveryCodeHashes(nil, "42")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b", "c"}, hashes)
+
+	ok, err := s.ConsumeRecoveryCode(nil, "42", "b")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s.ConsumeRecoveryCode(nil, "42", "b")
+	require.NoError(t, err)
+	require.False(t, ok)
+	n, err = s.RecoveryCodesRemaining(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	hashes, err = s.RecoveryCodeHashes(nil, "44")
+	require.NoError(t, err)
+	require.Empty(t, hashes)
+
+	// Setting codes replaces the remaining ones, duplicates fail as a whole
+	err = s.SetRecoveryCodes(nil, "42", []string{"d", "d"})
+	require.Error(t, err)
+	n, err = s.RecoveryCodesRemaining(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, s.SetRecoveryCodes(nil, "42", []string{"d"}))
+	ok, err = s.ConsumeRecoveryCode(nil, "42", "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Other users are not affected
+	n, err = s.RecoveryCodesRemaining(nil, "43")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Failures are counted until a code is used
+	failures, _, err := s.RecoveryCodeFailures(nil, "42")
+	require.NoError(t, err)
+	require.Zero(t, failures)
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, s.AddRecoveryCodeFailure(nil, "42", now.Add(-time.Minute)))
+	require.NoError(t, s.AddRecoveryCodeFailure(nil, "42", now))
+	failures, failed, err := s.RecoveryCodeFailures(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, failures)
+	require.Equal(t, now, failed)
+	ok, err = s.ConsumeRecoveryCode(nil, "42", "a")
+	require.NoError(t, err)
+	require.False(t, ok)
+	failures, _, err = s.RecoveryCodeFailures(nil, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, failures)
+	ok, err = s.ConsumeRecoveryCode(nil, "42", "d")
+	require.NoError(t, err)
+	require.True(t, ok)
+	failures, _, err = s.RecoveryCodeFailures(nil, "42")
+	require.NoError(t, err)
+	require.Zero(t, failures)
+}
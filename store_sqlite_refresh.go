@@ -0,0 +1,164 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const RefreshTokenTableName = "refresh_token"
+
+// SQLiteRefreshTokenStore is a RefreshTokenStore that keeps refresh tokens
+// in SQLite, hashed with bcrypt like SQLiteStore. Used tokens are kept
+// until their family expires, to detect reuse, and expired families are
+// purged whenever a token is stored. The table must exist, e.g.
+//
+//	create table refresh_token (
+//		id varchar(32) primary key,
+//		family varchar(32) not null,
+//		uid string not null,
+//		token varchar(255) not null,
+//		expires datetime not null,
+//		family_expires datetime not null,
+//		used datetime not null default '',
+//		created datetime not null
+//	);
+//	create index refresh_token_family on refresh_token (family);
+//	create index refresh_token_uid on refresh_token (uid);
+type SQLiteRefreshTokenStore struct {
+	db *sql.DB
+	// tableName for refresh tokens table
+	tableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteRefreshTokenStore creates and returns a new
+// SQLiteRefreshTokenStore
+func NewSQLiteRefreshTokenStore(db *sql.DB, tableName string) (*SQLiteRefreshTokenStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = RefreshTokenTableName
+	}
+	return &SQLiteRefreshTokenStore{
+		db:         db,
+		tableName:  tableName,
+		dateFormat: DateFormatISO8601,
+	}, nil
+}
+
+// StoreRefreshToken inserts a token with the bcrypt hash of its secret,
+// after purging expired families
+func (s SQLiteRefreshTokenStore) StoreRefreshToken(ctx context.Context, t *RefreshToken, secret string) error {
+	hashedToken, err := bcrypt.GenerateFromPassword(
+		[]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := s.purge(time.Now()); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf(
+		`insert into %s (id, family, uid, token, expires, family_expires, created)
+values (?, ?, ?, ?, ?, ?, ?)`, s.tableName),
+		t.ID, t.Family, t.UID, hashedToken,
+		t.Expires.UTC().Format(s.dateFormat),
+		t.FamilyExpires.UTC().Format(s.dateFormat),
+		t.Created.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// purge removes families past their absolute expiry, or whose latest token
+// expired unused. Used tokens of live families are kept to detect reuse.
+func (s SQLiteRefreshTokenStore) purge(now time.Time) error {
+	at := now.UTC().Format(s.dateFormat)
+	_, err := s.db.Exec(fmt.Sprintf(
+		`delete from %[1]s where family_expires < ? or family in (
+	select family from %[1]s group by family having max(expires) < ?)`,
+		s.tableName), at, at)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// VerifyRefreshToken compares the secret with the hash of the token
+func (s SQLiteRefreshTokenStore) VerifyRefreshToken(ctx context.Context, id, secret string) (*RefreshToken, error) {
+	t := &RefreshToken{ID: id}
+	var hash []byte
+	var expires, familyExpires, used, created string
+	err := s.db.QueryRow(fmt.Sprintf(
+		`select family, uid, token, expires, family_expires, used, created
+from %s where id = ?`, s.tableName), id).Scan(
+		&t.Family, &t.UID, &hash, &expires, &familyExpires, &used, &created)
+	if err == sql.ErrNoRows {
+		return nil, errors.WithStack(ErrRefreshTokenNotValid)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(secret)) != nil {
+		return nil, errors.WithStack(ErrRefreshTokenNotValid)
+	}
+	for _, f := range []struct {
+		dst *time.Time
+		src string
+	}{
+		{&t.Expires, expires}, {&t.FamilyExpires, familyExpires},
+		{&t.Used, used}, {&t.Created, created},
+	} {
+		if f.src == "" {
+			continue
+		}
+		if *f.dst, err = time.Parse(s.dateFormat, f.src); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return t, nil
+}
+
+// UseRefreshToken atomically marks a token used
+func (s SQLiteRefreshTokenStore) UseRefreshToken(ctx context.Context, id string, used time.Time) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set used = ? where id = ? and used = ''", s.tableName),
+		used.UTC().Format(s.dateFormat), id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrRefreshTokenReused)
+	}
+	return nil
+}
+
+// DeleteRefreshFamily removes the tokens of a family
+func (s SQLiteRefreshTokenStore) DeleteRefreshFamily(ctx context.Context, family string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where family = ?", s.tableName), family)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// DeleteRefreshTokens removes all tokens of a user
+func (s SQLiteRefreshTokenStore) DeleteRefreshTokens(ctx context.Context, uid string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where uid = ?", s.tableName), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createRefreshTokenTable(db *sql.DB) error {
+	_, err := db.Exec(`create table refresh_token (
+	id varchar(32) primary key,
+	family varchar(32) not null,
+	uid string not null,
+	token varchar(255) not null,
+	expires datetime not null,
+	family_expires datetime not null,
+	used datetime not null default '',
+	created datetime not null
+);
+create index refresh_token_family on refresh_token (family);
+create index refresh_token_uid on refresh_token (uid);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteRefreshTokenStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createRefreshTokenTable(db))
+	_, err = NewSQLiteRefreshTokenStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteRefreshTokenStore(db, "")
+	require.NoError(t, err)
+
+	_, err = s.VerifyRefreshToken(nil, "a", "secret")
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	a := &RefreshToken{
+		ID:            "a",
+		Family:        "f",
+		UID:           "42",
+		Expires:       now.Add(time.Hour),
+		FamilyExpires: now.Add(2 * time.Hour),
+		Created:       now,
+	}
+	require.NoError(t, s.StoreRefreshToken(nil, a, "secret"))
+	var hash string
+	require.NoError(t, db.QueryRow("select token from refresh_token").Scan(&hash))
+	require.NotEqual(t, "secret", hash)
+
+	_, err = s.VerifyRefreshToken(nil, "a", "other")
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+	got, err := s.VerifyRefreshToken(nil, "a", "secret")
+	require.NoError(t, err)
+	require.Equal(t, a, got)
+	require.True(t, got.Used.IsZero())
+
+	require.NoError(t, s.UseRefreshToken(nil, "a", now))
+	err = s.UseRefreshToken(nil, "a", now)
+	require.True(t, errors.Is(err, ErrRefreshTokenReused))
+	got, err = s.VerifyRefreshToken(nil, "a", "secret")
+	require.NoError(t, err)
+	require.Equal(t, now, got.Used)
+
+	b := *a
+	b.ID = "b"
+	require.NoError(t, s.StoreRefreshToken(nil, &b, "secret"))
+	c := *a
+	c.ID, c.Family = "c", "g"
+	require.NoError(t, s.StoreRefreshToken(nil, &c, "secret"))
+	d := *a
+	d.ID, d.Family, d.UID = "d", "h", "43"
+	require.NoError(t, s.StoreRefreshToken(nil, &d, "secret"))
+
+	require.NoError(t, s.DeleteRefreshFamily(nil, "f"))
+	for _, id := range []string{"a", "b"} {
+		_, err = s.VerifyRefreshToken(nil, id, "secret")
+		require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+	}
+	_, err = s.VerifyRefreshToken(nil, "c", "secret")
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteRefreshTokens(nil, "42"))
+	_, err = s.VerifyRefreshToken(nil, "c", "secret")
+	require.True(t, errors.Is(err, ErrRefreshTokenNotValid))
+	_, err = s.VerifyRefreshToken(nil, "d", "secret")
+	require.NoError(t, err)
+
+	// Expired families are purged when storing tokens, while used tokens
+	// of live families are kept
+	past := *a
+	past.ID, past.Family, past.FamilyExpires = "e", "i", now.Add(-time.Minute)
+	require.NoError(t, s.StoreRefreshToken(nil, &past, "secret"))
+	idle := *a
+	idle.ID, idle.Family, idle.Expires = "f", "j", now.Add(-time.Minute)
+	require.NoError(t, s.StoreRefreshToken(nil, &idle, "secret"))
+	used := *a
+	used.ID, used.Family = "g", "k"
+	require.NoError(t, s.StoreRefreshToken(nil, &used, "secret"))
+	require.NoError(t, s.UseRefreshToken(nil, "g", now))
+	next := *a
+	next.ID, next.Family = "h", "k"
+	require.NoError(t, s.StoreRefreshToken(nil, &next, "secret"))
+	_, err = db.Exec("update refresh_token set expires = ? where id = 'g'",
+		now.Add(-time.Minute).Format(DateFormatISO8601))
+	require.NoError(t, err)
+	other := *a
+	other.ID, other.Family = "i", "l"
+	require.NoError(t, s.StoreRefreshToken(nil, &other, "secret"))
+	rows, err := db.Query("select id from refresh_token order by id")
+	require.NoError(t, err)
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"d", "g", "h", "i"}, ids)
+}
@@ -0,0 +1,161 @@
+package passwordless
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const UserSessionTableName = "user_session"
+
+// SQLiteSessionStore is a SessionStore that keeps sessions in SQLite. Note
+// the "session" table of SQLiteStore holds tokens rather than sessions.
+// The table must exist, e.g.
+//
+//	create table user_session (
+//		id varchar(32) primary key,
+//		hash varchar(64) not null unique,
+//		uid string not null,
+//		ip varchar(64) not null,
+//		user_agent text not null,
+//		created datetime not null,
+//		last_seen datetime not null,
+//		expires datetime not null
+//	);
+//	create index user_session_uid on user_session (uid);
+type SQLiteSessionStore struct {
+	db *sql.DB
+	// tableName for sessions table
+	tableName string
+	// dateFormat for timestamps
+	dateFormat string
+}
+
+// NewSQLiteSessionStore creates and returns a new SQLiteSessionStore
+func NewSQLiteSessionStore(db *sql.DB, tableName string) (*SQLiteSessionStore, error) {
+	if db == nil {
+		return nil, errors.WithStack(ErrDBConnectionNotValid)
+	}
+	if tableName == "" {
+		tableName = UserSessionTableName
+	}
+	return &SQLiteSessionStore{
+		db:         db,
+		tableName:  tableName,
+		dateFormat: DateFormatISO8601,
+	}, nil
+}
+
+// CreateSession inserts a new session
+func (s SQLiteSessionStore) CreateSession(ctx context.Context, us *UserSession, hash string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`insert into %s (id, hash, uid, ip, user_agent, created, last_seen, expires)
+values (?, ?, ?, ?, ?, ?, ?, ?)`, s.tableName),
+		us.ID, hash, us.UID, us.IP, us.UserAgent,
+		us.Created.UTC().Format(s.dateFormat),
+		us.LastSeen.UTC().Format(s.dateFormat),
+		us.Expires.UTC().Format(s.dateFormat))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// SessionByHash returns the session with the token hash
+func (s SQLiteSessionStore) SessionByHash(ctx context.Context, hash string) (*UserSession, error) {
+	sessions, err := s.query(fmt.Sprintf(
+		"select %s from %s where hash = ?", sessionColumns, s.tableName), hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, errors.WithStack(ErrSessionNotFound)
+	}
+	return sessions[0], nil
+}
+
+// TouchSession sets the last seen time of a session
+func (s SQLiteSessionStore) TouchSession(ctx context.Context, id string, lastSeen time.Time) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"update %s set last_seen = ? where id = ?", s.tableName),
+		lastSeen.UTC().Format(s.dateFormat), id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.checkFound(r)
+}
+
+// Sessions returns the sessions of a user, most recently seen first
+func (s SQLiteSessionStore) Sessions(ctx context.Context, uid string) ([]*UserSession, error) {
+	return s.query(fmt.Sprintf(
+		"select %s from %s where uid = ? order by last_seen desc, id",
+		sessionColumns, s.tableName), uid)
+}
+
+// DeleteSession removes a session of a user
+func (s SQLiteSessionStore) DeleteSession(ctx context.Context, uid, id string) error {
+	r, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where id = ? and uid = ?", s.tableName), id, uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.checkFound(r)
+}
+
+// DeleteSessions removes all sessions of a user
+func (s SQLiteSessionStore) DeleteSessions(ctx context.Context, uid string) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		"delete from %s where uid = ?", s.tableName), uid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+const sessionColumns = "id, uid, ip, user_agent, created, last_seen, expires"
+
+// query returns the sessions selected with sessionColumns
+func (s SQLiteSessionStore) query(query string, args ...interface{}) ([]*UserSession, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	sessions := []*UserSession{}
+	for rows.Next() {
+		us := &UserSession{}
+		var created, lastSeen, expires string
+		if err := rows.Scan(&us.ID, &us.UID, &us.IP, &us.UserAgent,
+			&created, &lastSeen, &expires); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, t := range []struct {
+			dst *time.Time
+			src string
+		}{{&us.Created, created}, {&us.LastSeen, lastSeen}, {&us.Expires, expires}} {
+			if *t.dst, err = time.Parse(s.dateFormat, t.src); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		sessions = append(sessions, us)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sessions, nil
+}
+
+// checkFound returns ErrSessionNotFound if no rows were affected
+func (s SQLiteSessionStore) checkFound(r sql.Result) error {
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rowsAffected == 0 {
+		return errors.WithStack(ErrSessionNotFound)
+	}
+	return nil
+}
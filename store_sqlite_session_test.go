@@ -0,0 +1,87 @@
+package passwordless
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func createUserSessionTable(db *sql.DB) error {
+	_, err := db.Exec(`create table user_session (
+	id varchar(32) primary key,
+	hash varchar(64) not null unique,
+	uid string not null,
+	ip varchar(64) not null,
+	user_agent text not null,
+	created datetime not null,
+	last_seen datetime not null,
+	expires datetime not null
+);
+create index user_session_uid on user_session (uid);`)
+	return errors.WithStack(err)
+}
+
+func TestSQLiteSessionStore(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createUserSessionTable(db))
+	_, err = NewSQLiteSessionStore(nil, "")
+	require.True(t, errors.Is(err, ErrDBConnectionNotValid))
+	s, err := NewSQLiteSessionStore(db, "")
+	require.NoError(t, err)
+
+	_, err = s.SessionByHash(nil, "abc")
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	a := &UserSession{
+		ID:        "a",
+		UID:       "42",
+		IP:        "192.0.2.1",
+		UserAgent: "Mozilla/5.0",
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(time.Hour),
+	}
+	require.NoError(t, s.CreateSession(nil, a, "hash-a"))
+	b := *a
+	b.ID = "b"
+	require.NoError(t, s.CreateSession(nil, &b, "hash-b"))
+	c := *a
+	c.ID, c.UID = "c", "43"
+	require.NoError(t, s.CreateSession(nil, &c, "hash-c"))
+	require.Error(t, s.CreateSession(nil, &UserSession{ID: "d"}, "hash-a"),
+		"token hashes are unique")
+
+	got, err := s.SessionByHash(nil, "hash-a")
+	require.NoError(t, err)
+	require.Equal(t, a, got)
+
+	// Most recently seen first
+	require.NoError(t, s.TouchSession(nil, "b", now.Add(time.Minute)))
+	sessions, err := s.Sessions(nil, "42")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.Equal(t, "b", sessions[0].ID)
+	require.Equal(t, now.Add(time.Minute), sessions[0].LastSeen)
+	err = s.TouchSession(nil, "d", now)
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+
+	// Sessions of other users can't be deleted
+	err = s.DeleteSession(nil, "43", "a")
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+	require.NoError(t, s.DeleteSession(nil, "42", "a"))
+	_, err = s.SessionByHash(nil, "hash-a")
+	require.True(t, errors.Is(err, ErrSessionNotFound))
+
+	require.NoError(t, s.DeleteSessions(nil, "42"))
+	sessions, err = s.Sessions(nil, "42")
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+	sessions, err = s.Sessions(nil, "43")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+}
@@ -27,10 +27,14 @@ func createDB(testName string) (db *sql.DB, err error) {
 		return db, errors.WithStack(err)
 	}
 	_, err = db.Exec(`create table session (
-	uid string primary key,
+	uid string not null,
 	token varchar(255) not null,
 	expires datetime not null,
-	created datetime not null
+	created datetime not null,
+	binding varchar(64) not null default '',
+	purpose varchar(32) not null default 'login',
+	recipient varchar(255) not null default '',
+	primary key (uid, purpose)
 );`)
 	if err != nil {
 		return db, errors.WithStack(err)
@@ -65,6 +69,35 @@ func TestSQLiteStoreExists(t *testing.T) {
 	require.False(t, exp.IsZero())
 }
 
+func TestSQLiteStoreReissue(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	s, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Store(WithPendingRecipient(WithBinding(nil, "abc"),
+		"new@ilovebender.com"), "1337", "uid", time.Hour))
+	binding, err := s.Binding(nil, "uid")
+	require.NoError(t, err)
+	require.Equal(t, "abc", binding)
+	_, err = db.Exec("update session set created = '2000-01-01T00:00:00Z'")
+	require.NoError(t, err)
+
+	// Reissued tokens replace the binding, pending recipient and creation
+	// time
+	require.NoError(t, s.Store(nil, "1338", "uid", time.Hour))
+	binding, err = s.Binding(nil, "uid")
+	require.NoError(t, err)
+	require.Empty(t, binding)
+	session, err := s.getSessionByUID(nil, "uid")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), session.Created, time.Minute)
+	recipient, valid, err := s.ConsumePendingRecipient(nil, "1338", "uid")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Empty(t, recipient)
+}
+
 func TestSQLiteStoreVerify(t *testing.T) {
 	db, err := createDB(t.Name())
 	require.NoError(t, err)
@@ -0,0 +1,130 @@
+package passwordless
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ValidFunc is a predicate determining whether a strategy is valid for the
+// given context. See `SimpleStrategy`.
+type ValidFunc func(ctx context.Context) bool
+
+// AllOf returns a predicate that is true if all of fns are true. With no
+// predicates it is always true.
+func AllOf(fns ...ValidFunc) ValidFunc {
+	return func(ctx context.Context) bool {
+		for _, fn := range fns {
+			if !fn(ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf returns a predicate that is true if any of fns is true. With no
+// predicates it is always false.
+func AnyOf(fns ...ValidFunc) ValidFunc {
+	return func(ctx context.Context) bool {
+		for _, fn := range fns {
+			if fn(ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a predicate negating fn.
+func Not(fn ValidFunc) ValidFunc {
+	return func(ctx context.Context) bool {
+		return !fn(ctx)
+	}
+}
+
+// RecipientMatches returns a predicate that is true if the recipient set
+// with `WithRecipient` matches re, e.g. to only offer SMS for phone
+// numbers. If the recipient is not known yet, such as when listing
+// strategies before the user has entered one, the predicate is true.
+func RecipientMatches(re *regexp.Regexp) ValidFunc {
+	return func(ctx context.Context) bool {
+		recipient, ok := RecipientFromContext(ctx)
+		return !ok || re.MatchString(recipient)
+	}
+}
+
+// RequestHost returns a predicate that is true if the host of the request
+// stored by `SetContext` is one of hosts, ignoring case and port. It is
+// false if there is no request.
+func RequestHost(hosts ...string) ValidFunc {
+	return func(ctx context.Context) bool {
+		r := RequestFromContext(ctx)
+		if r == nil {
+			return false
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, h := range hosts {
+			if strings.EqualFold(h, host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HeaderMatches returns a predicate that is true if the named header of the
+// request stored by `SetContext` matches re. It is false if there is no
+// request.
+func HeaderMatches(name string, re *regexp.Regexp) ValidFunc {
+	return func(ctx context.Context) bool {
+		r := RequestFromContext(ctx)
+		return r != nil && re.MatchString(r.Header.Get(name))
+	}
+}
+
+// RemoteIPIn returns a predicate that is true if the remote address of the
+// request stored by `SetContext` is within any of the CIDR ranges, e.g.
+// "127.0.0.0/8". It is false if there is no request. Note that the remote
+// address is that of the immediate peer, not one given by proxy headers.
+func RemoteIPIn(cidrs ...string) (ValidFunc, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return func(ctx context.Context) bool {
+		r := RequestFromContext(ctx)
+		if r == nil {
+			return false
+		}
+		ip := net.ParseIP(remoteHost(r))
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// remoteHost returns the host of the remote address of r, without the port.
+func remoteHost(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,102 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidFuncs(t *testing.T) {
+	yes := func(context.Context) bool { return true }
+	no := func(context.Context) bool { return false }
+	require.True(t, AllOf()(nil))
+	require.True(t, AllOf(yes, yes)(nil))
+	require.False(t, AllOf(yes, no)(nil))
+	require.False(t, AnyOf()(nil))
+	require.True(t, AnyOf(no, yes)(nil))
+	require.False(t, AnyOf(no, no)(nil))
+	require.True(t, Not(no)(nil))
+
+	phone := RecipientMatches(regexp.MustCompile(`^\+[0-9]+$`))
+	require.True(t, phone(nil), "unknown recipient should be valid")
+	require.True(t, phone(WithRecipient(nil, "+27820000000")))
+	require.False(t, phone(WithRecipient(nil, "bender@ilovebender.com")))
+
+	req := httptest.NewRequest(http.MethodGet, "http://Example.com:8080/", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	req.Header.Set("User-Agent", "curl/7.64.1")
+	ctx := SetContext(nil, httptest.NewRecorder(), req)
+
+	require.True(t, RequestHost("localhost", "example.com")(ctx))
+	require.False(t, RequestHost("localhost")(ctx))
+	require.False(t, RequestHost("example.com")(nil))
+
+	require.True(t, HeaderMatches("User-Agent", regexp.MustCompile(`^curl/`))(ctx))
+	require.False(t, HeaderMatches("X-Debug", regexp.MustCompile(`.`))(ctx))
+	require.False(t, HeaderMatches("User-Agent", regexp.MustCompile(`.`))(nil))
+
+	private, err := RemoteIPIn("10.0.0.0/8", "::1/128")
+	require.NoError(t, err)
+	require.True(t, private(ctx))
+	require.False(t, private(nil))
+	req.RemoteAddr = "[::1]:4567"
+	require.True(t, private(ctx))
+	req.RemoteAddr = "192.0.2.1:4567"
+	require.False(t, private(ctx))
+	req.RemoteAddr = "garbage"
+	require.False(t, private(ctx))
+
+	_, err = RemoteIPIn("10.0.0.0")
+	require.Error(t, err)
+}
+
+func TestStrategyValidity(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+
+	email := &testTransport{}
+	sms := &testTransport{}
+	local, err := RemoteIPIn("127.0.0.0/8")
+	require.NoError(t, err)
+	p.SetTransport("email", email, testGenerator{token: "1337"}, time.Minute)
+	p.SetTransport("sms", sms, testGenerator{token: "1337"}, time.Minute,
+		RecipientMatches(regexp.MustCompile(`^\+[0-9]+$`)))
+	p.SetTransport("debug", &testTransport{}, testGenerator{token: "1337"}, time.Minute,
+		local)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	ctx := SetContext(context.Background(), httptest.NewRecorder(), req)
+	require.Equal(t, []string{"email", "sms"}, strategyNames(p.ListStrategies(ctx)))
+
+	// The recipient is checked when requesting a token
+	require.ErrorIs(t, p.RequestToken(ctx, PurposeLogin, "sms", "uid", "bender@ilovebender.com"),
+		ErrNotValidForContext)
+	require.Empty(t, sms.token)
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "sms", "uid", "+27820000000"))
+	require.Equal(t, "1337", sms.token)
+
+	// With a resolver, the recipient resolved for a uid is checked
+	p.Resolver = mapResolver{users: map[string]string{
+		"42": "+27820000042", "43": "bender@ilovebender.com"}}
+	sms.token = ""
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "sms", "42", ""))
+	require.Equal(t, "1337", sms.token)
+	require.Equal(t, "+27820000042", sms.recipient)
+	require.ErrorIs(t, p.RequestToken(ctx, PurposeLogin, "sms", "43", ""),
+		ErrNotValidForContext)
+	p.Resolver = nil
+
+	_, err = p.GetStrategy(ctx, "debug")
+	require.ErrorIs(t, err, ErrNotValidForContext)
+	req.RemoteAddr = "127.0.0.1:1234"
+	require.Equal(t, []string{"email", "sms", "debug"}, strategyNames(p.ListStrategies(ctx)))
+}
@@ -0,0 +1,166 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TOTP is a Strategy for time-based one-time passwords generated by an
+// authenticator app, see RFC 6238. As codes are generated on the device,
+// nothing is stored or sent when requesting a token, and codes are
+// verified against the secret enrolled with `Enroll`.
+type TOTP struct {
+	NopTransport
+	otpConfig
+	Store OTPStore
+	// Period is the time step, 30 seconds by default
+	Period time.Duration
+	// Skew is the number of time steps before and after the current one
+	// that are also accepted, to allow for clock drift
+	Skew  uint64
+	valid []ValidFunc
+	now   func() time.Time
+}
+
+// NewTOTP returns a TOTP strategy using 6 digit SHA1 codes with a 30 second
+// period and a skew of one step, which all common authenticator apps
+// support. Verification locks for DefaultOTPLockout after
+// DefaultOTPMaxFailures failed codes. The issuer is shown in the app next
+// to the account name. The strategy is only valid for contexts satisfying
+// all of the predicates.
+func NewTOTP(store OTPStore, issuer string, valid ...ValidFunc) *TOTP {
+	return &TOTP{
+		otpConfig: otpConfig{
+			Issuer:      issuer,
+			Digits:      6,
+			Algorithm:   OTPSHA1,
+			MaxFailures: DefaultOTPMaxFailures,
+			Lockout:     DefaultOTPLockout,
+		},
+		Store:  store,
+		Period: 30 * time.Second,
+		Skew:   1,
+		valid:  valid,
+		now:    time.Now,
+	}
+}
+
+// Generate returns an empty token, as codes are generated on the device.
+func (s *TOTP) Generate(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// Sanitize removes spaces and dashes from codes.
+func (s *TOTP) Sanitize(ctx context.Context, t string) (string, error) {
+	return sanitizeOTP(t), nil
+}
+
+// TTL returns the period of codes.
+func (s *TOTP) TTL(context.Context) time.Duration {
+	return s.Period
+}
+
+// Valid returns true if the context satisfies all validity predicates.
+func (s *TOTP) Valid(ctx context.Context) bool {
+	return AllOf(s.valid...)(ctx)
+}
+
+// Enroll generates a new pending secret for the user. The account, e.g.
+// the email address of the user, identifies the secret in the
+// authenticator app. The secret replaces any existing one once the user
+// enters a code from the app with `Confirm`.
+func (s *TOTP) Enroll(ctx context.Context, uid, account string) (*OTPEnrollment, error) {
+	if s.Period < time.Second {
+		return nil, errors.WithStack(ErrOTPPeriodNotValid)
+	}
+	params := url.Values{}
+	params.Set("period", strconv.Itoa(int(s.Period/time.Second)))
+	return s.enroll(ctx, s.Store, "totp", uid, account, params)
+}
+
+// Confirm activates the secret enrolled with `Enroll` if code is valid for
+// it, replacing any existing secret. It returns false if the code is not
+// valid, which counts as a failure like in `VerifyToken`.
+func (s *TOTP) Confirm(ctx context.Context, uid, code string) (bool, error) {
+	now := s.now()
+	if err := s.locked(ctx, s.Store, uid, now); err != nil {
+		return false, err
+	}
+	secret, err := s.Store.PendingOTPSecret(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	c, ok, err := s.match(secret, 0, code, now)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return s.fail(ctx, s.Store, uid, now)
+	}
+	if err := s.Store.ActivateOTPSecret(ctx, uid, c+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyToken returns true if code is valid for the current time step, or
+// one within the skew. Each code is accepted once, and so are codes of
+// earlier time steps once a code was accepted, so an intercepted code
+// can't be replayed within its period. A reused code fails with
+// ErrOTPCodeReused. After MaxFailures failed codes, verification fails
+// with ErrOTPLocked until Lockout has passed.
+func (s *TOTP) VerifyToken(ctx context.Context, uid, code string) (bool, error) {
+	now := s.now()
+	if err := s.locked(ctx, s.Store, uid, now); err != nil {
+		return false, err
+	}
+	secret, next, err := s.Store.OTPSecret(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	c, ok, err := s.match(secret, next, code, now)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return s.fail(ctx, s.Store, uid, now)
+	}
+	if err := s.Store.AdvanceOTPCounter(ctx, uid, c+1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// match returns the time step within the skew of now that code is valid
+// for, ignoring steps before next. It fails with ErrOTPCodeReused if code
+// is only valid for such steps.
+func (s *TOTP) match(secret []byte, next uint64, code string, now time.Time) (uint64, bool, error) {
+	code = sanitizeOTP(code)
+	step := uint64(now.Unix()) / uint64(s.Period/time.Second)
+	from := uint64(0)
+	if step > s.Skew {
+		from = step - s.Skew
+	}
+	reused := false
+	for c := from; c <= step+s.Skew; c++ {
+		expected, err := s.code(secret, c)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+		if c < next {
+			reused = true
+			continue
+		}
+		return c, true, nil
+	}
+	if reused {
+		return 0, false, errors.WithStack(ErrOTPCodeReused)
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,211 @@
+package passwordless
+
+import (
+	"context"
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B
+	secrets := map[OTPAlgorithm]string{
+		OTPSHA1:   "12345678901234567890",
+		OTPSHA256: "12345678901234567890123456789012",
+		OTPSHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	tests := []struct {
+		time int64
+		alg  OTPAlgorithm
+		code string
+	}{
+		{59, OTPSHA1, "94287082"},
+		{59, OTPSHA256, "46119246"},
+		{59, OTPSHA512, "90693936"},
+		{1111111109, OTPSHA1, "07081804"},
+		{1111111109, OTPSHA256, "68084774"},
+		{1111111109, OTPSHA512, "25091201"},
+		{20000000000, OTPSHA1, "65353130"},
+	}
+	for _, test := range tests {
+		c := otpConfig{Digits: 8, Algorithm: test.alg}
+		code, err := c.code([]byte(secrets[test.alg]), uint64(test.time/30))
+		require.NoError(t, err)
+		require.Equal(t, test.code, code, "%s at %d", test.alg, test.time)
+	}
+
+	_, err := otpConfig{Digits: 6, Algorithm: "MD5"}.code(nil, 0)
+	require.True(t, errors.Is(err, ErrOTPAlgorithmNotValid))
+}
+
+func TestTOTP(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOTPTable(db, TOTPTableName))
+	otps, err := NewSQLiteOTPStore(db, "")
+	require.NoError(t, err)
+	s := NewTOTP(otps, "Planet Express")
+	now := time.Unix(1111111109, 0)
+	s.now = func() time.Time { return now }
+
+	_, err = s.VerifyToken(nil, "42", "123456")
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+
+	e, err := s.Enroll(nil, "42", "bender@ilovebender.com")
+	require.NoError(t, err)
+	u, err := url.Parse(e.URI)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/Planet Express:bender@ilovebender.com", u.Path)
+	q := u.Query()
+	require.Equal(t, e.Secret, q.Get("secret"))
+	require.Equal(t, "Planet Express", q.Get("issuer"))
+	require.Equal(t, "SHA1", q.Get("algorithm"))
+	require.Equal(t, "6", q.Get("digits"))
+	require.Equal(t, "30", q.Get("period"))
+	png, err := e.PNG(256)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(png), "\x89PNG"))
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	require.NoError(t, err)
+	require.Len(t, secret, OTPSecretSize)
+	code := func(at time.Time) string {
+		c, err := s.code(secret, uint64(at.Unix()/30))
+		require.NoError(t, err)
+		return c
+	}
+
+	// The secret is only used once confirmed with a code from the app
+	_, err = s.VerifyToken(nil, "42", code(now))
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	valid, err := s.Confirm(nil, "42", "000000")
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = s.Confirm(nil, "42", code(now.Add(-30*time.Second)))
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, err = s.Confirm(nil, "42", code(now))
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled), "confirmed once")
+
+	// Codes outside the skew are rejected
+	valid, err = s.VerifyToken(nil, "42", code(now.Add(-time.Minute)))
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = s.VerifyToken(nil, "42", code(now.Add(time.Minute)))
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// The current step is accepted, once
+	c := code(now)
+	valid, err = s.VerifyToken(nil, "42", c[:3]+" "+c[3:])
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = s.VerifyToken(nil, "42", c)
+	require.True(t, errors.Is(err, ErrOTPCodeReused))
+	require.False(t, valid)
+	_, err = s.VerifyToken(nil, "42", code(now.Add(-30*time.Second)))
+	require.True(t, errors.Is(err, ErrOTPCodeReused), "step used to confirm")
+
+	// A later code prevents replay of earlier ones
+	now = now.Add(30 * time.Second)
+	valid, err = s.VerifyToken(nil, "42", code(now.Add(30*time.Second)))
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, err = s.VerifyToken(nil, "42", code(now))
+	require.True(t, errors.Is(err, ErrOTPCodeReused))
+
+	// Enrolling again keeps the current secret until confirmed
+	e2, err := s.Enroll(nil, "42", "bender@ilovebender.com")
+	require.NoError(t, err)
+	require.NotEqual(t, e.Secret, e2.Secret)
+	now = now.Add(2 * time.Minute)
+	valid, err = s.VerifyToken(nil, "42", code(now))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Failed codes lock verification, also of valid codes
+	for i := 0; i < s.MaxFailures; i++ {
+		valid, err = s.Confirm(nil, "42", "000000")
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+	now = now.Add(time.Minute)
+	_, err = s.VerifyToken(nil, "42", code(now))
+	require.True(t, errors.Is(err, ErrOTPLocked))
+	_, err = s.Confirm(nil, "42", "000000")
+	require.True(t, errors.Is(err, ErrOTPLocked))
+	now = now.Add(s.Lockout)
+	valid, err = s.VerifyToken(nil, "42", code(now))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	_, err = NewTOTP(otps, "").Enroll(nil, "42", "bender@ilovebender.com")
+	require.True(t, errors.Is(err, ErrOTPIssuerRequired))
+}
+
+func TestTOTPStrategy(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createOTPTable(db, TOTPTableName))
+	otps, err := NewSQLiteOTPStore(db, "")
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	tt := &testTransport{}
+	p.SetTransport("email", tt, testGenerator{token: "1337"}, time.Minute)
+	s := NewTOTP(otps, "Planet Express")
+	p.SetStrategy("totp", s)
+
+	e, err := s.Enroll(nil, "42", "bender@ilovebender.com")
+	require.NoError(t, err)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	require.NoError(t, err)
+	require.NoError(t, otps.ActivateOTPSecret(nil, "42", 0))
+	code, err := s.code(secret, uint64(time.Now().Unix()/30))
+	require.NoError(t, err)
+
+	// Requesting a token stores and sends nothing, and leaves pending
+	// tokens of other strategies alone
+	ctx := context.Background()
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "email", "42", "bender@ilovebender.com"))
+	require.NoError(t, p.RequestToken(ctx, PurposeLogin, "totp", "42", "bender@ilovebender.com"))
+	exists, _, err := store.Exists(ctx, "42")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	uid, valid, err := p.VerifyRecipient(ctx, PurposeLogin, "totp", "bender@ilovebender.com", code)
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", uid)
+
+	// Email tokens are not accepted as codes, and vice versa
+	valid, err = p.VerifyStrategyToken(ctx, PurposeLogin, "totp", "42", "1337")
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = p.VerifyStrategyToken(ctx, PurposeLogin, "email", "42", code)
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = p.VerifyStrategyToken(ctx, PurposeLogin, "email", "42", "1337")
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	_, err = p.VerifyStrategyToken(ctx, PurposeLogin, "sms", "42", code)
+	require.Equal(t, ErrUnknownStrategy, err)
+
+	// Users without an authenticator look like those entering a wrong code
+	_, err = p.VerifyStrategyToken(ctx, PurposeLogin, "totp", "43", code)
+	require.True(t, errors.Is(err, ErrOTPNotEnrolled))
+	p.EnumerationSafe = true
+	valid, err = p.VerifyStrategyToken(ctx, PurposeLogin, "totp", "43", code)
+	require.NoError(t, err)
+	require.False(t, valid)
+}
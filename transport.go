@@ -24,3 +24,11 @@ func (lt LogTransport) Send(ctx context.Context, token, user, recipient string)
 	log.Printf(lt.MessageFunc(token, user))
 	return nil
 }
+
+// NopTransport sends nothing. It is used by strategies where tokens are
+// generated on the user's device, e.g. TOTP.
+type NopTransport struct{}
+
+func (NopTransport) Send(ctx context.Context, token, user, recipient string) error {
+	return nil
+}
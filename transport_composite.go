@@ -0,0 +1,215 @@
+package passwordless
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TransportErrors is returned by composite transports when every
+// delivery attempt failed, holding the error of each attempt.
+type TransportErrors []error
+
+func (e TransportErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "all transports failed: " + strings.Join(s, "; ")
+}
+
+// Unwrap returns the errors of each attempt.
+func (e TransportErrors) Unwrap() []error {
+	return e
+}
+
+// Is returns true if any attempt failed with target.
+func (e TransportErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportHealth describes the recent delivery record of a transport.
+type TransportHealth struct {
+	// ConsecutiveFailures since the last successful delivery
+	ConsecutiveFailures int
+	// OpenUntil is set while the circuit is open, i.e. the transport is
+	// skipped
+	OpenUntil time.Time
+}
+
+// FailoverTransport tries a list of transports in order until one
+// succeeds, e.g. a primary and secondary SMTP relay. A transport that
+// fails Threshold consecutive times is skipped for Cooldown, after which
+// it is tried again; if it fails, it is skipped for another Cooldown.
+type FailoverTransport struct {
+	// Threshold of consecutive failures that opens the circuit
+	Threshold int
+	// Cooldown before a transport with an open circuit is retried
+	Cooldown time.Duration
+
+	transports []Transport
+	mu         sync.Mutex
+	health     []TransportHealth
+	now        func() time.Time
+}
+
+// NewFailoverTransport returns a transport that tries each of the given
+// transports in order. By default the circuit of a transport opens after 3
+// consecutive failures, for one minute.
+func NewFailoverTransport(transports ...Transport) *FailoverTransport {
+	return &FailoverTransport{
+		Threshold:  3,
+		Cooldown:   time.Minute,
+		transports: transports,
+		health:     make([]TransportHealth, len(transports)),
+		now:        time.Now,
+	}
+}
+
+// Send delivers the token through the first available transport that
+// succeeds. If the circuits of all transports are open, each is tried
+// anyway rather than failing outright.
+func (f *FailoverTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	if len(f.transports) == 0 {
+		return errors.WithStack(ErrNoTransport)
+	}
+	errs := TransportErrors{}
+	attempted := false
+	for _, skipOpen := range []bool{true, false} {
+		for i, t := range f.transports {
+			if skipOpen && !f.available(i) {
+				continue
+			}
+			if ctx != nil && ctx.Err() != nil {
+				return append(errs, ctx.Err())
+			}
+			attempted = true
+			err := t.Send(ctx, token, uid, recipient)
+			f.record(i, err)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		if attempted {
+			break
+		}
+	}
+	return errs
+}
+
+// Health returns the health of each transport, in order.
+func (f *FailoverTransport) Health() []TransportHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]TransportHealth{}, f.health...)
+}
+
+// available returns false while the circuit of transport i is open.
+func (f *FailoverTransport) available(i int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.now().Before(f.health[i].OpenUntil)
+}
+
+// record updates the health of transport i after an attempt.
+func (f *FailoverTransport) record(i int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := &f.health[i]
+	if err == nil {
+		*h = TransportHealth{}
+		return
+	}
+	h.ConsecutiveFailures++
+	if f.Threshold > 0 && h.ConsecutiveFailures >= f.Threshold {
+		h.OpenUntil = f.now().Add(f.Cooldown)
+	}
+}
+
+// RecipientFunc maps the recipient of a token to the recipient for a
+// particular transport, e.g. an email address to a phone number. An empty
+// recipient skips the transport.
+type RecipientFunc func(ctx context.Context, uid, recipient string) (string, error)
+
+type fanoutRoute struct {
+	transport Transport
+	recipient RecipientFunc
+}
+
+// FanoutTransport delivers the same token through several transports
+// concurrently, e.g. email and SMS, and succeeds if any delivery succeeds.
+type FanoutTransport struct {
+	routes []fanoutRoute
+}
+
+// NewFanoutTransport returns a transport that delivers tokens through all
+// of the given transports to the same recipient. Use AddRoute for
+// transports requiring a different recipient.
+func NewFanoutTransport(transports ...Transport) *FanoutTransport {
+	f := &FanoutTransport{}
+	for _, t := range transports {
+		f.AddRoute(t, nil)
+	}
+	return f
+}
+
+// AddRoute adds a transport, delivering to the recipient returned by r. If
+// r is nil the recipient is passed through unchanged.
+func (f *FanoutTransport) AddRoute(t Transport, r RecipientFunc) *FanoutTransport {
+	f.routes = append(f.routes, fanoutRoute{transport: t, recipient: r})
+	return f
+}
+
+// Send delivers the token through every transport, returning nil if at
+// least one delivery succeeded.
+func (f *FanoutTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	if len(f.routes) == 0 {
+		return errors.WithStack(ErrNoTransport)
+	}
+	errs := make([]error, len(f.routes))
+	sent := make([]bool, len(f.routes))
+	wg := sync.WaitGroup{}
+	for i, r := range f.routes {
+		wg.Add(1)
+		go func(i int, r fanoutRoute) {
+			defer wg.Done()
+			to := recipient
+			if r.recipient != nil {
+				var err error
+				if to, err = r.recipient(ctx, uid, recipient); err != nil {
+					errs[i] = err
+					return
+				} else if to == "" {
+					return
+				}
+			}
+			if errs[i] = r.transport.Send(ctx, token, uid, to); errs[i] == nil {
+				sent[i] = true
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	failed := TransportErrors{}
+	for i := range f.routes {
+		if sent[i] {
+			return nil
+		} else if errs[i] != nil {
+			failed = append(failed, errs[i])
+		}
+	}
+	if len(failed) == 0 {
+		// Every route was skipped
+		return errors.WithStack(ErrNoTransport)
+	}
+	return failed
+}
@@ -0,0 +1,136 @@
+package passwordless
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// countingTransport records the recipients it was asked to deliver to.
+type countingTransport struct {
+	mu         sync.Mutex
+	recipients []string
+	err        error
+}
+
+func (t *countingTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recipients = append(t.recipients, recipient)
+	return t.err
+}
+
+func (t *countingTransport) calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.recipients)
+}
+
+func TestFailoverTransport(t *testing.T) {
+	primary := &countingTransport{err: errors.New("primary down")}
+	secondary := &countingTransport{}
+	f := NewFailoverTransport(primary, secondary)
+	f.Threshold = 2
+	f.Cooldown = time.Minute
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	// Falls back to secondary
+	require.NoError(t, f.Send(nil, "token", "uid", "recipient"))
+	require.Equal(t, 1, primary.calls())
+	require.Equal(t, 1, secondary.calls())
+	require.Equal(t, 1, f.Health()[0].ConsecutiveFailures)
+	require.True(t, f.Health()[0].OpenUntil.IsZero())
+
+	// Circuit opens after threshold
+	require.NoError(t, f.Send(nil, "token", "uid", "recipient"))
+	require.Equal(t, now.Add(time.Minute), f.Health()[0].OpenUntil)
+	require.NoError(t, f.Send(nil, "token", "uid", "recipient"))
+	require.Equal(t, 2, primary.calls(), "primary should be skipped")
+	require.Equal(t, 3, secondary.calls())
+
+	// Primary is retried after cooldown and recovers
+	now = now.Add(2 * time.Minute)
+	primary.err = nil
+	require.NoError(t, f.Send(nil, "token", "uid", "recipient"))
+	require.Equal(t, 3, primary.calls())
+	require.Equal(t, 3, secondary.calls())
+	require.Equal(t, TransportHealth{}, f.Health()[0])
+
+	// All failing
+	primary.err = errors.New("primary down")
+	secondary.err = errors.New("secondary down")
+	err := f.Send(nil, "token", "uid", "recipient")
+	require.EqualError(t, err, "all transports failed: primary down; secondary down")
+	var errs TransportErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+
+	// Transports are still tried when all circuits are open
+	require.Error(t, f.Send(nil, "token", "uid", "recipient"))
+	require.False(t, f.Health()[0].OpenUntil.IsZero())
+	require.False(t, f.Health()[1].OpenUntil.IsZero())
+	secondary.err = nil
+	require.NoError(t, f.Send(nil, "token", "uid", "recipient"))
+
+	// Context is honoured between attempts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, f.Send(ctx, "token", "uid", "recipient"), context.Canceled)
+
+	require.ErrorIs(t, NewFailoverTransport().Send(nil, "token", "uid", "recipient"), ErrNoTransport)
+}
+
+func TestFanoutTransport(t *testing.T) {
+	email := &countingTransport{}
+	sms := &countingTransport{}
+	phones := map[string]string{"uid": "+27820000000"}
+	f := NewFanoutTransport(email).AddRoute(sms,
+		func(ctx context.Context, uid, recipient string) (string, error) {
+			return phones[uid], nil
+		})
+
+	require.NoError(t, f.Send(nil, "token", "uid", "bender@ilovebender.com"))
+	require.Equal(t, []string{"bender@ilovebender.com"}, email.recipients)
+	require.Equal(t, []string{"+27820000000"}, sms.recipients)
+
+	// Empty recipient skips the route
+	require.NoError(t, f.Send(nil, "token", "other", "fry@planetexpress.com"))
+	require.Equal(t, 2, email.calls())
+	require.Equal(t, 1, sms.calls())
+
+	// Succeeds if any delivery succeeds
+	email.err = errors.New("smtp down")
+	require.NoError(t, f.Send(nil, "token", "uid", "bender@ilovebender.com"))
+
+	// Fails if all fail
+	sms.err = errors.New("sms down")
+	err := f.Send(nil, "token", "uid", "bender@ilovebender.com")
+	var errs TransportErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+
+	// Fails if the only attempted delivery fails
+	err = f.Send(nil, "token", "other", "fry@planetexpress.com")
+	require.EqualError(t, err, "all transports failed: smtp down")
+
+	// Recipient lookup errors are reported
+	f = NewFanoutTransport().AddRoute(sms,
+		func(ctx context.Context, uid, recipient string) (string, error) {
+			return "", fmt.Errorf("lookup failed")
+		})
+	require.EqualError(t, f.Send(nil, "token", "uid", "recipient"),
+		"all transports failed: lookup failed")
+
+	// Skipping every route
+	f = NewFanoutTransport().AddRoute(sms,
+		func(ctx context.Context, uid, recipient string) (string, error) {
+			return "", nil
+		})
+	require.ErrorIs(t, f.Send(nil, "token", "uid", "recipient"), ErrNoTransport)
+}
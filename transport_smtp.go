@@ -2,15 +2,34 @@ package passwordless
 
 import (
 	"bytes"
-	"crypto/md5"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
 	"net/smtp"
-	"time"
+	"net/textproto"
 
 	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSTARTTLSNotSupported = errors.New("server does not support STARTTLS")
+	ErrInsecureAuth         = errors.New("refusing to authenticate over an unencrypted connection")
+)
+
+// TLSPolicy determines how SMTPTransport secures connections.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic upgrades the connection with STARTTLS if the server
+	// supports it. Authentication fails if the connection is not upgraded.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSRequireSTARTTLS fails unless the connection is upgraded with
+	// STARTTLS.
+	TLSRequireSTARTTLS
+	// TLSImplicit connects over TLS from the start, typically to port 465.
+	TLSImplicit
 )
 
 // ComposerFunc is called when writing the contents of an email, including
@@ -19,7 +38,16 @@ type ComposerFunc func(ctx context.Context, token, user, recipient string, w io.
 
 // SMTPTransport delivers a user token via e-mail.
 type SMTPTransport struct {
-	UseSSL   bool
+	// UseSSL is equivalent to setting TLSPolicy to TLSImplicit
+	UseSSL bool
+	// TLSPolicy determines whether and how connections are encrypted
+	TLSPolicy TLSPolicy
+	// TLSConfig is used for TLS connections, e.g. to set a custom CA pool,
+	// client certificates or minimum version. If ServerName is empty it is
+	// set to the host of the server address.
+	TLSConfig *tls.Config
+	// DKIM signs composed messages, if set
+	DKIM     *DKIMSigner
 	auth     smtp.Auth
 	from     string
 	addr     string
@@ -39,155 +67,202 @@ func NewSMTPTransport(addr, from string, auth smtp.Auth, c ComposerFunc) *SMTPTr
 }
 
 // Send sends an email to the email address specified in `recipient`,
-// containing the user token provided.
+// containing the user token provided. Errors are returned as *SMTPError.
 func (t *SMTPTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	c, err := t.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := t.deliver(ctx, c, token, uid, recipient); err != nil {
+		quit(c)
+		return err
+	}
+
+	// Succeeded; quit nicely
+	if err := c.Quit(); err != nil {
+		c.Close()
+		return newSMTPError(SMTPPhaseQuit, err)
+	}
+	return nil
+}
+
+// dial connects to the server, negotiating TLS and authenticating as
+// configured. The connection is closed if an error is returned.
+func (t *SMTPTransport) dial(ctx context.Context) (_ *smtp.Client, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	host, _, _ := net.SplitHostPort(t.addr)
 
 	// If UseSSL is true, need to ensure the connection is made over a
 	// TLS channel.
-	var c *smtp.Client
-	if t.UseSSL {
+	var conn net.Conn
+	if t.UseSSL || t.TLSPolicy == TLSImplicit {
 		// Connect with SSL handshake
-		tlscfg := &tls.Config{
-			ServerName: host,
-		}
-		if conn, err := tls.Dial("tcp", t.addr, tlscfg); err != nil {
-			return err
-		} else if c, err = smtp.NewClient(conn, host); err != nil {
-			defer c.Close()
-			defer conn.Close()
-			return err
-		}
+		d := &tls.Dialer{Config: t.tlsConfig(host)}
+		conn, err = d.DialContext(ctx, "tcp", t.addr)
 	} else {
 		// Not using SSL handshake
-		if cl, err := smtp.Dial(t.addr); err != nil {
-			return err
-		} else {
-			c = cl
-			defer c.Close()
+		d := &net.Dialer{}
+		conn, err = d.DialContext(ctx, "tcp", t.addr)
+	}
+	if err != nil {
+		return nil, newSMTPError(SMTPPhaseDial, err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, newSMTPError(SMTPPhaseGreeting, err)
+	}
+
+	// End the session if any of the following steps fail
+	defer func() {
+		if err != nil {
+			quit(c)
 		}
+	}()
+
+	if err := c.Hello("localhost"); err != nil {
+		return nil, newSMTPError(SMTPPhaseHello, err)
 	}
 
 	// Use STARTTLS if available
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: host}
-		if err := c.StartTLS(config); err != nil {
-			return err
+	_, isTLS := c.TLSConnectionState()
+	if ok, _ := c.Extension("STARTTLS"); ok && !isTLS {
+		if err := c.StartTLS(t.tlsConfig(host)); err != nil {
+			return nil, newSMTPError(SMTPPhaseStartTLS, err)
 		}
+		isTLS = true
+	}
+
+	// Fail closed if the policy isn't met
+	if !isTLS && t.TLSPolicy == TLSRequireSTARTTLS {
+		return nil, newSMTPError(SMTPPhaseStartTLS, ErrSTARTTLSNotSupported)
 	}
 
 	// Use auth credentials if supported and provided
 	if ok, _ := c.Extension("AUTH"); ok && t.auth != nil {
+		// Never send credentials in clear text
+		if !isTLS {
+			return nil, newSMTPError(SMTPPhaseAuth, ErrInsecureAuth)
+		}
 		if err := c.Auth(t.auth); err != nil {
-			return err
+			return nil, newSMTPError(SMTPPhaseAuth, err)
 		}
 	}
 
+	return c, nil
+}
+
+// tlsConfig returns the TLS configuration for connecting to host.
+func (t *SMTPTransport) tlsConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if t.TLSConfig != nil {
+		config = t.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// deliver sends a single message containing the token over c. The
+// message is composed before the transaction starts, so c can be reused or
+// quit if an error is returned.
+func (t *SMTPTransport) deliver(ctx context.Context, c *smtp.Client, token, uid, recipient string) error {
 	// Compose email
+	msg := bytes.NewBuffer(nil)
+	if err := t.compose(ctx, token, uid, recipient, msg); err != nil {
+		return newSMTPError(SMTPPhaseCompose, err)
+	}
+
 	if err := c.Mail(t.from); err != nil {
-		return err
+		return newSMTPError(SMTPPhaseMail, err)
 	}
 	if err := c.Rcpt(recipient); err != nil {
-		return err
+		return newSMTPError(SMTPPhaseRcpt, err)
 	}
 
 	// Write body
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return newSMTPError(SMTPPhaseData, err)
 	}
-
-	// Emit message body
-	if err := t.composer(ctx, token, uid, recipient, w); err != nil {
-		return err
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return newSMTPError(SMTPPhaseData, err)
 	}
 
-	// Close writer
+	// Close writer, the server accepts or rejects the message
 	if err := w.Close(); err != nil {
-		return err
+		return newSMTPError(SMTPPhaseData, err)
 	}
-
-	// Succeeded; quit nicely
-	return c.Quit()
-}
-
-// Email is a helper for creating multipart (text and html) emails
-type Email struct {
-	Body    []struct{ t, c string }
-	To      string
-	Subject string
-	Date    time.Time
+	return nil
 }
 
-// AddBody adds a content section to the email. The `contentType` should
-// be a known type, such as "text/html" or "text/plain". If no `contentType`
-// is provided, "text/plain" is used. Call this method for each required
-// body, with the most preferable type last.
-func (e *Email) AddBody(contentType, body string) {
-	if e.Body == nil {
-		e.Body = make([]struct{ t, c string }, 0)
+// compose writes the message to w, signing it if DKIM is configured.
+func (t *SMTPTransport) compose(ctx context.Context, token, uid, recipient string, w io.Writer) error {
+	ctx = withSender(ctx, t.from)
+	if t.DKIM == nil {
+		return t.composer(ctx, token, uid, recipient, w)
 	}
-	if contentType == "" {
-		contentType = "text/plain"
-	}
-	e.Body = append(e.Body, struct{ t, c string }{contentType, body})
-}
-
-// Write emits the Email to the specified writer.
-func (e Email) Write(w io.Writer) (int64, error) {
-	return e.Buffer().WriteTo(w)
-}
-
-// Bytes returns the contents of the email as a series of bytes.
-func (e Email) Bytes() []byte {
-	return e.Buffer().Bytes()
-}
-
-// Buffer generates the email header and contents as a `Buffer`.
-func (e Email) Buffer() *bytes.Buffer {
-	crlf := "\r\n"
 	b := bytes.NewBuffer(nil)
-
-	if e.Date.IsZero() {
-		b.WriteString("Date: " + time.Now().UTC().Format(time.RFC822) + crlf)
-	} else {
-		b.WriteString("Date: " + e.Date.UTC().Format(time.RFC822) + crlf)
+	if err := t.composer(ctx, token, uid, recipient, b); err != nil {
+		return err
 	}
-
-	if e.Subject != "" {
-		b.WriteString("Subject: " + e.Subject + crlf)
+	msg, err := t.DKIM.Sign(b.Bytes())
+	if err != nil {
+		return err
 	}
-	if e.To != "" {
-		b.WriteString("To: " + e.To + crlf)
+	_, err = w.Write(msg)
+	return err
+}
+
+// quit ends the session with the server, closing the connection even if
+// the server doesn't respond.
+func quit(c *smtp.Client) {
+	if err := c.Quit(); err != nil {
+		c.Close()
 	}
+}
 
-	boundary := ""
+// Phases of an SMTP exchange, as reported by SMTPError.
+const (
+	SMTPPhaseDial     = "dial"
+	SMTPPhaseGreeting = "greeting"
+	SMTPPhaseHello    = "hello"
+	SMTPPhaseStartTLS = "starttls"
+	SMTPPhaseAuth     = "auth"
+	SMTPPhaseCompose  = "compose"
+	SMTPPhaseMail     = "mail"
+	SMTPPhaseRcpt     = "rcpt"
+	SMTPPhaseData     = "data"
+	SMTPPhaseQuit     = "quit"
+)
 
-	// Write multipart header if email contains multiple parts
-	if len(e.Body) > 1 {
-		// Generate unique boundary to separate sections
-		h := md5.New()
-		io.WriteString(h, fmt.Sprintf("%d", time.Now().UnixNano()))
-		boundary = fmt.Sprintf("%x", h.Sum(nil))
+// SMTPError describes a failed SMTP exchange.
+type SMTPError struct {
+	// Phase of the exchange that failed
+	Phase string
+	// Code of the server reply, or zero if the server didn't reply
+	Code int
+	Err  error
+}
 
-		// Write boundary
-		b.WriteString("MIME-Version: 1.0" + crlf)
-		b.WriteString("Content-Type: multipart/alternative; boundary=" +
-			boundary + crlf + crlf)
+func newSMTPError(phase string, err error) *SMTPError {
+	e := &SMTPError{Phase: phase, Err: err}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		e.Code = tpErr.Code
 	}
+	return e
+}
 
-	// Write each part
-	for _, body := range e.Body {
-		if boundary != "" {
-			b.WriteString(crlf + "--" + boundary + crlf)
-		}
-		b.WriteString("Content-Type: " + body.t + "; charset=\"UTF-8\";")
-		b.WriteString(crlf + crlf + body.c)
-	}
-	if boundary != "" {
-		b.WriteString(crlf + "--" + boundary + "--")
-	}
-	b.WriteString(crlf)
+func (e *SMTPError) Error() string {
+	return "smtp " + e.Phase + ": " + e.Err.Error()
+}
 
-	return b
+func (e *SMTPError) Unwrap() error {
+	return e.Err
 }
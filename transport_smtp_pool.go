@@ -0,0 +1,195 @@
+package passwordless
+
+import (
+	"context"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrPoolClosed = errors.New("smtp pool is closed")
+)
+
+// SMTPPool delivers user tokens via e-mail like SMTPTransport, but keeps
+// authenticated connections open for reuse between messages.
+type SMTPPool struct {
+	// IdleTimeout is how long an unused connection is kept open
+	IdleTimeout time.Duration
+
+	transport *SMTPTransport
+	sem       chan struct{}
+	mu        sync.Mutex
+	idle      []*pooledClient
+	closed    bool
+	done      chan struct{}
+}
+
+type pooledClient struct {
+	*smtp.Client
+	lastUsed time.Time
+}
+
+// minReapInterval is the shortest interval idle connections are checked
+// for expiry at.
+const minReapInterval = 10 * time.Millisecond
+
+// NewSMTPPool returns a new pooled transport that sends emails as
+// configured by t. At most maxConns connections are open concurrently,
+// further calls to Send block until one is available. Connections unused
+// for idleTimeout are closed.
+func NewSMTPPool(t *SMTPTransport, maxConns int, idleTimeout time.Duration) *SMTPPool {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	p := &SMTPPool{
+		IdleTimeout: idleTimeout,
+		transport:   t,
+		sem:         make(chan struct{}, maxConns),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		// Tiny timeouts would make the ticker interval zero
+		interval := idleTimeout / 2
+		if interval < minReapInterval {
+			interval = minReapInterval
+		}
+		go p.reap(interval)
+	}
+	return p
+}
+
+// Send sends an email containing the user token to `recipient`, reusing
+// an idle connection if one is available.
+func (p *SMTPPool) Send(ctx context.Context, token, uid, recipient string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Cap concurrency
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.sem }()
+
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.transport.deliver(ctx, c.Client, token, uid, recipient)
+
+	// Reset the connection so it can be reused, even if delivery failed
+	if rerr := c.Reset(); rerr != nil {
+		c.Close()
+	} else {
+		p.put(c)
+	}
+	return err
+}
+
+// Close closes all idle connections. Connections in use are closed once
+// released, and subsequent calls to Send fail with ErrPoolClosed.
+func (p *SMTPPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		quit(c.Client)
+	}
+	return nil
+}
+
+// get returns a live connection, either idle or newly dialled.
+func (p *SMTPPool) get(ctx context.Context) (*pooledClient, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.WithStack(ErrPoolClosed)
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// Most recently used first, so surplus connections expire
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.expired(c, time.Now()) {
+			quit(c.Client)
+			continue
+		}
+		// Detect connections dropped by the server
+		if err := c.Noop(); err != nil {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	c, err := p.transport.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledClient{Client: c}, nil
+}
+
+// put returns a connection to the pool.
+func (p *SMTPPool) put(c *pooledClient) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		quit(c.Client)
+		return
+	}
+	c.lastUsed = time.Now()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// reap periodically closes expired idle connections, until the pool is
+// closed.
+func (p *SMTPPool) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			live := p.idle[:0]
+			expired := []*pooledClient{}
+			for _, c := range p.idle {
+				if p.expired(c, now) {
+					expired = append(expired, c)
+				} else {
+					live = append(live, c)
+				}
+			}
+			p.idle = live
+			p.mu.Unlock()
+			for _, c := range expired {
+				quit(c.Client)
+			}
+		}
+	}
+}
+
+func (p *SMTPPool) expired(c *pooledClient, now time.Time) bool {
+	return p.IdleTimeout > 0 && now.Sub(c.lastUsed) > p.IdleTimeout
+}
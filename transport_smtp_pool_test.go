@@ -0,0 +1,107 @@
+package passwordless
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozey/go-passwordless-sqlite/smtptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMTPPool(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+	p := NewSMTPPool(NewSMTPTransport(
+		s.Addr, "noreply@example.com", nil, testComposer), 2, time.Minute)
+	defer p.Close()
+
+	// Sequential messages reuse a single connection
+	for i := 0; i < 5; i++ {
+		require.NoError(t, p.Send(nil, fmt.Sprint(i), "uid", "bender@ilovebender.com"))
+	}
+	accepted, _ := s.Conns()
+	require.Equal(t, 1, accepted)
+	require.Len(t, s.Messages(), 5)
+	require.Equal(t, []string{
+		"EHLO", "MAIL", "RCPT", "DATA", "RSET",
+		"NOOP", "MAIL", "RCPT", "DATA", "RSET",
+	}, s.Commands()[:10])
+
+	// Concurrent messages are capped
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, p.Send(nil, "token", "uid", "bender@ilovebender.com"))
+		}()
+	}
+	wg.Wait()
+	accepted, _ = s.Conns()
+	require.LessOrEqual(t, accepted, 2)
+	require.Len(t, s.Messages(), 15)
+
+	// Dead connections are detected and replaced
+	s.CloseClientConnections()
+	require.NoError(t, p.Send(nil, "token", "uid", "bender@ilovebender.com"))
+	accepted, _ = s.Conns()
+	require.Greater(t, accepted, 1)
+
+	// Closed pool quits connections and refuses to send
+	require.NoError(t, p.Close())
+	require.Eventually(t, func() bool {
+		accepted, closed := s.Conns()
+		return accepted == closed
+	}, time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, p.Send(nil, "token", "uid", "recipient"), ErrPoolClosed)
+}
+
+func TestSMTPPoolIdleTimeout(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+	p := NewSMTPPool(NewSMTPTransport(
+		s.Addr, "noreply@example.com", nil, testComposer), 1, 20*time.Millisecond)
+	defer p.Close()
+
+	require.NoError(t, p.Send(nil, "token", "uid", "bender@ilovebender.com"))
+	require.Eventually(t, func() bool {
+		_, closed := s.Conns()
+		return closed == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Contains(t, s.Commands(), "QUIT")
+
+	// A new connection is dialled after expiry
+	require.NoError(t, p.Send(nil, "token", "uid", "bender@ilovebender.com"))
+	accepted, _ := s.Conns()
+	require.Equal(t, 2, accepted)
+	require.Len(t, s.Messages(), 2)
+
+	// Tiny timeouts expire connections all the same
+	tiny := NewSMTPPool(NewSMTPTransport(
+		s.Addr, "noreply@example.com", nil, testComposer), 1, time.Nanosecond)
+	defer tiny.Close()
+	require.NoError(t, tiny.Send(nil, "token", "uid", "bender@ilovebender.com"))
+	require.Eventually(t, func() bool {
+		_, closed := s.Conns()
+		return closed == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSMTPPoolContext(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+	p := NewSMTPPool(NewSMTPTransport(
+		s.Addr, "noreply@example.com", nil, testComposer), 1, 0)
+	defer p.Close()
+
+	// Occupy the only connection slot
+	p.sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Send(ctx, "token", "uid", "recipient"), context.DeadlineExceeded)
+	<-p.sem
+	require.NoError(t, p.Send(context.Background(), "token", "uid", "recipient"))
+}
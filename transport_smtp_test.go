@@ -1,69 +1,295 @@
 package passwordless
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
+	"io"
+	"mime"
 	"mime/multipart"
-	"net/mail"
+	"net"
+	"net/smtp"
 	"regexp"
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/assert"
+	"github.com/mozey/go-passwordless-sqlite/smtptest"
+	"github.com/stretchr/testify/require"
 )
 
-func TestEmail(t *testing.T) {
+func testComposer(ctx context.Context, token, uid, recipient string, w io.Writer) error {
+	e := &Email{To: recipient, Subject: "Token"}
+	e.AddBody("text/plain", "Your token is "+token)
+	_, err := e.Write(w)
+	return err
+}
+
+func TestSMTPTransport(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+	tr := NewSMTPTransport(s.Addr, "noreply@example.com", nil, testComposer)
+
+	require.NoError(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"))
+	messages := s.Messages()
+	require.Len(t, messages, 1)
+	require.Equal(t, "noreply@example.com", messages[0].From)
+	require.Equal(t, []string{"bender@ilovebender.com"}, messages[0].To)
+	require.Contains(t, string(messages[0].Data), "Your token is 1337")
+	require.Equal(t, []string{"EHLO", "MAIL", "RCPT", "DATA", "QUIT"}, s.Commands())
+	accepted, _ := s.Conns()
+	require.Equal(t, 1, accepted)
+}
+
+// TestSMTPTransportEmail checks the headers and parts of the email
+// delivered for a token, as TestEmail did before the output of Email
+// became RFC 5322/2045 compliant. The format itself is covered by
+// email_test.go.
+func TestSMTPTransportEmail(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
 	d := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
-	e := Email{
-		To:      "bender@ilovebender.com",
-		Subject: "Mom Calling",
-		Date:    d,
+	tr := NewSMTPTransport(s.Addr, "noreply@example.com", nil,
+		func(ctx context.Context, token, uid, recipient string, w io.Writer) error {
+			e := &Email{To: recipient, Subject: "Mom Calling", Date: d}
+			e.AddBody("text/plain", "Hello dear, your token is "+token)
+			e.AddBody("text/html", "<html><body>Hello dear</body></html>")
+			_, err := e.Write(w)
+			return err
+		})
+	require.NoError(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"))
+	messages := s.Messages()
+	require.Len(t, messages, 1)
+
+	m, err := messages[0].Parse()
+	require.NoError(t, err)
+	require.Equal(t, "<bender@ilovebender.com>", m.Header.Get("To"))
+	require.Equal(t, "Mom Calling", m.Header.Get("Subject"))
+	require.Equal(t, d.Format(time.RFC1123Z), m.Header.Get("Date"))
+	require.Equal(t, "1.0", m.Header.Get("MIME-Version"))
+	require.Empty(t, m.Header.Get("Content-Transfer-Encoding"))
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mt)
+
+	// Parts are ordered from least- to most-preferable
+	mpr := multipart.NewReader(m.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", "Hello dear, your token is 1337"},
+		{"text/html; charset=UTF-8", "<html><body>Hello dear</body></html>"},
+	} {
+		p, err := mpr.NextPart()
+		require.NoError(t, err)
+		require.Equal(t, want.contentType, p.Header.Get("Content-Type"))
+		// The quoted-printable encoding is removed by the reader
+		body, err := io.ReadAll(p)
+		require.NoError(t, err)
+		require.Equal(t, want.body, string(body))
 	}
+	_, err = mpr.NextPart()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestSMTPTransportTLSPolicy(t *testing.T) {
+	users := map[string]string{"user": "pass"}
+	auth := smtp.PlainAuth("", "user", "pass", "127.0.0.1")
+
+	// Opportunistic without STARTTLS sends in clear text
+	s := smtptest.NewServer()
+	defer s.Close()
+	tr := NewSMTPTransport(s.Addr, "noreply@example.com", nil, testComposer)
+	require.NoError(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"))
+
+	// ...but refuses to authenticate
+	s = smtptest.NewUnstartedServer()
+	s.Users = users
+	s.Start()
+	defer s.Close()
+	tr = NewSMTPTransport(s.Addr, "noreply@example.com", auth, testComposer)
+	require.ErrorIs(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"), ErrInsecureAuth)
+	require.Equal(t, []string{"EHLO", "QUIT"}, s.Commands())
+
+	// Required STARTTLS fails closed
+	s = smtptest.NewServer()
+	defer s.Close()
+	tr = NewSMTPTransport(s.Addr, "noreply@example.com", nil, testComposer)
+	tr.TLSPolicy = TLSRequireSTARTTLS
+	require.ErrorIs(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"), ErrSTARTTLSNotSupported)
+	require.NotContains(t, s.Commands(), "MAIL")
+
+	// Upgraded with STARTTLS, verifying the server with a custom CA pool
+	s = smtptest.NewUnstartedServer()
+	s.Users = users
+	s.StartTLS()
+	defer s.Close()
+	tr = NewSMTPTransport(s.Addr, "noreply@example.com", auth, testComposer)
+	tr.TLSPolicy = TLSRequireSTARTTLS
+	require.Error(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"),
+		"certificate should not be trusted")
+	clientTLS := s.ClientTLSConfig()
+	tr.TLSConfig = clientTLS
+	require.NoError(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"))
+	require.Equal(t, []string{
+		"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT",
+	}, s.Commands()[2:])
+	m := s.Messages()[0]
+	require.True(t, m.TLS)
+	require.Equal(t, "user", m.User)
+
+	// Implicit TLS
+	s = smtptest.NewUnstartedServer()
+	s.Users = users
+	s.StartImplicitTLS()
+	defer s.Close()
+	tr = NewSMTPTransport(s.Addr, "noreply@example.com", auth, testComposer)
+	tr.TLSPolicy = TLSImplicit
+	clientTLS = s.ClientTLSConfig()
+	tr.TLSConfig = clientTLS
+	require.NoError(t, tr.Send(nil, "1337", "uid", "bender@ilovebender.com"))
+	require.Equal(t, []string{"EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT"}, s.Commands())
+	require.Empty(t, clientTLS.ServerName, "config should not be modified")
+}
+
+func TestSMTPTransportFailures(t *testing.T) {
+	for _, tc := range []struct {
+		reject   map[string]int
+		composer ComposerFunc
+		phase    string
+		code     int
+		commands []string
+	}{
+		{
+			reject:   map[string]int{"GREETING": 554},
+			phase:    SMTPPhaseGreeting,
+			code:     554,
+			commands: []string{},
+		},
+		{
+			reject:   map[string]int{"EHLO": 500, "HELO": 501},
+			phase:    SMTPPhaseHello,
+			code:     501,
+			commands: []string{"EHLO", "HELO", "QUIT"},
+		},
+		{
+			reject:   map[string]int{"AUTH": 535},
+			phase:    SMTPPhaseAuth,
+			code:     535,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "*", "QUIT"},
+		},
+		{
+			composer: func(context.Context, string, string, string, io.Writer) error {
+				return errors.New("bad template")
+			},
+			phase:    SMTPPhaseCompose,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "QUIT"},
+		},
+		{
+			reject:   map[string]int{"MAIL": 550},
+			phase:    SMTPPhaseMail,
+			code:     550,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "QUIT"},
+		},
+		{
+			reject:   map[string]int{"RCPT": 553},
+			phase:    SMTPPhaseRcpt,
+			code:     553,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "QUIT"},
+		},
+		{
+			reject:   map[string]int{"DATA": 554},
+			phase:    SMTPPhaseData,
+			code:     554,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT"},
+		},
+		{
+			reject:   map[string]int{".": 552},
+			phase:    SMTPPhaseData,
+			code:     552,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT"},
+		},
+		{
+			reject:   map[string]int{"QUIT": 500},
+			phase:    SMTPPhaseQuit,
+			code:     500,
+			commands: []string{"EHLO", "STARTTLS", "EHLO", "AUTH", "MAIL", "RCPT", "DATA", "QUIT"},
+		},
+	} {
+		t.Run(tc.phase, func(t *testing.T) {
+			s := smtptest.NewUnstartedServer()
+			s.Users = map[string]string{"user": "pass"}
+			s.Reject = tc.reject
+			s.StartTLS()
+			defer s.Close()
+			composer := tc.composer
+			if composer == nil {
+				composer = testComposer
+			}
+			tr := NewSMTPTransport(s.Addr, "noreply@example.com",
+				smtp.PlainAuth("", "user", "pass", "127.0.0.1"), composer)
+			tr.TLSConfig = s.ClientTLSConfig()
+
+			err := tr.Send(nil, "1337", "uid", "bender@ilovebender.com")
+			var se *SMTPError
+			require.True(t, errors.As(err, &se), "%v", err)
+			require.Equal(t, tc.phase, se.Phase)
+			require.Equal(t, tc.code, se.Code)
+			require.Contains(t, err.Error(), "smtp "+tc.phase+": ")
+
+			// Every connection is closed
+			require.Eventually(t, func() bool {
+				accepted, closed := s.Conns()
+				return accepted == 1 && closed == 1
+			}, time.Second, 10*time.Millisecond)
+			require.Equal(t, tc.commands, s.Commands())
+		})
+	}
+
+	// Dial failure
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	tr := NewSMTPTransport(addr, "noreply@example.com", nil, testComposer)
+	err = tr.Send(nil, "1337", "uid", "bender@ilovebender.com")
+	var se *SMTPError
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, SMTPPhaseDial, se.Phase)
+	require.Zero(t, se.Code)
+
+	// Implicit TLS handshake failure
+	s := smtptest.NewUnstartedServer()
+	s.StartImplicitTLS()
+	defer s.Close()
+	tr = NewSMTPTransport(s.Addr, "noreply@example.com", nil, testComposer)
+	tr.UseSSL = true
+	err = tr.Send(nil, "1337", "uid", "bender@ilovebender.com")
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, SMTPPhaseDial, se.Phase)
+}
+
+func TestSMTPTransportEndToEnd(t *testing.T) {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.SetTransport("email", NewSMTPTransport(s.Addr, "noreply@example.com", nil,
+		NewTemplateComposer(testEmailTemplates(t), "en", "noreply@example.com", nil)),
+		NewCrockfordGenerator(8), time.Minute)
+
+	require.NoError(t, p.RequestToken(nil, PurposeLogin, "email", "uid", "bender@ilovebender.com"))
+	messages := s.WaitMessages(1, time.Second)
+	require.Len(t, messages, 1)
+	m, err := messages[0].Parse()
+	require.NoError(t, err)
+	require.Equal(t, "Sign in to bender@ilovebender.com", m.Header.Get("Subject"))
 
-	// Empty body
-	m, err := mail.ReadMessage(e.Buffer())
-	assert.NoError(t, err)
-	assert.Equal(t, "bender@ilovebender.com", m.Header.Get("To"))
-	assert.Equal(t, "Mom Calling", m.Header.Get("Subject"))
-	assert.Equal(t, d.Format(time.RFC822), m.Header.Get("Date"))
-
-	// Plain body
-	e.AddBody("", "Hello dear")
-	m, err = mail.ReadMessage(e.Buffer())
-	assert.NoError(t, err)
-	assert.Equal(t, "text/plain; charset=\"UTF-8\";", m.Header.Get("Content-Type"))
-	body, err := ioutil.ReadAll(m.Body)
-	assert.NoError(t, err)
-	assert.Equal(t, "Hello dear\r\n", string(body))
-
-	// Additional HTML body (multipart)
-	e.AddBody("text/html", "<html><body>Hello dear</body></html>")
-	m, err = mail.ReadMessage(e.Buffer())
-	assert.Equal(t, "1.0", m.Header.Get("MIME-Version"))
-	ct := m.Header.Get("Content-Type")
-	re := regexp.MustCompile("^multipart/alternative; boundary=([a-z0-9]+)$")
-	assert.Regexp(t, re, ct)
-	boundary := re.FindStringSubmatch(ct)[1]
-	assert.NotEmpty(t, boundary)
-
-	mpr := multipart.NewReader(m.Body, boundary)
-
-	// Read first part
-	p, err := mpr.NextPart()
-	assert.NoError(t, err, "reading first part")
-	assert.Equal(t, "text/plain; charset=\"UTF-8\";", p.Header.Get("Content-Type"))
-	body, err = ioutil.ReadAll(p)
-	assert.NoError(t, err, "reading body of first part")
-	assert.Equal(t, "Hello dear", string(body))
-
-	// Read second part
-	p, err = mpr.NextPart()
-	assert.NoError(t, err, "reading second part")
-	assert.Equal(t, "text/html; charset=\"UTF-8\";", p.Header.Get("Content-Type"))
-	body, err = ioutil.ReadAll(p)
-	assert.NoError(t, err, "reading body of second part")
-	assert.Equal(t, "<html><body>Hello dear</body></html>", string(body))
-
-	// Read (non-existent) next part
-	p, err = mpr.NextPart()
-	assert.Nil(t, p)
+	// Extract the token from the plain text part
+	token := regexp.MustCompile(`Your PIN is ([0-9a-z]{8})`).
+		FindStringSubmatch(string(messages[0].Data))
+	require.Len(t, token, 2)
+	valid, err := p.VerifyToken(nil, PurposeLogin, "uid", token[1])
+	require.NoError(t, err)
+	require.True(t, valid)
 }
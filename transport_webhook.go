@@ -0,0 +1,234 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrWebhookURLNotValid       = errors.New("webhook url is not valid")
+	ErrWebhookFailed            = errors.New("webhook delivery failed")
+	ErrWebhookSignatureNotValid = errors.New("webhook signature is not valid")
+	ErrWebhookTimestampExpired  = errors.New("webhook timestamp is outside the tolerance")
+)
+
+// WebhookSignatureHeader is the default header carrying the HMAC signature
+// of webhook payloads.
+const WebhookSignatureHeader = "X-Passwordless-Signature"
+
+// WebhookTimestampHeader carries the time a payload was signed, in Unix
+// seconds. It is covered by the signature, so that receivers can reject
+// replayed deliveries.
+const WebhookTimestampHeader = "X-Passwordless-Timestamp"
+
+// DefaultWebhookTolerance is how old a signed payload may be when checked
+// by `VerifyWebhookSignature`. It must exceed the retry schedule and clock
+// skew between sender and receiver.
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// DefaultWebhookTemplate is the JSON body posted when no template is set.
+const DefaultWebhookTemplate = `{"token":{{json .Token}},"uid":{{json .UID}},"recipient":{{json .Recipient}}}`
+
+// defaultWebhookTemplate is used by transports created without
+// `NewWebhookTransport`.
+var defaultWebhookTemplate = template.Must(template.New("webhook").Funcs(
+	template.FuncMap{"json": webhookJSON}).Parse(DefaultWebhookTemplate))
+
+// WebhookData is passed to the WebhookTransport body template.
+type WebhookData struct {
+	Token     string
+	UID       string
+	Recipient string
+}
+
+// WebhookTransport delivers a user token by POSTing a JSON body to a URL,
+// e.g. a chat bot or notification service.
+type WebhookTransport struct {
+	// URL the payload is posted to
+	URL string
+	// Secret used to sign the timestamp and payload with HMAC-SHA256, see
+	// `VerifyWebhookSignature`. If empty, the payload is not signed.
+	Secret []byte
+	// SignatureHeader is the header name carrying the signature, in the
+	// form "sha256=<hex>". Defaults to WebhookSignatureHeader.
+	SignatureHeader string
+	// Header contains additional headers added to each request
+	Header http.Header
+	// Client is used to make requests, http.DefaultClient if nil
+	Client *http.Client
+	// MaxRetries is the number of times a request is retried after a
+	// 5xx response or network error
+	MaxRetries int
+	// RetryWait is the delay before the first retry, doubled after each
+	// subsequent attempt
+	RetryWait time.Duration
+
+	tmpl *template.Template
+}
+
+// NewWebhookTransport returns a new transport that posts tokens to the
+// given URL, signing payloads with secret. If tmpl is empty,
+// DefaultWebhookTemplate is used. The template is executed with
+// WebhookData, and values should be written with the "json" function to
+// ensure the body is valid JSON.
+func NewWebhookTransport(url string, secret []byte, tmpl string) (*WebhookTransport, error) {
+	if url == "" {
+		return nil, errors.WithStack(ErrWebhookURLNotValid)
+	}
+	if tmpl == "" {
+		tmpl = DefaultWebhookTemplate
+	}
+	t, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": webhookJSON,
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &WebhookTransport{
+		URL:             url,
+		Secret:          secret,
+		SignatureHeader: WebhookSignatureHeader,
+		MaxRetries:      3,
+		RetryWait:       500 * time.Millisecond,
+		tmpl:            t,
+	}, nil
+}
+
+// Send posts the token to the configured URL. Requests are retried on
+// 5xx responses and network errors, until MaxRetries is reached or the
+// context is done.
+func (t *WebhookTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tmpl := t.tmpl
+	if tmpl == nil {
+		tmpl = defaultWebhookTemplate
+	}
+	body := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(body, WebhookData{
+		Token:     token,
+		UID:       uid,
+		Recipient: recipient,
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	payload := body.Bytes()
+
+	wait := t.RetryWait
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = t.post(ctx, payload)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= t.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), err.Error())
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Sign returns the signature of the payload sent at the given time, as set
+// in the signature header.
+func (t *WebhookTransport) Sign(timestamp int64, payload []byte) string {
+	return webhookSignature(t.Secret, strconv.FormatInt(timestamp, 10), payload)
+}
+
+// VerifyWebhookSignature is used by receivers to check the signature and
+// timestamp headers of a delivery. Payloads signed more than tolerance
+// ago, or in the future, are rejected with ErrWebhookTimestampExpired.
+// Receivers that must not act twice on a delivery should also remember
+// the signatures seen within the tolerance window.
+func VerifyWebhookSignature(secret []byte, timestamp, signature string, payload []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(ErrWebhookSignatureNotValid, err.Error())
+	}
+	if !hmac.Equal([]byte(webhookSignature(secret, timestamp, payload)), []byte(signature)) {
+		return errors.WithStack(ErrWebhookSignatureNotValid)
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > tolerance || age < -tolerance {
+		return errors.WithStack(ErrWebhookTimestampExpired)
+	}
+	return nil
+}
+
+// webhookSignature signs the timestamp and payload, separated by a dot.
+func webhookSignature(secret []byte, timestamp string, payload []byte) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(timestamp + "."))
+	m.Write(payload)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// post makes a single delivery attempt, returning true if a failed
+// attempt may be retried.
+func (t *WebhookTransport) post(ctx context.Context, payload []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, t.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for k, v := range t.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(t.Secret) > 0 {
+		h := t.SignatureHeader
+		if h == "" {
+			h = WebhookSignatureHeader
+		}
+		// Each attempt is signed with its own timestamp
+		now := time.Now().Unix()
+		req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now, 10))
+		req.Header.Set(h, t.Sign(now, payload))
+	}
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// Don't retry once the context is done
+		return ctx.Err() == nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode >= 500, errors.Wrapf(ErrWebhookFailed,
+		"%s responded %s", t.URL, resp.Status)
+}
+
+// webhookJSON encodes v as JSON for use in templates.
+func webhookJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("json: %v", err)
+	}
+	return string(b), nil
+}
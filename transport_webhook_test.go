@@ -0,0 +1,133 @@
+package passwordless
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookTransport(t *testing.T) {
+	var body []byte
+	var sig, ts, ct, xtest string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			sig = r.Header.Get(WebhookSignatureHeader)
+			ts = r.Header.Get(WebhookTimestampHeader)
+			ct = r.Header.Get("Content-Type")
+			xtest = r.Header.Get("X-Test")
+		}))
+	defer srv.Close()
+
+	_, err := NewWebhookTransport("", nil, "")
+	require.Error(t, err)
+
+	wt, err := NewWebhookTransport(srv.URL, []byte("secret"), "")
+	require.NoError(t, err)
+	wt.Header = http.Header{"X-Test": []string{"yes"}}
+	require.NoError(t, wt.Send(nil, "1337", "uid", `"bender"@example.com`))
+	require.Equal(t, "application/json", ct)
+	require.Equal(t, "yes", xtest)
+
+	v := map[string]string{}
+	require.NoError(t, json.Unmarshal(body, &v))
+	require.Equal(t, map[string]string{
+		"token":     "1337",
+		"uid":       "uid",
+		"recipient": `"bender"@example.com`,
+	}, v)
+	require.NoError(t, VerifyWebhookSignature(
+		[]byte("secret"), ts, sig, body, DefaultWebhookTolerance))
+	err = VerifyWebhookSignature([]byte("secret"), ts, sig, []byte("tampered"), DefaultWebhookTolerance)
+	require.True(t, errors.Is(err, ErrWebhookSignatureNotValid))
+	err = VerifyWebhookSignature([]byte("other"), ts, sig, body, DefaultWebhookTolerance)
+	require.True(t, errors.Is(err, ErrWebhookSignatureNotValid))
+
+	// The timestamp is signed, so old deliveries can't be replayed with a
+	// new one
+	old := time.Now().Add(-time.Hour).Unix()
+	err = VerifyWebhookSignature([]byte("secret"), strconv.FormatInt(old, 10),
+		wt.Sign(old, body), body, DefaultWebhookTolerance)
+	require.True(t, errors.Is(err, ErrWebhookTimestampExpired))
+	err = VerifyWebhookSignature([]byte("secret"), strconv.FormatInt(old+1, 10),
+		sig, body, DefaultWebhookTolerance)
+	require.True(t, errors.Is(err, ErrWebhookSignatureNotValid))
+
+	// Custom template
+	wt, err = NewWebhookTransport(srv.URL, nil,
+		`{"text":{{json (printf "Your code is %s" .Token)}}}`)
+	require.NoError(t, err)
+	require.NoError(t, wt.Send(nil, "1337", "uid", "recipient"))
+	require.JSONEq(t, `{"text":"Your code is 1337"}`, string(body))
+	require.Empty(t, sig, "unsigned without secret")
+
+	// Struct literals use the default template
+	wt = &WebhookTransport{URL: srv.URL, Secret: []byte("secret")}
+	require.NoError(t, wt.Send(nil, "1337", "uid", "recipient"))
+	require.JSONEq(t, `{"token":"1337","uid":"uid","recipient":"recipient"}`, string(body))
+	require.NoError(t, VerifyWebhookSignature(
+		[]byte("secret"), ts, sig, body, DefaultWebhookTolerance))
+}
+
+func TestWebhookTransportRetry(t *testing.T) {
+	var calls int32
+	status := http.StatusBadGateway
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(status)
+			}
+		}))
+	defer srv.Close()
+
+	wt, err := NewWebhookTransport(srv.URL, nil, "")
+	require.NoError(t, err)
+	wt.RetryWait = time.Millisecond
+
+	// Succeeds on third attempt
+	require.NoError(t, wt.Send(nil, "token", "uid", "recipient"))
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Gives up after MaxRetries
+	atomic.StoreInt32(&calls, -10)
+	wt.MaxRetries = 2
+	err = wt.Send(nil, "token", "uid", "recipient")
+	require.True(t, errors.Is(err, ErrWebhookFailed))
+	require.Equal(t, int32(-7), atomic.LoadInt32(&calls))
+
+	// 4xx responses are not retried
+	atomic.StoreInt32(&calls, 0)
+	status = http.StatusBadRequest
+	err = wt.Send(nil, "token", "uid", "recipient")
+	require.True(t, errors.Is(err, ErrWebhookFailed))
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookTransportDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer srv.Close()
+
+	wt, err := NewWebhookTransport(srv.URL, nil, "")
+	require.NoError(t, err)
+	wt.MaxRetries = 100
+	wt.RetryWait = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = wt.Send(ctx, "token", "uid", "recipient")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,608 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrWebAuthnResponseNotValid  = errors.New("webauthn response is not valid")
+	ErrChallengeNotValid         = errors.New("webauthn challenge is not valid")
+	ErrCredentialNotFound        = errors.New("credential does not exist")
+	ErrCredentialExists          = errors.New("credential is already registered")
+	ErrCredentialKeyNotSupported = errors.New("credential key type is not supported")
+	ErrSignCountNotValid         = errors.New("credential sign count did not increase, it may be cloned")
+)
+
+// PurposeWebAuthnRegistration is the purpose of registration challenges in
+// the token store. Login challenges are stored for the purpose from the
+// context prefixed with "webauthn_", e.g. "webauthn_login".
+const PurposeWebAuthnRegistration = "webauthn_registration"
+
+// COSE algorithm identifiers of the supported credential keys
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	authDataUserPresent   = 0x01
+	authDataUserVerified  = 0x04
+	authDataAttestedCreds = 0x40
+)
+
+// Base64URL is binary data, encoded as unpadded base64url in JSON as used
+// by the WebAuthn JSON serialisation, e.g. `PublicKeyCredential.toJSON()`.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = d
+	return nil
+}
+
+// Credential is a public key credential, i.e. a passkey, registered by a
+// user.
+type Credential struct {
+	ID  []byte
+	UID string
+	// PublicKey is the COSE encoded public key
+	PublicKey []byte
+	// SignCount is the signature counter last reported by the authenticator
+	SignCount uint32
+	// Transports are hints of how the authenticator is reached, e.g. "usb"
+	Transports []string
+	Created    time.Time
+	LastUsed   time.Time
+}
+
+// CredentialStore persists the WebAuthn credentials of users.
+type CredentialStore interface {
+	// AddCredential stores a new credential, or fails with
+	// ErrCredentialExists if the ID is already registered
+	AddCredential(ctx context.Context, c *Credential) error
+	// Credentials returns the credentials of the user
+	Credentials(ctx context.Context, uid string) ([]*Credential, error)
+	// UpdateCredential records the use of a credential
+	UpdateCredential(ctx context.Context, uid string, id []byte, signCount uint32, lastUsed time.Time) error
+	// DeleteCredential removes a credential of the user
+	DeleteCredential(ctx context.Context, uid string, id []byte) error
+	// UserHandle returns the user handle identifying the user to
+	// authenticators, a random ID generated and kept on first use
+	UserHandle(ctx context.Context, uid string) ([]byte, error)
+}
+
+// RelyingParty identifies the site to authenticators.
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUser identifies the user to authenticators.
+type WebAuthnUser struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+// CredentialParameter is a supported credential key type.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor refers to a registered credential.
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection states requirements of authenticators.
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+// CredentialCreationOptions are passed to `navigator.credentials.create`,
+// e.g. after `PublicKeyCredential.parseCreationOptionsFromJSON`.
+type CredentialCreationOptions struct {
+	Challenge              Base64URL              `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   WebAuthnUser           `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// CredentialRequestOptions are passed to `navigator.credentials.get`, e.g.
+// after `PublicKeyCredential.parseRequestOptionsFromJSON`.
+type CredentialRequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// RegistrationResponse is the JSON serialisation of the credential
+// returned by `navigator.credentials.create`.
+type RegistrationResponse struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AttestationObject Base64URL `json:"attestationObject"`
+		Transports        []string  `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON serialisation of the credential returned
+// by `navigator.credentials.get`.
+type AssertionResponse struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AuthenticatorData Base64URL `json:"authenticatorData"`
+		Signature         Base64URL `json:"signature"`
+		UserHandle        Base64URL `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// WebAuthn is a Strategy for passkeys, see https://www.w3.org/TR/webauthn/.
+// Users register a credential with `BeginRegistration` and
+// `FinishRegistration`, typically once they signed in with a token sent to
+// them. Later sign ins start with `BeginLogin`, and the assertion returned
+// by the browser is verified as the token, e.g. with `VerifyRecipient`.
+// Challenges are kept in a TokenStore, e.g. SQLiteStore, so each is used
+// once. Attestation is not requested, so the make of the authenticator is
+// not verified.
+type WebAuthn struct {
+	NopTransport
+	// RPID is the domain credentials are scoped to, e.g. "example.com"
+	RPID string
+	// RPName is shown to users by authenticators, and defaults to RPID
+	RPName string
+	// Origins are the origins the ceremonies may run on, e.g.
+	// "https://example.com"
+	Origins     []string
+	Challenges  TokenStore
+	Credentials CredentialStore
+	// Timeout of ceremonies, after which challenges expire
+	Timeout time.Duration
+	// UserVerification is "required", "preferred" or "discouraged". If
+	// required, responses without user verification are rejected.
+	UserVerification string
+	valid            []ValidFunc
+}
+
+// NewWebAuthn returns a WebAuthn strategy for the relying party ID, running
+// on origin, with a timeout of 5 minutes and preferring user verification.
+// The strategy is only valid for contexts satisfying all of the
+// predicates.
+func NewWebAuthn(rpID, origin string, challenges TokenStore, credentials CredentialStore, valid ...ValidFunc) *WebAuthn {
+	return &WebAuthn{
+		RPID:             rpID,
+		Origins:          []string{origin},
+		Challenges:       challenges,
+		Credentials:      credentials,
+		Timeout:          5 * time.Minute,
+		UserVerification: "preferred",
+		valid:            valid,
+	}
+}
+
+// Generate returns an empty token, as assertions are made by the
+// authenticator.
+func (w *WebAuthn) Generate(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// Sanitize returns the token as is.
+func (w *WebAuthn) Sanitize(ctx context.Context, t string) (string, error) {
+	return t, nil
+}
+
+// TTL returns the timeout of ceremonies.
+func (w *WebAuthn) TTL(context.Context) time.Duration {
+	return w.Timeout
+}
+
+// Valid returns true if the context satisfies all validity predicates.
+func (w *WebAuthn) Valid(ctx context.Context) bool {
+	return AllOf(w.valid...)(ctx)
+}
+
+// BeginRegistration returns the options to create a credential for the
+// user. The name, e.g. the email address, and display name are shown by
+// the authenticator. Only register credentials for users that proved who
+// they are, e.g. by signing in with a token sent to them.
+func (w *WebAuthn) BeginRegistration(ctx context.Context, uid, name, displayName string) (*CredentialCreationOptions, error) {
+	creds, err := w.Credentials.Credentials(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	// Authenticators may show or sync the handle, so it must not contain
+	// personal data such as the uid or email address
+	handle, err := w.Credentials.UserHandle(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := w.challenge(WithPurpose(ctx, PurposeWebAuthnRegistration), uid)
+	if err != nil {
+		return nil, err
+	}
+	rpName := w.RPName
+	if rpName == "" {
+		rpName = w.RPID
+	}
+	return &CredentialCreationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: w.RPID, Name: rpName},
+		User: WebAuthnUser{
+			ID:          handle,
+			Name:        name,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            w.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(creds),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: w.UserVerification,
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishRegistration verifies the response to `BeginRegistration`, and
+// stores the new credential.
+func (w *WebAuthn) FinishRegistration(ctx context.Context, uid string, r *RegistrationResponse) (*Credential, error) {
+	ctx = WithPurpose(ctx, PurposeWebAuthnRegistration)
+	if r.Type != "public-key" {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "type")
+	}
+	if err := w.verifyClientData(ctx, uid, "webauthn.create", r.Response.ClientDataJSON); err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(r.Response.AttestationObject)
+	if err != nil {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "attestation object")
+	}
+	obj, _ := v.(map[interface{}]interface{})
+	raw, _ := obj["authData"].([]byte)
+	ad, err := w.parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&authDataAttestedCreds == 0 || !bytes.Equal(ad.credID, r.RawID) {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "credential data")
+	}
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	c := &Credential{
+		ID:         ad.credID,
+		UID:        uid,
+		PublicKey:  ad.publicKey,
+		SignCount:  ad.signCount,
+		Transports: r.Response.Transports,
+		Created:    now,
+		LastUsed:   now,
+	}
+	if err := w.Credentials.AddCredential(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BeginLogin returns the options to sign in with one of the credentials
+// of the user. The challenge is scoped to the purpose in the context, see
+// `WithPurpose`. It fails with ErrCredentialNotFound if the user has none.
+func (w *WebAuthn) BeginLogin(ctx context.Context, uid string) (*CredentialRequestOptions, error) {
+	creds, err := w.Credentials.Credentials(ctx, uid)
+	if err != nil {
+		return nil, err
+	} else if len(creds) == 0 {
+		return nil, errors.WithStack(ErrCredentialNotFound)
+	}
+	challenge, err := w.challenge(w.loginContext(ctx), uid)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          w.Timeout.Milliseconds(),
+		RPID:             w.RPID,
+		AllowCredentials: descriptors(creds),
+		UserVerification: w.UserVerification,
+	}, nil
+}
+
+// FinishLogin verifies the response to `BeginLogin`. It returns false if
+// the challenge or signature is not valid, and fails with
+// ErrSignCountNotValid if the signature counter went backwards, which
+// suggests the authenticator was cloned.
+func (w *WebAuthn) FinishLogin(ctx context.Context, uid string, r *AssertionResponse) (bool, error) {
+	ctx = w.loginContext(ctx)
+	if r.Type != "public-key" {
+		return false, errors.Wrap(ErrWebAuthnResponseNotValid, "type")
+	}
+	creds, err := w.Credentials.Credentials(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	var c *Credential
+	for _, cred := range creds {
+		if bytes.Equal(cred.ID, r.RawID) {
+			c = cred
+		}
+	}
+	if c == nil {
+		return false, errors.WithStack(ErrCredentialNotFound)
+	}
+	if len(r.Response.UserHandle) > 0 {
+		handle, err := w.Credentials.UserHandle(ctx, uid)
+		if err != nil {
+			return false, err
+		} else if !bytes.Equal(handle, r.Response.UserHandle) {
+			return false, errors.Wrap(ErrWebAuthnResponseNotValid, "user handle")
+		}
+	}
+	err = w.verifyClientData(ctx, uid, "webauthn.get", r.Response.ClientDataJSON)
+	if errors.Is(err, ErrChallengeNotValid) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	ad, err := w.parseAuthData(r.Response.AuthenticatorData)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte{}, r.Response.AuthenticatorData...), hash[:]...)
+	if valid, err := verifyCOSE(c.PublicKey, signed, r.Response.Signature); err != nil || !valid {
+		return false, err
+	}
+	// Authenticators that don't count always report zero
+	if (ad.signCount != 0 || c.SignCount != 0) && ad.signCount <= c.SignCount {
+		return false, errors.WithStack(ErrSignCountNotValid)
+	}
+	if err := w.Credentials.UpdateCredential(
+		ctx, uid, c.ID, ad.signCount, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyToken verifies the JSON encoded AssertionResponse in token, see
+// `FinishLogin`.
+func (w *WebAuthn) VerifyToken(ctx context.Context, uid, token string) (bool, error) {
+	r := &AssertionResponse{}
+	if err := json.Unmarshal([]byte(token), r); err != nil {
+		return false, errors.Wrap(ErrWebAuthnResponseNotValid, err.Error())
+	}
+	return w.FinishLogin(ctx, uid, r)
+}
+
+// loginContext returns the context for login challenges.
+func (w *WebAuthn) loginContext(ctx context.Context) context.Context {
+	return WithPurpose(ctx, "webauthn_"+PurposeFromContext(ctx))
+}
+
+// challenge generates and stores a challenge for the user, for the purpose
+// in the context.
+func (w *WebAuthn) challenge(ctx context.Context, uid string) (Base64URL, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err := w.Challenges.Store(
+		ctx, base64.RawURLEncoding.EncodeToString(b), uid, w.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// verifyClientData checks the client data of a ceremony of the given type,
+// and that its challenge was issued to the user for the purpose in the
+// context. The challenge is then removed before the rest of the response
+// is verified, so each is tried at most once.
+func (w *WebAuthn) verifyClientData(ctx context.Context, uid, typ string, data []byte) error {
+	var cd struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return errors.Wrap(ErrWebAuthnResponseNotValid, "client data")
+	}
+	if cd.Type != typ {
+		return errors.Wrap(ErrWebAuthnResponseNotValid, "client data type")
+	}
+	originValid := false
+	for _, o := range w.Origins {
+		originValid = originValid || o == cd.Origin
+	}
+	if !originValid || cd.CrossOrigin {
+		return errors.Wrap(ErrWebAuthnResponseNotValid, "origin")
+	}
+	valid, err := w.Challenges.Verify(ctx, cd.Challenge, uid)
+	if err != nil {
+		return err
+	} else if !valid {
+		return errors.WithStack(ErrChallengeNotValid)
+	}
+	return w.Challenges.Delete(ctx, uid)
+}
+
+// authData is the parsed authenticator data of a response.
+type authData struct {
+	flags     byte
+	signCount uint32
+	// credID and publicKey are set if attested credential data is included
+	credID    []byte
+	publicKey []byte
+}
+
+// parseAuthData parses authenticator data, checking it is for the relying
+// party and that the user was present, and verified if required.
+func (w *WebAuthn) parseAuthData(b []byte) (*authData, error) {
+	if len(b) < 37 {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "authenticator data")
+	}
+	rpIDHash := sha256.Sum256([]byte(w.RPID))
+	if subtle.ConstantTimeCompare(b[:32], rpIDHash[:]) != 1 {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "relying party")
+	}
+	ad := &authData{
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "user not present")
+	}
+	if w.UserVerification == "required" && ad.flags&authDataUserVerified == 0 {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "user not verified")
+	}
+	if ad.flags&authDataAttestedCreds == 0 {
+		return ad, nil
+	}
+	// AAGUID, then the length prefixed credential ID and public key
+	b = b[37:]
+	if len(b) < 18 {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "credential data")
+	}
+	n := int(binary.BigEndian.Uint16(b[16:18]))
+	b = b[18:]
+	if len(b) < n {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "credential data")
+	}
+	ad.credID, b = b[:n], b[n:]
+	_, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, errors.Wrap(ErrWebAuthnResponseNotValid, "credential key")
+	}
+	ad.publicKey = b[:len(b)-len(rest)]
+	return ad, nil
+}
+
+// parseCOSEKey parses COSE encoded public keys of supported types, see
+// RFC 8152.
+func parseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, errors.Wrap(ErrCredentialKeyNotSupported, err.Error())
+	}
+	m, _ := v.(map[interface{}]interface{})
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	switch {
+	case kty == 2 && alg == coseAlgES256 && crv == 1:
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			break
+		}
+		k := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !k.Curve.IsOnCurve(k.X, k.Y) {
+			break
+		}
+		return k, nil
+	case kty == 1 && alg == coseAlgEdDSA && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			break
+		}
+		exp := 0
+		for _, c := range e {
+			exp = exp<<8 | int(c)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	}
+	return nil, errors.WithStack(ErrCredentialKeyNotSupported)
+}
+
+// verifyCOSE verifies the signature of data with the COSE encoded key.
+func verifyCOSE(key, data, sig []byte) (bool, error) {
+	k, err := parseCOSEKey(key)
+	if err != nil {
+		return false, err
+	}
+	switch pub := k.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, h[:], sig), nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig), nil
+	case *rsa.PublicKey:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil, nil
+	}
+	return false, errors.WithStack(ErrCredentialKeyNotSupported)
+}
+
+// descriptors returns descriptors of the credentials.
+func descriptors(creds []*Credential) []CredentialDescriptor {
+	d := make([]CredentialDescriptor, len(creds))
+	for i, c := range creds {
+		d[i] = CredentialDescriptor{
+			Type:       "public-key",
+			ID:         c.ID,
+			Transports: c.Transports,
+		}
+	}
+	return d
+}
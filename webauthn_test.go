@@ -0,0 +1,316 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// cborPairs is a CBOR map with ordered keys, for encodeCBOR
+type cborPairs [][2]interface{}
+
+// encodeCBOR encodes the subset of CBOR used by authenticators
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case cborPairs:
+		b := head(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCBOR(kv[0])...)
+			b = append(b, encodeCBOR(kv[1])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// softAuthenticator is a software authenticator with a single credential
+type softAuthenticator struct {
+	rpID, origin string
+	credID       []byte
+	userHandle   []byte
+	key          interface{}
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftAuthenticator(rpID, origin string, ed bool) *softAuthenticator {
+	a := &softAuthenticator{
+		rpID:   rpID,
+		origin: origin,
+		credID: make([]byte, 16),
+		flags:  authDataUserPresent | authDataUserVerified,
+	}
+	rand.Read(a.credID)
+	if ed {
+		_, a.key, _ = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch k := a.key.(type) {
+	case *ecdsa.PrivateKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return encodeCBOR(cborPairs{{1, 2}, {3, coseAlgES256}, {-1, 1}, {-2, x}, {-3, y}})
+	case ed25519.PrivateKey:
+		return encodeCBOR(cborPairs{{1, 1}, {3, coseAlgEdDSA}, {-1, 6},
+			{-2, []byte(k.Public().(ed25519.PublicKey))}})
+	}
+	panic("unsupported key")
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return b
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	h := sha256.Sum256([]byte(a.rpID))
+	b := append(h[:], a.flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if attested {
+		b[32] |= authDataAttestedCreds
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.credID)>>8), byte(len(a.credID)))
+		b = append(b, a.credID...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func (a *softAuthenticator) create(opts *CredentialCreationOptions) *RegistrationResponse {
+	r := &RegistrationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credID),
+		RawID: a.credID,
+		Type:  "public-key",
+	}
+	r.Response.ClientDataJSON = a.clientData("webauthn.create", opts.Challenge)
+	r.Response.AttestationObject = encodeCBOR(cborPairs{
+		{"fmt", "none"}, {"attStmt", cborPairs{}}, {"authData", a.authData(true)},
+	})
+	r.Response.Transports = []string{"internal"}
+	a.userHandle = opts.User.ID
+	return r
+}
+
+func (a *softAuthenticator) get(opts *CredentialRequestOptions) *AssertionResponse {
+	a.signCount++
+	r := &AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credID),
+		RawID: a.credID,
+		Type:  "public-key",
+	}
+	r.Response.ClientDataJSON = a.clientData("webauthn.get", opts.Challenge)
+	r.Response.AuthenticatorData = a.authData(false)
+	r.Response.UserHandle = a.userHandle
+	h := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte{}, r.Response.AuthenticatorData...), h[:]...)
+	switch k := a.key.(type) {
+	case *ecdsa.PrivateKey:
+		d := sha256.Sum256(signed)
+		r.Response.Signature, _ = ecdsa.SignASN1(rand.Reader, k, d[:])
+	case ed25519.PrivateKey:
+		r.Response.Signature = ed25519.Sign(k, signed)
+	}
+	return r
+}
+
+// roundTrip encodes and decodes v as JSON, like a browser would
+func roundTrip(t *testing.T, v, out interface{}) {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, out))
+}
+
+func TestWebAuthn(t *testing.T) {
+	db, err := createDB(t.Name())
+	require.NoError(t, err)
+	require.NoError(t, createCredentialTable(db))
+	creds, err := NewSQLiteCredentialStore(db, "")
+	require.NoError(t, err)
+	store, err := NewSQLiteStore(db, "")
+	require.NoError(t, err)
+	p := New(store)
+	p.Resolver = mapResolver{users: map[string]string{"42": "bender@ilovebender.com"}}
+	w := NewWebAuthn("example.com", "https://example.com", store, creds)
+	p.SetStrategy("passkey", w)
+	ctx := context.Background()
+
+	register := func(a *softAuthenticator) (*Credential, error) {
+		opts, err := w.BeginRegistration(ctx, "42", "bender@ilovebender.com", "Bender")
+		require.NoError(t, err)
+		o := &CredentialCreationOptions{}
+		roundTrip(t, opts, o)
+		r := &RegistrationResponse{}
+		roundTrip(t, a.create(o), r)
+		return w.FinishRegistration(ctx, "42", r)
+	}
+	login := func(ctx context.Context, a *softAuthenticator) string {
+		opts, err := w.BeginLogin(ctx, "42")
+		require.NoError(t, err)
+		o := &CredentialRequestOptions{}
+		roundTrip(t, opts, o)
+		b, err := json.Marshal(a.get(o))
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	_, err = w.BeginLogin(ctx, "42")
+	require.True(t, errors.Is(err, ErrCredentialNotFound))
+
+	a := newSoftAuthenticator("example.com", "https://example.com", false)
+	c, err := register(a)
+	require.NoError(t, err)
+	require.Equal(t, a.credID, c.ID)
+	require.Equal(t, []string{"internal"}, c.Transports)
+
+	// Registered credentials are excluded, and can't be added twice
+	opts, err := w.BeginRegistration(ctx, "42", "bender@ilovebender.com", "Bender")
+	require.NoError(t, err)
+	require.Len(t, opts.ExcludeCredentials, 1)
+	require.Equal(t, Base64URL(a.credID), opts.ExcludeCredentials[0].ID)
+	// The user handle is random rather than the uid, and kept
+	require.Len(t, opts.User.ID, WebAuthnUserHandleSize)
+	require.NotContains(t, string(opts.User.ID), "42")
+	require.Equal(t, Base64URL(a.userHandle), opts.User.ID)
+	_, err = w.FinishRegistration(ctx, "42", a.create(opts))
+	require.True(t, errors.Is(err, ErrCredentialExists))
+
+	// Sign in via the resolver, like other strategies
+	uid, valid, err := p.VerifyRecipient(ctx, PurposeLogin, "passkey",
+		"bender@ilovebender.com", login(ctx, a))
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, "42", uid)
+
+	// Challenges are used once
+	opts2, err := w.BeginLogin(ctx, "42")
+	require.NoError(t, err)
+	assertion := a.get(opts2)
+	valid, err = w.FinishLogin(ctx, "42", assertion)
+	require.NoError(t, err)
+	require.True(t, valid)
+	a.signCount++
+	_, err = w.FinishLogin(ctx, "42", assertion)
+	require.True(t, errors.Is(err, ErrTokenNotFound))
+
+	// Challenges are scoped to the purpose
+	token := login(WithPurpose(ctx, PurposeReauth), a)
+	_, err = p.VerifyStrategyToken(ctx, PurposeLogin, "passkey", "42", token)
+	require.True(t, errors.Is(err, ErrTokenNotFound))
+	valid, err = p.VerifyStrategyToken(ctx, PurposeReauth, "passkey", "42", token)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// fresh returns the options of a new login challenge
+	fresh := func() *CredentialRequestOptions {
+		opts, err := w.BeginLogin(ctx, "42")
+		require.NoError(t, err)
+		return opts
+	}
+
+	// Bad signatures and other challenges are rejected, and the challenge
+	// can't be tried again
+	opts2 = fresh()
+	assertion = a.get(opts2)
+	assertion.Response.Signature[len(assertion.Response.Signature)-1] ^= 1
+	valid, err = w.FinishLogin(ctx, "42", assertion)
+	require.NoError(t, err)
+	require.False(t, valid)
+	_, err = w.FinishLogin(ctx, "42", a.get(opts2))
+	require.True(t, errors.Is(err, ErrTokenNotFound))
+	fresh()
+	assertion = a.get(&CredentialRequestOptions{Challenge: []byte("other")})
+	valid, err = w.FinishLogin(ctx, "42", assertion)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	// Other origins and relying parties are rejected
+	a.origin = "https://example.org"
+	_, err = w.FinishLogin(ctx, "42", a.get(fresh()))
+	require.True(t, errors.Is(err, ErrWebAuthnResponseNotValid))
+	a.origin, a.rpID = "https://example.com", "example.org"
+	_, err = w.FinishLogin(ctx, "42", a.get(fresh()))
+	require.True(t, errors.Is(err, ErrWebAuthnResponseNotValid))
+	a.rpID = "example.com"
+
+	// User handles must match the user
+	assertion = a.get(fresh())
+	assertion.Response.UserHandle = Base64URL("42")
+	_, err = w.FinishLogin(ctx, "42", assertion)
+	require.True(t, errors.Is(err, ErrWebAuthnResponseNotValid))
+
+	// A sign count going backwards suggests a cloned authenticator
+	a.signCount = 1
+	_, err = w.FinishLogin(ctx, "42", a.get(fresh()))
+	require.True(t, errors.Is(err, ErrSignCountNotValid))
+
+	// User verification is enforced if required
+	w.UserVerification = "required"
+	a.signCount = 100
+	a.flags = authDataUserPresent
+	_, err = w.FinishLogin(ctx, "42", a.get(fresh()))
+	require.True(t, errors.Is(err, ErrWebAuthnResponseNotValid))
+	a.flags |= authDataUserVerified
+	valid, err = w.FinishLogin(ctx, "42", a.get(fresh()))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Credentials of other users are not accepted
+	_, err = w.FinishLogin(ctx, "43", a.get(fresh()))
+	require.True(t, errors.Is(err, ErrCredentialNotFound))
+
+	// Ed25519 keys are supported, alongside others
+	ed := newSoftAuthenticator("example.com", "https://example.com", true)
+	_, err = register(ed)
+	require.NoError(t, err)
+	valid, err = p.VerifyStrategyToken(ctx, PurposeLogin, "passkey", "42", login(ctx, ed))
+	require.NoError(t, err)
+	require.True(t, valid)
+	all, err := creds.Credentials(ctx, "42")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	_, err = p.VerifyStrategyToken(ctx, PurposeLogin, "passkey", "42", "not json")
+	require.True(t, errors.Is(err, ErrWebAuthnResponseNotValid))
+}